@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jonestimd/backupd/internal/backend"
+	"github.com/jonestimd/backupd/internal/config"
+)
+
+// runAuthorize requests access to a backend and replaces its saved credentials.  Returns the exit status.
+func runAuthorize(cfg *config.Config, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: backupd authorize <backend>")
+		return 1
+	}
+	if err := backend.Authorize(configDir, dataDir, cfg, args[0]); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
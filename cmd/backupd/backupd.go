@@ -2,79 +2,29 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os/signal"
 	"sync"
+	"time"
 
 	"os"
 	"path/filepath"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/jonestimd/backupd/internal/backend"
 	"github.com/jonestimd/backupd/internal/config"
 	"github.com/jonestimd/backupd/internal/filesys"
 )
 
-// TODO handle mount/umount for watched directories
-// TODO wait for file to be closed before uploading
-
 const (
-	configFileName = "backupd.yml"
+	configFileName      = "backupd.yml"
+	defaultPollInterval = 10 * time.Minute // interval for rescanning directories that are not watched
 )
 
 var help = flag.Bool("h", false, "Show help")
 var configDir = flag.String("c", defaultConfigDir, "Configuration directory")
 var dataDir = flag.String("d", defaultDataDir, "Data directory")
-
-func startMonitor(dest *backend.Destination) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatalf("Error initializing file watcher for %s\n\t%v\n", *dest.LocalRoot, err)
-		os.Exit(1)
-	}
-	//defer watcher.Close()
-	go handleFileChanges(watcher, dest)
-
-	// TODO look for config files, handle ignored files
-	// TODO don't use Walk?  Is it too slow (due to sorting)?
-	go filepath.Walk(*dest.LocalRoot, func(path string, info os.FileInfo, err error) error {
-		// TODO how to handle input err
-		if err != nil {
-			log.Printf("Error walking %s: %v\n", path, err)
-		} else if info.IsDir() {
-			err := watcher.Add(path)
-			if err != nil {
-				log.Fatalf("Error adding watcher: %v\n", err)
-			}
-		} else if info.Mode().IsRegular() {
-			dest.Init(path)
-		}
-		return nil // TODO return SkipDir for ignored directories
-	})
-}
-
-func handleFileChanges(watcher *fsnotify.Watcher, dest *backend.Destination) {
-	for {
-		select {
-		case event := <-watcher.Events:
-			log.Println("event:", event)
-			if (event.Op & fsnotify.Write) == fsnotify.Write { // TODO is file still open?
-				dest.Update(event.Name)
-				printKey(event.Name)
-			}
-			if (event.Op & fsnotify.Remove) == fsnotify.Remove {
-				dest.Delete(event.Name)
-				printKey(event.Name)
-			}
-			if (event.Op & fsnotify.Create) == fsnotify.Create { // TODO is file still open?
-				dest.Add(event.Name)
-				printKey(event.Name)
-			}
-		case err := <-watcher.Errors:
-			log.Println("error:", err)
-		}
-	}
-}
+var dryRun = flag.Bool("dry-run", false, "Show the changes that would be backed up without making them")
 
 func printKey(path string) {
 	fileInfo, err := filesys.Stat(path)
@@ -85,38 +35,125 @@ func printKey(path string) {
 	}
 }
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [command]\n", os.Args[0])
+	fmt.Fprintln(flag.CommandLine.Output(), "Commands:")
+	fmt.Fprintln(flag.CommandLine.Output(), "  authorize\tRequest access to a backend and save the credentials")
+	fmt.Fprintln(flag.CommandLine.Output(), "  catalog\tExport or import the cached file records")
+	fmt.Fprintln(flag.CommandLine.Output(), "  db\tRebuild, check or compact the cache of a backend")
+	fmt.Fprintln(flag.CommandLine.Output(), "  restore\tDownload files from a backend")
+	fmt.Fprintln(flag.CommandLine.Output(), "  status\tShow the status of the running daemon")
+	fmt.Fprintln(flag.CommandLine.Output(), "  sync\tBack up changes once and exit")
+	fmt.Fprintln(flag.CommandLine.Output(), "  verify\tCompare the sources with their backups")
+	fmt.Fprintln(flag.CommandLine.Output(), "Runs as a daemon if no command is specified.  Options:")
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 	if *help {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	halt := make(chan bool)
 	configPath := filepath.Join(*configDir, configFileName)
 	cfg, err := config.Parse(configPath)
 	if err != nil {
 		log.Fatalf("Error reading configuration from %s\n\t%v\n", configPath, err)
 		os.Exit(1)
 	}
+
+	if *dryRun && flag.Arg(0) != "" && flag.Arg(0) != "sync" {
+		fmt.Fprintf(flag.CommandLine.Output(), "-dry-run is not supported by the %s command\n", flag.Arg(0))
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+		runDaemon(cfg)
+	case "authorize":
+		os.Exit(runAuthorize(cfg, flag.Args()[1:]))
+	case "catalog":
+		os.Exit(runCatalog(cfg, flag.Args()[1:]))
+	case "db":
+		os.Exit(runDb(cfg, flag.Args()[1:]))
+	case "restore":
+		os.Exit(runRestore(cfg, flag.Args()[1:]))
+	case "status":
+		os.Exit(runStatus(flag.Args()[1:]))
+	case "sync":
+		os.Exit(runSync(cfg, flag.Args()[1:]))
+	case "verify":
+		os.Exit(runVerify(cfg, flag.Args()[1:]))
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "Unknown command: %s\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// runDaemon watches the source directories and backs up changed files until the process is interrupted.
+func runDaemon(cfg *config.Config) {
 	if len(cfg.Sources) == 0 {
 		log.Print("No source directories, exiting")
 		os.Exit(1)
 	}
 
+	halt := make(chan bool)
 	var backendThreads sync.WaitGroup
-	dests := backend.Connect(configDir, dataDir, cfg, &backendThreads, halt)
-	for _, d := range dests {
-		// TODO look for deleted files
-		startMonitor(d)
+	var plan *backend.Plan
+	if *dryRun {
+		plan = backend.NewPlan(os.Stdout)
+	}
+	pollInterval, err := cfg.Watch.GetPollInterval(defaultPollInterval)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	opts := filesys.WatcherOptions{PollInterval: pollInterval}
+	if cfg.Watch != nil {
+		opts.Budget = cfg.Watch.Budget
+		opts.Fanotify = cfg.Watch.Mode == config.FanotifyMode
+	}
+	dests, err := backend.Connect(configDir, dataDir, cfg, plan, &backendThreads, halt)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	monitors := make([]*monitor, 0, len(dests))
+	for i, d := range dests {
+		rescanInterval, err := cfg.Sources[i].GetRescanInterval()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		m := newMonitor(d, opts)
+		if !d.Suspended() {
+			d.QueueDeleted()
+			m.start()
+		}
+		if rescanInterval > 0 {
+			m.rescanEvery(rescanInterval)
+		}
+		monitors = append(monitors, m)
+	}
+	watchMounts(monitors)
+	startMetrics(cfg, dests)
+	control, err := startControlSocket(dests)
+	if err != nil {
+		log.Printf("Error starting control socket: %v\n", err)
+	} else {
+		defer control.Close()
 	}
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, os.Kill)
 	<-done
-	halt <- true
+	close(halt) // stop all of the backends
 
 	log.Print("Waiting for incomplete actions")
 	backendThreads.Wait()
 	log.Println()
+	if plan != nil {
+		plan.PrintSummary(os.Stdout)
+	}
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jonestimd/backupd/internal/backend"
+	"github.com/jonestimd/backupd/internal/config"
+)
+
+// runCatalog exports or imports the file records in the cache of a backend.  The daemon must not be running.  Returns
+// the exit status.
+func runCatalog(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("catalog", flag.ExitOnError)
+	file := flags.String("f", "", "Catalog file (default stdout for export, stdin for import)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: backupd catalog export|import [options] <backend>")
+		fmt.Fprintln(flags.Output(), "  export\tWrite the cached file records as JSON lines")
+		fmt.Fprintln(flags.Output(), "  import\tAdd the file records from an exported catalog to an empty cache")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return 1
+	}
+	command := args[0]
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+	name := flags.Arg(0)
+
+	switch command {
+	case "export":
+		out := os.Stdout
+		if *file != "" {
+			f, err := os.Create(*file)
+			if err != nil {
+				log.Println(err)
+				return 1
+			}
+			defer f.Close()
+			out = f
+		}
+		count, err := backend.ExportCatalog(dataDir, cfg, name, out)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		log.Printf("Exported %d files\n", count)
+	case "import":
+		in := os.Stdin
+		if *file != "" {
+			f, err := os.Open(*file)
+			if err != nil {
+				log.Println(err)
+				return 1
+			}
+			defer f.Close()
+			in = f
+		}
+		count, err := backend.ImportCatalog(dataDir, cfg, name, in)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		log.Printf("Imported %d files\n", count)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown catalog command: %s\n", command)
+		flags.Usage()
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jonestimd/backupd/internal/backend"
+	"github.com/jonestimd/backupd/internal/config"
+)
+
+// runDb maintains the cache database of a backend.  The daemon must not be running.  Returns the exit status.
+func runDb(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("db", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "Correct the problems found by check")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: backupd db rebuild|check|compact [options] <backend>")
+		fmt.Fprintln(flags.Output(), "  rebuild\tReload the cache from the backend")
+		fmt.Fprintln(flags.Output(), "  check\tValidate the file records and paths in the cache")
+		fmt.Fprintln(flags.Output(), "  compact\tReclaim unused space in the cache")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return 1
+	}
+	command := args[0]
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+	name := flags.Arg(0)
+
+	switch command {
+	case "rebuild":
+		if err := backend.RebuildCache(configDir, dataDir, cfg, name); err != nil {
+			log.Println(err)
+			return 1
+		}
+	case "check":
+		problems, err := backend.CheckCache(dataDir, cfg, name, *fix)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		fmt.Printf("Found %d problems\n", len(problems))
+		if len(problems) > 0 && !*fix {
+			return 1
+		}
+	case "compact":
+		before, after, err := backend.CompactCache(dataDir, cfg, name)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		fmt.Printf("Compacted from %d to %d bytes\n", before, after)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown db command: %s\n", command)
+		flags.Usage()
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/jonestimd/backupd/internal/backend"
+	"github.com/jonestimd/backupd/internal/config"
+	"github.com/jonestimd/backupd/internal/metrics"
+)
+
+// startMetrics serves the Prometheus metrics if a listen address is configured.
+func startMetrics(cfg *config.Config, dests []*backend.Destination) {
+	if cfg.Metrics == nil || cfg.Metrics.Listen == "" {
+		return
+	}
+	backend.RegisterMetrics(metrics.Default, dests)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	go func() {
+		if err := http.ListenAndServe(cfg.Metrics.Listen, mux); err != nil {
+			log.Printf("Error serving metrics on %s: %v\n", cfg.Metrics.Listen, err)
+		}
+	}()
+}
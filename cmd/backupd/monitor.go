@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/backend"
+	"github.com/jonestimd/backupd/internal/filesys"
+)
+
+// monitor watches a source folder for changes.  The destination is suspended while the filesystems of the source
+// folder are not mounted.
+type monitor struct {
+	dest    *backend.Destination
+	opts    filesys.WatcherOptions
+	mutex   sync.Mutex
+	watcher filesys.FileWatcher
+	stop    chan struct{}
+	mounts  filesys.MountState // filesystems of the source folder when it was last available
+}
+
+// newMonitor creates a monitor for a destination.  The destination is suspended if its source folder does not exist.
+func newMonitor(dest *backend.Destination, opts filesys.WatcherOptions) *monitor {
+	opts.OnWatch = func(dir string, added bool) {
+		if added {
+			dest.WatchAdded()
+		} else {
+			dest.WatchRemoved()
+		}
+	}
+	opts.Exclude = dest.Excluded
+	m := &monitor{dest: dest, opts: opts}
+	if mounts, err := filesys.ReadMounts(); err != nil {
+		log.Printf("Error reading mounts: %v\n", err)
+	} else if _, err := os.Stat(*dest.LocalRoot); err != nil {
+		log.Printf("Suspending %s: %v\n", *dest.LocalRoot, err)
+		dest.Suspend()
+	} else {
+		m.mounts = filesys.NewMountState(mounts, *dest.LocalRoot)
+	}
+	return m
+}
+
+// start watches the source folder and scans it for changes.
+func (m *monitor) start() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.stop = make(chan struct{})
+	// TODO look for config files, handle ignored files
+	go func(stop chan struct{}) {
+		watcher, err := filesys.NewFileWatcher(m.opts, *m.dest.LocalRoot)
+		if watcher == nil {
+			log.Fatalf("Error initializing file watcher for %s\n\t%v\n", *m.dest.LocalRoot, err)
+		}
+		if err != nil {
+			log.Printf("Error watching %s: %v\n", *m.dest.LocalRoot, err)
+		}
+		m.mutex.Lock()
+		select {
+		case <-stop:
+			watcher.Close()
+			m.mutex.Unlock()
+			return
+		default:
+			m.watcher = watcher
+		}
+		m.mutex.Unlock()
+		go handleFileChanges(watcher, stop, m.dest)
+		m.dest.Scan()
+	}(m.stop)
+}
+
+// restart replaces the watcher so that the watches are added for the current filesystems.
+func (m *monitor) restart() {
+	m.halt()
+	m.start()
+}
+
+// halt closes the watcher.
+func (m *monitor) halt() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+	if m.watcher != nil {
+		m.watcher.Close()
+		m.watcher = nil
+	}
+}
+
+// mountsChanged suspends the destination if one of the filesystems of the source folder has been unmounted.  A
+// suspended destination is resumed and rescanned when the same filesystems are mounted again.  The source folder is
+// also rescanned when a filesystem is mounted inside of it.
+func (m *monitor) mountsChanged(mounts []filesys.Mount) {
+	root := *m.dest.LocalRoot
+	current := filesys.NewMountState(mounts, root)
+	if m.mounts == nil {
+		// the source folder didn't exist at startup
+		if _, err := os.Stat(root); err != nil {
+			return
+		}
+		m.mounts = current
+	}
+	if missing := m.mounts.Missing(current); len(missing) > 0 {
+		if !m.dest.Suspended() {
+			log.Printf("Suspending %s: %v not mounted\n", root, missing)
+			m.dest.Suspend()
+			m.halt()
+		}
+		return
+	}
+	added := current.Missing(m.mounts)
+	m.mounts = current
+	if m.dest.Suspended() {
+		log.Printf("Resuming %s\n", root)
+		m.dest.Resume()
+		m.restart()
+		m.dest.QueueDeleted()
+	} else if len(added) > 0 {
+		log.Printf("Rescanning %s: %v mounted\n", root, added)
+		m.restart()
+		m.dest.QueueDeleted()
+	}
+}
+
+// rescanEvery periodically compares the source folder with its backups to find the changes that were missed by the
+// watcher.
+func (m *monitor) rescanEvery(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if m.dest.Suspended() {
+				continue
+			}
+			start := time.Now()
+			missed := m.dest.Resync()
+			log.Printf("Rescan of %s found %d missed changes in %v\n", *m.dest.LocalRoot, missed,
+				time.Since(start).Round(time.Second))
+		}
+	}()
+}
+
+// watchMounts notifies the monitors of changes to the mounted filesystems.
+func watchMounts(monitors []*monitor) {
+	watcher, err := filesys.NewMountWatcher()
+	if err != nil {
+		log.Printf("Error watching mounts: %v\n", err)
+		return
+	}
+	go func() {
+		for mounts := range watcher.Mounts() {
+			for _, m := range monitors {
+				m.mountsChanged(mounts)
+			}
+		}
+	}()
+}
+
+func handleFileChanges(watcher filesys.FileWatcher, stop chan struct{}, dest *backend.Destination) {
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-watcher.Events():
+			if dest.Excluded(event.Path) {
+				continue
+			}
+			log.Println("event:", event.Op, event.Path)
+			if event.Op == filesys.Create || event.Op == filesys.Write {
+				printKey(event.Path)
+			}
+			dest.HandleEvent(event)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/backend"
+	"github.com/jonestimd/backupd/internal/config"
+)
+
+// runRestore downloads files from a backend.  Returns the exit status.
+func runRestore(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	inPlace := flags.Bool("in-place", false, "Restore files to their source directories")
+	asOf := flags.String("as-of", "", "Restore the versions that were current at this time (RFC3339 or YYYY-MM-DD)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: backupd restore [options] <backend> <remote path or glob> [target directory]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 3 && !(*inPlace && flags.NArg() == 2) {
+		flags.Usage()
+		return 1
+	}
+
+	opts := &backend.RestoreOptions{Backend: flags.Arg(0), Pattern: flags.Arg(1), Target: flags.Arg(2), InPlace: *inPlace}
+	if *asOf != "" {
+		var err error
+		if opts.AsOf, err = parseTime(*asOf); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	count, err := backend.Restore(configDir, dataDir, cfg, opts)
+	log.Printf("Restored %d files\n", count)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// parseTime parses an RFC3339 timestamp or a local date.
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid time: %s", value)
+}
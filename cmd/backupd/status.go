@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/backend"
+)
+
+const socketFileName = "backupd.sock"
+
+func socketPath() string {
+	return filepath.Join(*dataDir, socketFileName)
+}
+
+// startControlSocket listens on a Unix domain socket and writes the daemon's status as JSON to each connection.
+func startControlSocket(dests []*backend.Destination) (net.Listener, error) {
+	path := socketPath()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return // listener closed
+			}
+			if err := json.NewEncoder(conn).Encode(backend.GetStatus(dests)); err != nil {
+				log.Printf("Error writing status: %v\n", err)
+			}
+			conn.Close()
+		}
+	}()
+	return listener, nil
+}
+
+// runStatus prints the status of the running daemon.  Returns the exit status.
+func runStatus(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: backupd status")
+		return 1
+	}
+	conn, err := net.Dial("unix", socketPath())
+	if err != nil {
+		log.Printf("Error connecting to backupd: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+	status := &backend.Status{}
+	if err := json.NewDecoder(conn).Decode(status); err != nil {
+		log.Printf("Error reading status: %v\n", err)
+		return 1
+	}
+	printStatus(os.Stdout, status)
+	return 0
+}
+
+func printStatus(w io.Writer, status *backend.Status) {
+	for _, b := range status.Backends {
+		fmt.Fprintf(w, "%s: %d queued\n", b.Name, b.Queued)
+		if op := b.InFlight; op != nil {
+			fmt.Fprintf(w, "  %s %s: %d of %d bytes, started %s\n", op.Action, op.Path, op.Transferred, op.Size,
+				op.Started.Format(time.RFC3339))
+		}
+		if len(b.Failures) > 0 {
+			fmt.Fprintln(w, "  Recent failures:")
+			for _, f := range b.Failures {
+				fmt.Fprintf(w, "    %s %s %s: %s\n", f.Time.Format(time.RFC3339), f.Action, f.Path, f.Error)
+			}
+		}
+	}
+	for _, s := range status.Sources {
+		lastBackup := "never"
+		if s.LastBackup != nil {
+			lastBackup = s.LastBackup.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s -> %s:%s\n  last backup: %s, watched directories: %d\n", s.Path, s.Backend, s.Folder,
+			lastBackup, s.Watched)
+		if s.Suspended {
+			fmt.Fprintln(w, "  suspended: filesystem not mounted")
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/jonestimd/backupd/internal/backend"
+	"github.com/jonestimd/backupd/internal/config"
+)
+
+// runSync backs up the changes to the sources and exits.  Returns the exit status.
+func runSync(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	source := flags.String("source", "", "Path of the source to back up (default all sources)")
+	// the global -dry-run option also applies to sync
+	syncDryRun := flags.Bool("dry-run", *dryRun, "Show the changes that would be made without making them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: backupd sync [options]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 1
+	}
+
+	halt := make(chan bool)
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		close(halt)
+	}()
+
+	opts := &backend.SyncOptions{Source: *source}
+	if *syncDryRun {
+		opts.Plan = backend.NewPlan(os.Stdout)
+	}
+	summary, err := backend.Sync(configDir, dataDir, cfg, opts, halt)
+	if opts.Plan != nil {
+		opts.Plan.PrintSummary(os.Stdout)
+	} else if summary != nil {
+		printSummary(os.Stdout, summary)
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if summary.Failures() > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printSummary(w io.Writer, summary *backend.SyncSummary) {
+	for _, action := range []backend.Action{backend.StoreAction, backend.UpdateAction, backend.TrashAction} {
+		fmt.Fprintf(w, "%s: %d succeeded, %d failed\n", action, summary.Succeeded[action], summary.Failed[action])
+	}
+	if summary.ScanErrors > 0 {
+		fmt.Fprintf(w, "%d files could not be read\n", summary.ScanErrors)
+	}
+}
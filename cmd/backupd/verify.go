@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/jonestimd/backupd/internal/backend"
+	"github.com/jonestimd/backupd/internal/config"
+)
+
+// runVerify compares the sources with their backups.  Returns the exit status.
+func runVerify(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	source := flags.String("source", "", "Path of the source to verify (default all sources)")
+	remote := flags.Bool("remote", false, "Compare the cache with a new listing of the backend")
+	sample := flags.String("sample", "", "Percentage of the backed up files to download and check, e.g. 5%")
+	fix := flags.Bool("fix", false, "Back up or trash files to correct the problems")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: backupd verify [options]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 1
+	}
+	opts := &backend.VerifyOptions{Source: *source, Remote: *remote, Fix: *fix}
+	if *sample != "" {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(*sample, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			fmt.Fprintf(flags.Output(), "Invalid sample: %s\n", *sample)
+			return 1
+		}
+		opts.Sample = percent
+	}
+
+	halt := make(chan bool)
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		close(halt)
+	}()
+
+	report, err := backend.Verify(configDir, dataDir, cfg, opts, halt)
+	if report != nil {
+		printReport(os.Stdout, report)
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if len(report.Problems) > 0 && (report.Fixed == nil || report.Fixed.Failures() > 0) {
+		return 1
+	}
+	return 0
+}
+
+func printReport(w io.Writer, report *backend.VerifyReport) {
+	for _, p := range report.Problems {
+		if p.Detail == "" {
+			fmt.Fprintf(w, "%s %s\n", p.Kind, p.LocalPath)
+		} else {
+			fmt.Fprintf(w, "%s %s: %s\n", p.Kind, p.LocalPath, p.Detail)
+		}
+	}
+	fmt.Fprintf(w, "Checked %d files, downloaded %d files, found %d problems\n", report.Checked, report.Sampled,
+		len(report.Problems))
+	if report.Fixed != nil {
+		printSummary(w, report.Fixed)
+	}
+}
@@ -1,119 +1,538 @@
 package backend
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"path/filepath"
 	"time"
 
 	"github.com/jonestimd/backupd/internal/config"
 	"github.com/jonestimd/backupd/internal/database"
-	"github.com/jonestimd/backupd/internal/filesys"
 )
 
 // backupService is the interface for reading and writing remote files/directories.
+// An empty parentID refers to the root folder of the backend.
 type backupService interface {
-	loadFiles() (chan database.FileOrError, error)
-	//store(localPath *string, fileID *filesys.FileID, dest *Destination)
-	//update(localPath *string)
+	loadFiles(ctx context.Context) (chan database.FileOrError, error)
+	isFolder(rf *database.RemoteFile) bool
+	createFolder(name string, parentID string) (*database.RemoteFile, error)
+	store(localPath string, name string, parentID string, meta *fileMetadata) (*database.RemoteFile, error)
+	update(localPath string, rf *database.RemoteFile, meta *fileMetadata) (*database.RemoteFile, error)
+	updateMetadata(rf *database.RemoteFile, meta *fileMetadata) (*database.RemoteFile, error)
+	link(name string, parentID string, target *database.RemoteFile, meta *fileMetadata) (*database.RemoteFile, error)
+	download(rf *database.RemoteFile, w io.Writer) error
+	revisions(rf *database.RemoteFile) ([]*database.Revision, error)
+	downloadRevision(rf *database.RemoteFile, revisionID string, w io.Writer) error
 	//move(newLocalPath *string, rf *database.RemoteFile)
-	//trash(localPath *string)
+	trash(rf *database.RemoteFile) error
+	retryable(err error) bool
 }
 
 // A backend represents a backup storage location.  A backend may be associated with multiple local directories.
 type backend struct {
+	name  string
 	queue *Queue            // pending updates
 	cache *database.BoltDao // Bolt database of backup state
 	srv   backupService     // Google Drive, etc.
+	quota *uploadQuota      // daily upload limit (nil for no limit)
+	state backendState      // activity for status reporting
+	plan  *Plan             // records operations instead of performing them (nil if not a dry run)
+	dests []*Destination    // destinations that use the backend
+	// maximum difference between a local and a remote modification time for the file to be considered unchanged
+	modTimeTolerance time.Duration
 }
 
-type serviceFactory func(configDir *string, dataDir *string, cfg *config.Backend) (backupService, error)
+// serviceFactory creates a backupService.  folders contains the remote backup folders of the sources that use the
+// backend.
+type serviceFactory func(configDir *string, dataDir *string, cfg *config.Backend, folders []string) (backupService, error)
 
 var serviceFactories = map[string]serviceFactory{
-	config.GoogleDriveName: func(configDir *string, dataDir *string, cfg *config.Backend) (backupService, error) {
-		return newGoogleDrive(configDir, dataDir, cfg)
+	config.GoogleDriveName: func(configDir *string, dataDir *string, cfg *config.Backend, folders []string) (backupService, error) {
+		return newGoogleDrive(configDir, dataDir, cfg, folders)
 	},
 }
 
+// authorizer requests access to a backend and saves the credentials.
+type authorizer func(configDir *string, dataDir *string, cfg *config.Backend) error
+
+var authorizers = map[string]authorizer{
+	config.GoogleDriveName: authorizeGoogleDrive,
+}
+
 var defaultDataFile = map[string]string{
 	config.GoogleDriveName: "googleDrive.db",
 }
 
-// Connect initializes the backends.
-func Connect(configDir *string, dataDir *string, backupConfig *config.Config, wg *sync.WaitGroup, halt chan bool) []*Destination {
+// errHalted indicates that an action was interrupted by halt.
+var errHalted = errors.New("halted")
+
+// retryDelays are the delays before retrying an action that failed with a transient error.
+var retryDelays = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// defaultUploadLimit is the default max bytes per day for each backend type.
+var defaultUploadLimit = map[string]int64{
+	config.GoogleDriveName: 750000000000,
+}
+
+// defaultModTimeTolerance is the default modification time tolerance for each backend type.  Drive stores
+// modification times with millisecond precision.
+var defaultModTimeTolerance = map[string]time.Duration{
+	config.GoogleDriveName: time.Millisecond,
+}
+
+// Connect initializes the backends.  If plan is not nil then the remote operations are recorded in the plan instead of
+// being performed.
+func Connect(configDir *string, dataDir *string, backupConfig *config.Config, plan *Plan, wg *sync.WaitGroup, halt chan bool) ([]*Destination, error) {
 	backends := make(map[string]*backend)
 	for name, cfg := range backupConfig.Backends {
-		factory := serviceFactories[cfg.Type]
-		if factory != nil {
-			srv, err := factory(configDir, dataDir, cfg)
+		if serviceFactories[cfg.Type] != nil {
+			b, err := openBackend(configDir, dataDir, backupConfig, name)
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
-			backends[name] = newBackend(srv, dataDir, cfg)
-			go backends[name].processQueue(wg, halt)
+			b.plan = plan
+			backends[name] = b
 		} else {
 			log.Println("Unknown destination type: " + cfg.Type)
 		}
 	}
-	dests := make([]*Destination, len(backupConfig.Sources))
-	for i, s := range backupConfig.Sources {
+	dests := newDestinations(backupConfig.Sources, backupConfig.Watch, backends)
+	for _, b := range backends {
+		go b.processQueue(wg, halt)
+	}
+	return dests, nil
+}
+
+// newDestinations creates the destinations of the sources using the backends.  The periodic rescans of all of the
+// sources share the rescanRate limit.
+func newDestinations(sources []*config.Source, watch *config.Watch, backends map[string]*backend) []*Destination {
+	var scanLimiter *rateLimiter
+	var scanWorkers int
+	if watch != nil {
+		if watch.RescanRate > 0 {
+			scanLimiter = newRateLimiter(float64(watch.RescanRate), watch.RescanRate)
+		}
+		scanWorkers = watch.ScanWorkers
+	}
+	dests := make([]*Destination, len(sources))
+	for i, s := range sources {
 		dests[i] = newDestination(backends[*s.Destination.Backend], s.Path, s.Destination.Folder, s.Destination.Encrypt)
+		dests[i].scanLimiter = scanLimiter
+		dests[i].scanWorkers = scanWorkers
+		dests[i].exclude = s.Exclude
+		dests[i].symlinks = s.Symlinks
+		if dests[i].backend != nil {
+			dests[i].backend.dests = append(dests[i].backend.dests, dests[i])
+		}
 	}
 	return dests
 }
 
-func newBackend(srv backupService, dataDir *string, cfg *config.Backend) *backend {
-	dataFile := filepath.Join(*dataDir, cfg.GetParameter("dataFile", defaultDataFile[cfg.Type]))
-	cache, err := database.OpenDb(dataFile, srv.loadFiles)
+// backupFolders returns the remote folders of the sources that use the backend.
+func backupFolders(backendName string, sources []*config.Source) []string {
+	folders := make([]string, 0, len(sources))
+	for _, s := range sources {
+		if *s.Destination.Backend == backendName && s.Destination.Folder != nil {
+			folders = append(folders, *s.Destination.Folder)
+		}
+	}
+	return folders
+}
+
+// backendSources returns the sources that use the backend.
+func backendSources(backendName string, sources []*config.Source) []*config.Source {
+	matches := make([]*config.Source, 0, len(sources))
+	for _, s := range sources {
+		if *s.Destination.Backend == backendName {
+			matches = append(matches, s)
+		}
+	}
+	return matches
+}
+
+// openBackend connects to a backend and opens its cache.
+func openBackend(configDir *string, dataDir *string, backupConfig *config.Config, name string) (*backend, error) {
+	srv, cfg, err := newService(configDir, dataDir, backupConfig, name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := newBackend(srv, dataDir, cfg)
+	if err != nil {
+		return nil, err
+	}
+	b.name = name
+	return b, nil
+}
+
+// newService connects to a backend.
+func newService(configDir *string, dataDir *string, backupConfig *config.Config, name string) (backupService, *config.Backend, error) {
+	cfg, err := backendConfig(backupConfig, name)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
+	}
+	factory := serviceFactories[cfg.Type]
+	if factory == nil {
+		return nil, nil, errors.New("Unknown destination type: " + cfg.Type)
 	}
-	return &backend{queue: NewQueue(), cache: cache, srv: srv}
+	srv, err := factory(configDir, dataDir, cfg, backupFolders(name, backupConfig.Sources))
+	if _, ok := err.(*tokenScopeError); ok {
+		return nil, nil, fmt.Errorf("%v: run \"backupd authorize %s\" to authorize the new scope", err, name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return srv, cfg, nil
 }
 
+// Authorize requests access to a backend and replaces its saved credentials.
+func Authorize(configDir *string, dataDir *string, backupConfig *config.Config, name string) error {
+	cfg, err := backendConfig(backupConfig, name)
+	if err != nil {
+		return err
+	}
+	authorize := authorizers[cfg.Type]
+	if authorize == nil {
+		return errors.New("Unknown destination type: " + cfg.Type)
+	}
+	return authorize(configDir, dataDir, cfg)
+}
+
+func backendConfig(backupConfig *config.Config, name string) (*config.Backend, error) {
+	cfg := backupConfig.Backends[name]
+	if cfg == nil {
+		return nil, errors.New("Backend not configured: " + name)
+	}
+	return cfg, nil
+}
+
+// dataFile returns the path of a backend's cache database.
+func dataFile(dataDir *string, cfg *config.Backend) string {
+	return filepath.Join(*dataDir, cfg.GetParameter("dataFile", defaultDataFile[cfg.Type]))
+}
+
+func newBackend(srv backupService, dataDir *string, cfg *config.Backend) (*backend, error) {
+	uploadLimit, err := cfg.GetIntParameter("dailyUploadLimit", defaultUploadLimit[cfg.Type])
+	if err != nil {
+		return nil, err
+	}
+	modTimeTolerance, err := cfg.GetDurationParameter("modTimeTolerance", defaultModTimeTolerance[cfg.Type])
+	if err != nil {
+		return nil, err
+	}
+	cache, err := database.OpenDb(dataFile(dataDir, cfg), srv.loadFiles)
+	if err != nil {
+		return nil, err
+	}
+	b := &backend{queue: NewQueue(), cache: cache, srv: srv, modTimeTolerance: modTimeTolerance}
+	if uploadLimit > 0 {
+		b.quota = newUploadQuota(uint64(uploadLimit), cache)
+	}
+	return b, nil
+}
+
+// processQueue performs the queued actions until halt is closed.  A message that is interrupted by halt is put back on
+// the queue.
 func (b *backend) processQueue(wg *sync.WaitGroup, halt chan bool) {
 	wg.Add(1)
-	for _, ok := <-halt; !ok; _, ok = <-halt {
-		m := b.queue.Get()
-		switch m.action {
-		case StoreAction:
-			if fileID, err := filesys.Stat(*m.local); err == nil {
-				if rf := b.cache.FindByID(fileID); rf != nil {
-					//service.move(m.local, rf)
-				} else {
-					//service.store(m.local, fileID, m.dest)
-				}
-			} else {
-				log.Printf("Can't stat %s\n", *m.local)
+	defer wg.Done()
+	for m := b.queue.Get(halt); m != nil; m = b.queue.Get(halt) {
+		if !b.waitForQuota(m, halt) || b.process(m, halt) == errHalted {
+			b.queue.Requeue(m)
+			return
+		}
+		if b.queue.Len() == 0 {
+			b.drained()
+		}
+	}
+}
+
+// drained records the destinations that have no failed actions as backed up after the queue has been emptied.
+func (b *backend) drained() {
+	for _, d := range b.dests {
+		d.upToDate(false)
+	}
+}
+
+// waitForQuota blocks until the daily upload limit allows the file to be uploaded.  The usage is only updated after
+// the file has been uploaded (see chargeUpload).  Returns false if halted while waiting.
+func (b *backend) waitForQuota(m *Message, halt chan bool) bool {
+	if b.quota == nil || b.plan != nil || m.action == TrashAction {
+		return true
+	}
+	info, err := os.Stat(*m.local)
+	if err != nil {
+		return true
+	}
+	for resume := b.quota.check(uint64(info.Size())); !resume.IsZero(); resume = b.quota.check(uint64(info.Size())) {
+		log.Printf("Daily upload limit reached, pausing until %s\n", resume.Format(time.RFC3339))
+		select {
+		case <-halt:
+			return false
+		case <-time.After(time.Until(resume)):
+		}
+	}
+	return true
+}
+
+// process performs the action for a message.  For a dry run, the action is added to the plan.  The action is retried
+// if it fails with a transient error.  Returns errHalted if halt is closed while waiting to retry.
+func (b *backend) process(m *Message, halt chan bool) error {
+	if b.plan != nil {
+		return b.plan.add(b, m)
+	}
+	b.state.start(m)
+	err := b.perform(m)
+	for attempt := 0; err != nil && attempt < len(retryDelays) && b.srv.retryable(err); attempt++ {
+		log.Printf("Retrying %s in %v: %v\n", *m.local, retryDelays[attempt], err)
+		retriesTotal.Inc(b.name)
+		select {
+		case <-halt:
+			log.Printf("Not retrying %s: halted\n", *m.local)
+			b.state.abort()
+			return errHalted
+		case <-time.After(retryDelays[attempt]):
+		}
+		err = b.perform(m)
+	}
+	if err != nil {
+		log.Printf("Error backing up %s: %v\n", *m.local, err)
+		operationsTotal.Inc(b.name, m.action.String(), "error")
+	} else {
+		operationsTotal.Inc(b.name, m.action.String(), "success")
+	}
+	b.state.finish(m, err)
+	return err
+}
+
+// perform attempts the action for a message.  The transferred byte count is reset so that only the last attempt is
+// charged to the upload quota.
+func (b *backend) perform(m *Message) error {
+	atomic.StoreInt64(&b.state.transferred, 0)
+	if m.action != TrashAction {
+		if _, err := os.Lstat(*m.local); os.IsNotExist(err) {
+			log.Printf("Skipping %s: file no longer exists\n", *m.local)
+			return nil
+		}
+	}
+	switch m.action {
+	case StoreAction:
+		return b.store(m)
+	case UpdateAction:
+		return b.update(m)
+	case TrashAction:
+		return b.trash(m)
+	}
+	return nil
+}
+
+// store uploads a new file.  If another path of the file has already been backed up then a link to that backup is
+// created instead of uploading the content again.
+func (b *backend) store(m *Message) error {
+	meta, err := newFileMetadata(*m.local, m.preserveLink())
+	if err != nil {
+		return err
+	}
+	meta.progress = &b.state.transferred
+	dir, name := filepath.Split(*m.remote)
+	parentID, err := b.folderID(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+	if target := b.hardLinkTarget(m, meta); target != nil {
+		start := time.Now()
+		rf, err := b.srv.link(name, parentID, target, meta)
+		b.observe("link", start)
+		if err != nil {
+			return err
+		}
+		return b.cache.Save(rf)
+	}
+	start := time.Now()
+	rf, err := b.srv.store(*m.local, name, parentID, meta)
+	b.observe("store", start)
+	if err != nil {
+		return err
+	}
+	b.chargeUpload()
+	uploadedBytes.Add(float64(rf.Size), b.name)
+	return b.saveUpload(rf, meta)
+}
+
+// update uploads the new content of a file.  The file is stored if it hasn't been backed up.  If only the attributes
+// of the file have changed then the backup's metadata is updated without uploading the content.
+func (b *backend) update(m *Message) error {
+	rf := b.cache.FindByPath(*m.remote)
+	if rf == nil {
+		return b.store(m)
+	}
+	if rf.TargetID != nil && b.hardLinkChanged(*m.local, rf) {
+		// the path is no longer linked to the backed up content
+		if err := b.trashFile(rf); err != nil {
+			return err
+		}
+		return b.store(m)
+	}
+	meta, err := newFileMetadata(*m.local, m.preserveLink())
+	if err != nil {
+		return err
+	}
+	if b.contentUnchanged(m, rf) {
+		if !meta.attributesChanged(rf) {
+			log.Printf("Skipping %s: content unchanged\n", *m.local)
+			return nil
+		}
+		start := time.Now()
+		rf, err = b.srv.updateMetadata(rf, meta)
+		b.observe("updateMetadata", start)
+		if err != nil {
+			return err
+		}
+		return b.cache.Save(rf)
+	}
+	meta.progress = &b.state.transferred
+	start := time.Now()
+	rf, err = b.srv.update(*m.local, rf, meta)
+	b.observe("update", start)
+	if err != nil {
+		return err
+	}
+	b.chargeUpload()
+	uploadedBytes.Add(float64(rf.Size), b.name)
+	return b.saveUpload(rf, meta)
+}
+
+// chargeUpload adds the bytes transferred by the current attempt to the daily upload usage.  Called after the content
+// of a file has been uploaded.
+func (b *backend) chargeUpload() {
+	if b.quota != nil {
+		b.quota.add(uint64(atomic.LoadInt64(&b.state.transferred)))
+	}
+}
+
+// contentUnchanged returns true if the content of a local file (or the target of a preserved link) matches its backup.
+func (b *backend) contentUnchanged(m *Message, rf *database.RemoteFile) bool {
+	if rf.TargetID != nil {
+		return true // checked by hardLinkChanged
+	}
+	if target, ok := m.dest.linkTarget(*m.local); ok {
+		return rf.LinkTarget != nil && *rf.LinkTarget == target
+	}
+	return b.unchanged(*m.local, rf)
+}
+
+// saveUpload updates the cache after a file has been uploaded.  The new version of the file is added to the file's
+// revisions.
+func (b *backend) saveUpload(rf *database.RemoteFile, meta *fileMetadata) error {
+	if err := b.cache.Save(rf); err != nil {
+		return err
+	}
+	if rf.RevisionID == nil {
+		return nil
+	}
+	return b.cache.AddRevision(*rf.RemoteID, &database.Revision{ID: *rf.RevisionID, Uploaded: time.Now(),
+		ModTime: meta.modTime, Md5Checksum: *rf.Md5Checksum})
+}
+
+// trash moves the backup of a deleted file to the trash.  The backup is kept if the file has been replaced, e.g. by an
+// editor that saves by renaming.  The saved checksums of the file are deleted unless other paths are linked to it.
+func (b *backend) trash(m *Message) error {
+	rf := b.cache.FindByPath(*m.remote)
+	if rf == nil {
+		return nil
+	}
+	if _, err := os.Lstat(*m.local); err == nil {
+		log.Printf("Skipping trash of %s: file has been replaced\n", *m.local)
+		return nil
+	}
+	if err := b.trashFile(rf); err != nil {
+		return err
+	}
+	var others []string
+	if m.dest != nil {
+		others = m.dest.hardLinks.remove(*m.local)
+		if rf.TargetID == nil {
+			// the other paths of the file were linked to the trashed content
+			for _, localPath := range others {
+				localPath, remotePath := localPath, m.dest.RemotePath(localPath)
+				b.queue.Add(&Message{&localPath, &remotePath, UpdateAction, m.dest})
 			}
-		case UpdateAction:
-			//service.update(m.local)
-		case TrashAction:
-			//service.trash(m.local)
 		}
 	}
-	wg.Done()
+	if rf.LocalID != nil && len(others) == 0 {
+		// the checksums are still valid for the other paths of a hard linked file
+		if err := b.cache.DeleteLocalHash(*rf.LocalID); err != nil {
+			log.Printf("Error deleting checksums of %s: %v\n", *m.local, err)
+		}
+	}
+	return nil
+}
+
+// trashFile moves a backup to the trash.
+func (b *backend) trashFile(rf *database.RemoteFile) error {
+	start := time.Now()
+	err := b.srv.trash(rf)
+	b.observe("trash", start)
+	if err != nil {
+		return err
+	}
+	return b.cache.Trash(*rf.RemoteID, time.Now())
+}
+
+// folderID returns the remote ID of a folder.  Missing folders are created.  Returns an empty string for the root
+// folder.
+func (b *backend) folderID(remotePath string) (string, error) {
+	if remotePath == string(filepath.Separator) || remotePath == "." {
+		return "", nil
+	}
+	if rf := b.cache.FindByPath(remotePath); rf != nil {
+		return *rf.RemoteID, nil
+	}
+	dir, name := filepath.Split(remotePath)
+	parentID, err := b.folderID(filepath.Clean(dir))
+	if err != nil {
+		return "", err
+	}
+	start := time.Now()
+	rf, err := b.srv.createFolder(name, parentID)
+	b.observe("createFolder", start)
+	if err != nil {
+		return "", err
+	}
+	return *rf.RemoteID, b.cache.Save(rf)
 }
 
 // Init checks the status of the file and adds it to the backup queue if it has changed or if it has never been backed up.
-// Used for startup.
-func (b *backend) Init(localPath string, remotePath string) {
+// Used for startup.  Returns true if the file was added to the queue.  Returns an error if the file can't be read.
+func (b *backend) Init(localPath string, remotePath string, dest *Destination) (bool, error) {
 	rf := b.cache.FindByPath(remotePath)
 	if rf == nil { // TODO verify local file still exists?
-		b.queue.Add(&Message{&localPath, &remotePath, StoreAction})
-	} else {
-		info, err := os.Stat(localPath)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				log.Fatalf("Error getting status of %s: %v\n", localPath, err)
-			}
-		} else {
-			// TODO check checksum?  don't check mod time?
-			if uint64(info.Size()) != rf.Size || info.ModTime().Format(time.RFC3339) > *rf.LastModified {
-				b.queue.Add(&Message{&localPath, &remotePath, UpdateAction})
-			}
+		b.queue.Add(&Message{&localPath, &remotePath, StoreAction, dest})
+		return true, nil
+	}
+	if target, ok := dest.linkTarget(localPath); ok {
+		if rf.LinkTarget != nil && *rf.LinkTarget == target && !attributesChanged(localPath, true, rf) {
+			return false, nil
 		}
+		b.queue.Add(&Message{&localPath, &remotePath, UpdateAction, dest})
+		return true, nil
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if b.changed(localPath, info, rf) || attributesChanged(localPath, false, rf) {
+		b.queue.Add(&Message{&localPath, &remotePath, UpdateAction, dest})
+		return true, nil
 	}
+	return false, nil
 }
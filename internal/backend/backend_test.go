@@ -1,6 +1,11 @@
 package backend
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"sync"
 	"testing"
 
@@ -19,14 +24,115 @@ type mockService struct {
 	configDir *string
 	dataDir   *string
 	cfg       *config.Backend
+	folders   []string
+	nextID    int
+	calls     []string
+	err       error
+	content   map[string]string // file content by remote ID or revision ID
+	revs      map[string][]*database.Revision
+	failures  int                    // number of calls that fail with a retryable error
+	remote    []*database.RemoteFile // files returned by loadFiles
+}
+
+var errRetryable = errors.New("retryable")
+
+func (ms *mockService) retryable(err error) bool {
+	return err == errRetryable
+}
+
+// fail returns the error for a call.
+func (ms *mockService) fail() error {
+	if ms.failures > 0 {
+		ms.failures--
+		return errRetryable
+	}
+	return ms.err
+}
+
+func (ms *mockService) isFolder(rf *database.RemoteFile) bool {
+	return rf.MimeType == defaultFolderMimeType
+}
+
+func (ms *mockService) download(rf *database.RemoteFile, w io.Writer) error {
+	ms.calls = append(ms.calls, "download "+rf.Name)
+	if ms.err != nil {
+		return ms.err
+	}
+	_, err := io.WriteString(w, ms.content[*rf.RemoteID])
+	return err
+}
+
+func (ms *mockService) revisions(rf *database.RemoteFile) ([]*database.Revision, error) {
+	ms.calls = append(ms.calls, "revisions "+rf.Name)
+	return ms.revs[*rf.RemoteID], ms.err
+}
+
+func (ms *mockService) downloadRevision(rf *database.RemoteFile, revID string, w io.Writer) error {
+	ms.calls = append(ms.calls, "downloadRevision "+rf.Name+" "+revID)
+	if ms.err != nil {
+		return ms.err
+	}
+	_, err := io.WriteString(w, ms.content[revID])
+	return err
+}
+
+func (ms *mockService) trash(rf *database.RemoteFile) error {
+	ms.calls = append(ms.calls, "trash "+rf.Name)
+	return ms.err
+}
+
+func (ms *mockService) newFile(name string, parentID string) *database.RemoteFile {
+	ms.nextID++
+	return newCacheFile(name, fmt.Sprintf("id%d", ms.nextID), parentID)
+}
+
+func (ms *mockService) createFolder(name string, parentID string) (*database.RemoteFile, error) {
+	ms.calls = append(ms.calls, "createFolder "+name)
+	return ms.newFile(name, parentID), ms.err
+}
+
+// upload reads the content of a file like an upload.
+func (ms *mockService) upload(meta *fileMetadata) {
+	if content, err := meta.open(); err == nil {
+		io.Copy(ioutil.Discard, meta.reader(content))
+		content.Close()
+	}
+}
+
+func (ms *mockService) store(localPath string, name string, parentID string, meta *fileMetadata) (*database.RemoteFile, error) {
+	ms.calls = append(ms.calls, "store "+name)
+	ms.upload(meta)
+	rf := ms.newFile(name, parentID)
+	rf.LocalID = &meta.localID
+	return rf, ms.fail()
+}
+
+func (ms *mockService) update(localPath string, rf *database.RemoteFile, meta *fileMetadata) (*database.RemoteFile, error) {
+	ms.calls = append(ms.calls, "update "+rf.Name)
+	ms.upload(meta)
+	return rf, ms.err
+}
+
+func (ms *mockService) link(name string, parentID string, target *database.RemoteFile, meta *fileMetadata) (*database.RemoteFile, error) {
+	ms.calls = append(ms.calls, "link "+name+" "+target.Name)
+	rf := ms.newFile(name, parentID)
+	rf.TargetID = target.RemoteID
+	rf.LocalID = &meta.localID
+	return rf, ms.err
+}
+
+func (ms *mockService) updateMetadata(rf *database.RemoteFile, meta *fileMetadata) (*database.RemoteFile, error) {
+	ms.calls = append(ms.calls, "updateMetadata "+rf.Name)
+	return rf, ms.err
 }
 
 type testFile struct {
-	size         uint64
-	lastModified string
+	size        uint64
+	modTime     time.Time
+	md5Checksum *string
 }
 
-func loadFiles() (chan database.FileOrError, error) {
+func loadFiles(ctx context.Context) (chan database.FileOrError, error) {
 	var ch = make(chan database.FileOrError)
 	defer func() {
 		close(ch)
@@ -34,17 +140,30 @@ func loadFiles() (chan database.FileOrError, error) {
 	return ch, nil
 }
 
-func (ms *mockService) loadFiles() (chan database.FileOrError, error) {
-	return loadFiles()
+func (ms *mockService) loadFiles(ctx context.Context) (chan database.FileOrError, error) {
+	if ms.remote == nil {
+		return loadFiles(ctx)
+	}
+	ch := make(chan database.FileOrError, len(ms.remote))
+	for _, rf := range ms.remote {
+		ch <- database.FileOrError{File: rf}
+	}
+	close(ch)
+	return ch, nil
 }
 
 func newTestFile(stat os.FileInfo, offset int64, sizeDelta int64) *testFile {
-	modTime := stat.ModTime().Add(time.Duration(offset) * NanosPerSecond).Format(time.RFC3339)
-	return &testFile{size: uint64(stat.Size() + sizeDelta), lastModified: modTime}
+	modTime := stat.ModTime().Add(time.Duration(offset) * NanosPerSecond)
+	return &testFile{size: uint64(stat.Size() + sizeDelta), modTime: modTime}
 }
 
-func mockServiceFactory(configDir *string, dataDir *string, cfg *config.Backend) (backupService, error) {
-	return &mockService{configDir: configDir, dataDir: dataDir, cfg: cfg}, nil
+func withChecksum(file *testFile, md5Checksum string) *testFile {
+	file.md5Checksum = &md5Checksum
+	return file
+}
+
+func mockServiceFactory(configDir *string, dataDir *string, cfg *config.Backend, folders []string) (backupService, error) {
+	return &mockService{configDir: configDir, dataDir: dataDir, cfg: cfg, folders: folders}, nil
 }
 
 func configuration(backendName string, sourceDir string, destDir string) *config.Config {
@@ -65,8 +184,9 @@ func TestConnect(t *testing.T) {
 	var wg sync.WaitGroup
 	halt := make(chan bool)
 
-	dests := Connect(addrOf("config dir"), addrOf("testdata"), cfg, &wg, halt)
+	dests, err := Connect(addrOf("config dir"), addrOf("testdata"), cfg, nil, &wg, halt)
 
+	assert.Nil(t, err, "Unexpected error")
 	halt <- true
 	if len(dests) != 1 {
 		t.Errorf("Expected 1 destination, got %d", len(dests))
@@ -77,10 +197,74 @@ func TestConnect(t *testing.T) {
 		assert.Equal(t, "config dir", *srv.configDir)
 		assert.Equal(t, "testdata", *srv.dataDir)
 		assert.Equal(t, cfg.Backends["backend 1"], srv.cfg)
+		assert.Equal(t, []string{"dest dir"}, srv.folders)
 	}
 	wg.Wait()
 }
 
+func TestConnect_TokenScope(t *testing.T) {
+	originalFactory := serviceFactories[config.GoogleDriveName]
+	defer func() {
+		serviceFactories[config.GoogleDriveName] = originalFactory
+	}()
+	serviceFactories[config.GoogleDriveName] = func(configDir *string, dataDir *string, cfg *config.Backend, folders []string) (backupService, error) {
+		return nil, &tokenScopeError{"old scope", "new scope"}
+	}
+	cfg := configuration("backend 1", "source dir", "dest dir")
+	var wg sync.WaitGroup
+
+	dests, err := Connect(addrOf("config dir"), addrOf("testdata"), cfg, nil, &wg, make(chan bool))
+
+	assert.Nil(t, dests)
+	assert.EqualError(t, err, "Saved token is for scope old scope but scope new scope is configured: "+
+		"run \"backupd authorize backend 1\" to authorize the new scope")
+}
+
+func TestAuthorize(t *testing.T) {
+	originalAuthorizer := authorizers[config.GoogleDriveName]
+	defer func() {
+		authorizers[config.GoogleDriveName] = originalAuthorizer
+	}()
+	cfg := configuration("backend 1", "source dir", "dest dir")
+	var authorized *config.Backend
+	authorizers[config.GoogleDriveName] = func(configDir *string, dataDir *string, backendCfg *config.Backend) error {
+		authorized = backendCfg
+		return nil
+	}
+
+	err := Authorize(addrOf("config dir"), addrOf("testdata"), cfg, "backend 1")
+
+	assert.Nil(t, err, "Unexpected error")
+	assert.Equal(t, cfg.Backends["backend 1"], authorized)
+	assert.EqualError(t, Authorize(addrOf("config dir"), addrOf("testdata"), cfg, "unknown"), "Backend not configured: unknown")
+}
+
+func TestBackupFolders(t *testing.T) {
+	backend1, backend2 := "backend 1", "backend 2"
+	sources := []*config.Source{
+		{Path: addrOf("source 1"), Destination: &config.Destination{Backend: &backend1, Folder: addrOf("folder 1")}},
+		{Path: addrOf("source 2"), Destination: &config.Destination{Backend: &backend2, Folder: addrOf("folder 2")}},
+		{Path: addrOf("source 3"), Destination: &config.Destination{Backend: &backend1, Folder: addrOf("folder 3")}},
+		{Path: addrOf("source 4"), Destination: &config.Destination{Backend: &backend1}},
+	}
+
+	assert.Equal(t, []string{"folder 1", "folder 3"}, backupFolders(backend1, sources))
+	assert.Equal(t, []string{"folder 2"}, backupFolders(backend2, sources))
+	assert.Equal(t, []string{}, backupFolders("backend 3", sources))
+}
+
+func TestBackendSources(t *testing.T) {
+	backend1, backend2 := "backend 1", "backend 2"
+	sources := []*config.Source{
+		{Path: addrOf("source 1"), Destination: &config.Destination{Backend: &backend1}},
+		{Path: addrOf("source 2"), Destination: &config.Destination{Backend: &backend2}},
+		{Path: addrOf("source 3"), Destination: &config.Destination{Backend: &backend1}},
+	}
+
+	assert.Equal(t, []*config.Source{sources[0], sources[2]}, backendSources(backend1, sources))
+	assert.Equal(t, []*config.Source{}, backendSources("backend 3", sources))
+}
+
 var dbPath = filepath.Join("testdata", "test.db")
 
 func initCache() *database.BoltDao {
@@ -89,23 +273,28 @@ func initCache() *database.BoltDao {
 }
 
 func initCacheFile(db *database.BoltDao, localPath string, file *testFile) error {
-	return db.AddOrUpdate(localPath, localPath, "plain/text", file.size, addrOf("deadbeaf"), nil, file.lastModified, &localPath)
+	return db.AddOrUpdate(localPath, localPath, "plain/text", file.size, file.md5Checksum, nil, file.modTime, &localPath)
 }
 
 func TestBackend_Init(t *testing.T) {
 	localFile := filepath.Join("testdata", "to_be_backed_up.txt")
 	stat, _ := os.Stat(localFile)
+	md5Checksum, _, _ := hashFile(localFile)
 	tests := []struct {
 		name      string
 		localPath string
 		file      *testFile
 		count     int
+		err       bool
 	}{
-		{"not backed up", localFile, nil, 1},
-		{"backed up, same size and date", localFile, newTestFile(stat, 0, 0), 0},
-		{"backed up, older remote file", localFile, newTestFile(stat, -1, 0), 1},
-		{"backed up, newer remote file", localFile, newTestFile(stat, 1, 0), 0},
-		{"backed up, different size", localFile, newTestFile(stat, 0, 1), 1},
+		{"not backed up", localFile, nil, 1, false},
+		{"backed up, same size and date", localFile, newTestFile(stat, 0, 0), 0, false},
+		{"backed up, older remote file", localFile, newTestFile(stat, -1, 0), 1, false},
+		{"backed up, newer remote file", localFile, newTestFile(stat, 1, 0), 0, false},
+		{"backed up, different size", localFile, newTestFile(stat, 0, 1), 1, false},
+		{"backed up, same content, older remote file", localFile, withChecksum(newTestFile(stat, -1, 0), md5Checksum), 0, false},
+		{"backed up, different content, same size and date", localFile, withChecksum(newTestFile(stat, 0, 0), "deadbeaf"), 1, false},
+		{"stat error", filepath.Join(localFile, "child"), newTestFile(stat, 0, 0), 0, true},
 	}
 
 	cache := initCache()
@@ -120,9 +309,284 @@ func TestBackend_Init(t *testing.T) {
 			}
 			b := backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
 
-			b.Init(test.localPath, string(filepath.Separator)+test.localPath)
+			queued, err := b.Init(test.localPath, string(filepath.Separator)+test.localPath, nil)
 
 			assert.Equal(t, test.count, b.queue.items.Len(), "wrong queue length")
+			assert.Equal(t, test.count == 1, queued)
+			assert.Equal(t, test.err, err != nil)
+		})
+	}
+}
+
+func TestBackend_waitForQuota(t *testing.T) {
+	localFile := filepath.Join("testdata", "to_be_backed_up.txt")
+	today := time.Now().Format(dayFormat)
+	tests := []struct {
+		name     string
+		quota    *uploadQuota
+		action   Action
+		expected bool
+	}{
+		{"no limit", nil, StoreAction, true},
+		{"under limit", newUploadQuota(1000, &mockQuotaStore{}), StoreAction, true},
+		{"trash over limit", newUploadQuota(1, &mockQuotaStore{&database.UploadQuota{Day: today, Bytes: 1}}), TrashAction, true},
+		{"halted over limit", newUploadQuota(1, &mockQuotaStore{&database.UploadQuota{Day: today, Bytes: 2}}), StoreAction, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := backend{queue: NewQueue(), quota: test.quota}
+			halt := make(chan bool, 1)
+			halt <- true
+
+			result := b.waitForQuota(newMessage(localFile, "/"+localFile, test.action), halt)
+
+			assert.Equal(t, test.expected, result)
 		})
 	}
 }
+
+func TestBackend_process_Quota(t *testing.T) {
+	source, _ := ioutil.TempDir("", "quota")
+	defer os.RemoveAll(source)
+	localFile := filepath.Join(source, "file.txt")
+	ioutil.WriteFile(localFile, []byte("hello"), 0644)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	store := &mockQuotaStore{}
+	srv := &mockService{err: errors.New("failed")}
+	b := &backend{queue: NewQueue(), cache: cache, srv: srv, quota: newUploadQuota(1000, store)}
+
+	b.process(newMessage(localFile, "/file.txt", StoreAction), nil)
+	assert.Nil(t, store.saved, "failed upload should not be charged")
+
+	srv.err = nil
+	assert.Nil(t, b.process(newMessage(localFile, "/file.txt", StoreAction), nil))
+	assert.Equal(t, uint64(5), store.saved.Bytes)
+
+	rf := cache.FindByPath("/file.txt")
+	rf.Md5Checksum = addrOf(helloMd5)
+	rf.Size = 5
+	rf.Mode = addrOfUint32(0644)
+	cache.Save(rf)
+	os.Chmod(localFile, 0600)
+	assert.Nil(t, b.process(newMessage(localFile, "/file.txt", UpdateAction), nil))
+	assert.Equal(t, "updateMetadata file.txt", srv.calls[len(srv.calls)-1])
+	assert.Equal(t, uint64(5), store.saved.Bytes, "metadata update should not be charged")
+}
+
+func TestBackend_process_QuotaRetry(t *testing.T) {
+	originalDelays := retryDelays
+	retryDelays = []time.Duration{0}
+	defer func() {
+		retryDelays = originalDelays
+	}()
+	source, _ := ioutil.TempDir("", "quota")
+	defer os.RemoveAll(source)
+	localFile := filepath.Join(source, "file.txt")
+	ioutil.WriteFile(localFile, []byte("hello"), 0644)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	store := &mockQuotaStore{}
+	srv := &mockService{failures: 1}
+	b := &backend{name: "quotaRetry", queue: NewQueue(), cache: cache, srv: srv, quota: newUploadQuota(1000, store)}
+
+	assert.Nil(t, b.process(newMessage(localFile, "/file.txt", StoreAction), nil))
+
+	assert.Equal(t, []string{"store file.txt", "store file.txt"}, srv.calls)
+	assert.Equal(t, uint64(5), store.saved.Bytes, "failed attempt should not be charged")
+}
+
+func TestBackend_process(t *testing.T) {
+	localFile := filepath.Join("testdata", "to_be_backed_up.txt")
+	tests := []struct {
+		name          string
+		remotePath    string
+		action        Action
+		expectedCalls []string
+		expectedPaths []string
+	}{
+		{"store in root", "/file.txt", StoreAction, []string{"store file.txt"}, []string{"/file.txt"}},
+		{"create folders", "/Backups/me/file.txt", StoreAction,
+			[]string{"createFolder Backups", "createFolder me", "store file.txt"}, []string{"/Backups", "/Backups/me", "/Backups/me/file.txt"}},
+		{"use existing folder", "/existing/file.txt", StoreAction, []string{"store file.txt"}, []string{"/existing/file.txt"}},
+		{"update existing file", "/existing/file.txt", UpdateAction, []string{"update file.txt"}, []string{"/existing/file.txt"}},
+		{"update new file", "/existing/new.txt", UpdateAction, []string{"store new.txt"}, []string{"/existing/new.txt"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := initCache()
+			defer func() {
+				cache.Close()
+				os.Remove(dbPath)
+			}()
+			cache.Save(newCacheFile("existing", "existingId", ""))
+			cache.Save(newCacheFile("file.txt", "fileId", "existingId"))
+			srv := &mockService{}
+			b := backend{queue: NewQueue(), cache: cache, srv: srv}
+
+			b.process(newMessage(localFile, test.remotePath, test.action), nil)
+
+			assert.Equal(t, test.expectedCalls, srv.calls)
+			for _, path := range test.expectedPaths {
+				assert.NotNil(t, cache.FindByPath(path), path)
+			}
+		})
+	}
+}
+
+func TestBackend_process_Error(t *testing.T) {
+	localFile := filepath.Join("testdata", "to_be_backed_up.txt")
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	srv := &mockService{err: errors.New("upload failed")}
+	b := backend{queue: NewQueue(), cache: cache, srv: srv}
+
+	b.process(newMessage(localFile, "/folder/file.txt", StoreAction), nil)
+
+	assert.Equal(t, []string{"createFolder folder"}, srv.calls)
+	assert.Nil(t, cache.FindByPath("/folder"))
+}
+
+func TestBackend_process_Trash(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		expectTrashed bool
+	}{
+		{"trashes file", nil, true},
+		{"keeps file on error", errors.New("trash failed"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := initCache()
+			defer func() {
+				cache.Close()
+				os.Remove(dbPath)
+			}()
+			cache.Save(newCacheFile("existing", "existingId", ""))
+			rf := newCacheFile("file.txt", "fileId", "existingId")
+			rf.LocalID = addrOf("localId")
+			cache.Save(rf)
+			cache.SaveLocalHash("localId", &database.LocalHash{Md5: helloMd5})
+			srv := &mockService{err: test.err}
+			b := backend{queue: NewQueue(), cache: cache, srv: srv}
+
+			b.process(newMessage("", "/existing/file.txt", TrashAction), nil)
+
+			assert.Equal(t, []string{"trash file.txt"}, srv.calls)
+			assert.Equal(t, test.expectTrashed, cache.FindByPath("/existing/file.txt") == nil)
+			assert.Equal(t, test.expectTrashed, len(cache.FindTrashedByPattern("/existing", time.Time{})) == 1)
+			assert.Equal(t, test.expectTrashed, cache.GetLocalHash("localId") == nil, "Expected the checksums to be deleted with the backup")
+		})
+	}
+}
+
+func TestBackend_process_Retry(t *testing.T) {
+	originalDelays := retryDelays
+	retryDelays = []time.Duration{0, 0}
+	defer func() {
+		retryDelays = originalDelays
+	}()
+	localFile := filepath.Join("testdata", "to_be_backed_up.txt")
+	tests := []struct {
+		name          string
+		failures      int
+		expectedCalls []string
+		stored        bool
+	}{
+		{"succeeds after retry", 2, []string{"store file.txt", "store file.txt", "store file.txt"}, true},
+		{"gives up after max retries", 3, []string{"store file.txt", "store file.txt", "store file.txt"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := initCache()
+			defer func() {
+				cache.Close()
+				os.Remove(dbPath)
+			}()
+			srv := &mockService{failures: test.failures}
+			b := backend{name: test.name, queue: NewQueue(), cache: cache, srv: srv}
+
+			b.process(newMessage(localFile, "/file.txt", StoreAction), nil)
+
+			assert.Equal(t, test.expectedCalls, srv.calls)
+			assert.Equal(t, test.stored, cache.FindByPath("/file.txt") != nil)
+			assert.Equal(t, 2.0, retriesTotal.Value(test.name))
+			if test.stored {
+				assert.Equal(t, 1.0, operationsTotal.Value(test.name, "store", "success"))
+			} else {
+				assert.Equal(t, 1.0, operationsTotal.Value(test.name, "store", "error"))
+			}
+			assert.Equal(t, uint64(3), operationDuration.Count(test.name, "store"))
+		})
+	}
+}
+
+func TestBackend_process_RetryHalted(t *testing.T) {
+	originalDelays := retryDelays
+	retryDelays = []time.Duration{time.Hour}
+	defer func() {
+		retryDelays = originalDelays
+	}()
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	srv := &mockService{failures: 1}
+	b := backend{name: "retry halted", queue: NewQueue(), cache: cache, srv: srv}
+	halt := make(chan bool)
+	close(halt)
+
+	err := b.process(newMessage(filepath.Join("testdata", "to_be_backed_up.txt"), "/file.txt", StoreAction), halt)
+
+	assert.Equal(t, errHalted, err)
+	assert.Equal(t, []string{"store file.txt"}, srv.calls)
+	assert.Nil(t, b.state.current)
+	assert.Empty(t, b.state.failures)
+}
+
+func TestBackend_processQueue_Halted(t *testing.T) {
+	originalDelays := retryDelays
+	retryDelays = []time.Duration{time.Hour}
+	defer func() {
+		retryDelays = originalDelays
+	}()
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	srv := &mockService{failures: 1}
+	b := backend{name: "queue halted", queue: NewQueue(), cache: cache, srv: srv}
+	var wg sync.WaitGroup
+	halt := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		b.processQueue(&wg, halt)
+		close(done)
+	}()
+	m := newMessage(filepath.Join("testdata", "to_be_backed_up.txt"), "/file.txt", StoreAction)
+	b.queue.Add(m)
+	for b.queue.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(halt)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected processQueue to return")
+	}
+	assert.Equal(t, m, b.queue.TryGet(), "Expected the message to be requeued")
+}
@@ -0,0 +1,68 @@
+package backend
+
+import (
+	"io"
+
+	"github.com/jonestimd/backupd/internal/config"
+	"github.com/jonestimd/backupd/internal/database"
+)
+
+// RebuildCache replaces the file records in a backend's cache with a new listing of the remote files.
+func RebuildCache(configDir *string, dataDir *string, backupConfig *config.Config, name string) error {
+	srv, cfg, err := newService(configDir, dataDir, backupConfig, name)
+	if err != nil {
+		return err
+	}
+	return database.Rebuild(dataFile(dataDir, cfg), srv.loadFiles)
+}
+
+// CheckCache validates the file records in a backend's cache.  If fix is true then the problems are corrected.
+// Returns descriptions of the problems.
+func CheckCache(dataDir *string, backupConfig *config.Config, name string, fix bool) ([]string, error) {
+	cache, err := openCache(dataDir, backupConfig, name)
+	if err != nil {
+		return nil, err
+	}
+	defer cache.Close()
+	return cache.Check(fix)
+}
+
+// CompactCache rewrites a backend's cache to reclaim unused space.  Returns the sizes of the file before and after
+// compaction.
+func CompactCache(dataDir *string, backupConfig *config.Config, name string) (int64, int64, error) {
+	cfg, err := backendConfig(backupConfig, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	return database.Compact(dataFile(dataDir, cfg))
+}
+
+// ExportCatalog writes the file records in a backend's cache to w as JSON lines.  Returns the number of records.
+func ExportCatalog(dataDir *string, backupConfig *config.Config, name string, w io.Writer) (int, error) {
+	cache, err := openCache(dataDir, backupConfig, name)
+	if err != nil {
+		return 0, err
+	}
+	defer cache.Close()
+	return cache.Export(w)
+}
+
+// ImportCatalog adds the file records from an exported catalog to a backend's cache.  The cache must not contain any
+// files.  Returns the number of records.
+func ImportCatalog(dataDir *string, backupConfig *config.Config, name string, r io.Reader) (int, error) {
+	cache, err := openCache(dataDir, backupConfig, name)
+	if err != nil {
+		return 0, err
+	}
+	defer cache.Close()
+	return cache.Import(r)
+}
+
+// openCache opens a backend's cache without connecting to the backend.
+func openCache(dataDir *string, backupConfig *config.Config, name string) (*database.BoltDao, error) {
+	cfg, err := backendConfig(backupConfig, name)
+	if err != nil {
+		return nil, err
+	}
+	return database.OpenDb(dataFile(dataDir, cfg), nil)
+}
@@ -0,0 +1,88 @@
+package backend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jonestimd/backupd/internal/config"
+	"github.com/jonestimd/backupd/internal/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebuildCache(t *testing.T) {
+	originalFactory := serviceFactories[config.GoogleDriveName]
+	defer func() {
+		serviceFactories[config.GoogleDriveName] = originalFactory
+		os.Remove(filepath.Join("testdata", defaultDataFile[config.GoogleDriveName]))
+	}()
+	remote := []*database.RemoteFile{newCacheFile("Backups", "backupsId", ""), newCacheFile("file.txt", "fileId", "backupsId")}
+	serviceFactories[config.GoogleDriveName] = func(configDir *string, dataDir *string, cfg *config.Backend, folders []string) (backupService, error) {
+		return &mockService{remote: remote}, nil
+	}
+	cfg := configuration("backend", "source dir", "Backups")
+	dataDir := addrOf("testdata")
+	cache, _ := database.OpenDb(filepath.Join(*dataDir, defaultDataFile[config.GoogleDriveName]), nil)
+	cache.Save(newCacheFile("stale.txt", "staleId", ""))
+	cache.Close()
+
+	err := RebuildCache(addrOf("config dir"), dataDir, cfg, "backend")
+
+	assert.Nil(t, err)
+	problems, err := CheckCache(dataDir, cfg, "backend", false)
+	assert.Nil(t, err)
+	assert.Empty(t, problems)
+	cache, _ = database.OpenDb(filepath.Join(*dataDir, defaultDataFile[config.GoogleDriveName]), nil)
+	defer cache.Close()
+	assert.Nil(t, cache.FindByPath("/stale.txt"))
+	assert.Equal(t, "fileId", *cache.FindByPath("/Backups/file.txt").RemoteID)
+}
+
+func TestCheckCache_UnknownBackend(t *testing.T) {
+	cfg := configuration("backend", "source dir", "Backups")
+
+	_, err := CheckCache(addrOf("testdata"), cfg, "other", false)
+
+	assert.EqualError(t, err, "Backend not configured: other")
+}
+
+func TestCompactCache(t *testing.T) {
+	defer os.Remove(filepath.Join("testdata", defaultDataFile[config.GoogleDriveName]))
+	cfg := configuration("backend", "source dir", "Backups")
+	dataDir := addrOf("testdata")
+	cache, _ := database.OpenDb(filepath.Join(*dataDir, defaultDataFile[config.GoogleDriveName]), nil)
+	cache.Save(newCacheFile("file.txt", "fileId", ""))
+	cache.Close()
+
+	before, after, err := CompactCache(dataDir, cfg, "backend")
+
+	assert.Nil(t, err)
+	assert.True(t, after <= before, "expected %d to be at most %d", after, before)
+}
+
+func TestExportCatalog_ImportCatalog(t *testing.T) {
+	dataDir := addrOf("testdata")
+	cfg := configuration("backend", "source dir", "Backups")
+	cfg.Backends["copy"] = &config.Backend{Type: config.GoogleDriveName, Config: map[string]*string{"dataFile": addrOf("copy.db")}}
+	defer func() {
+		os.Remove(filepath.Join(*dataDir, defaultDataFile[config.GoogleDriveName]))
+		os.Remove(filepath.Join(*dataDir, "copy.db"))
+	}()
+	cache, _ := database.OpenDb(filepath.Join(*dataDir, defaultDataFile[config.GoogleDriveName]), nil)
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	cache.Save(newCacheFile("file.txt", "fileId", "backupsId"))
+	cache.Close()
+	var buf bytes.Buffer
+
+	exported, err := ExportCatalog(dataDir, cfg, "backend", &buf)
+	assert.Nil(t, err)
+	imported, err := ImportCatalog(dataDir, cfg, "copy", &buf)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, exported)
+	assert.Equal(t, 2, imported)
+	cache, _ = database.OpenDb(filepath.Join(*dataDir, "copy.db"), nil)
+	defer cache.Close()
+	assert.Equal(t, "fileId", *cache.FindByPath("/Backups/file.txt").RemoteID)
+}
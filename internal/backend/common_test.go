@@ -1,5 +1,28 @@
 package backend
 
+import (
+	"time"
+
+	"github.com/jonestimd/backupd/internal/database"
+)
+
 func addrOf(value string) *string {
 	return &value
 }
+
+// newCacheFile creates a cache record with a single parent.  An empty parentID creates a record without a parent.
+func newCacheFile(name string, remoteID string, parentID string) *database.RemoteFile {
+	var parents []string
+	if parentID != "" {
+		parents = []string{parentID}
+	}
+	return &database.RemoteFile{Name: name, RemoteID: &remoteID, ParentIDs: parents}
+}
+
+func addrOfUint32(value uint32) *uint32 {
+	return &value
+}
+
+func addrOfTime(value time.Time) *time.Time {
+	return &value
+}
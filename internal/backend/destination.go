@@ -1,51 +1,434 @@
 package backend
 
 import (
+	"log"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/config"
+	"github.com/jonestimd/backupd/internal/database"
+	"github.com/jonestimd/backupd/internal/filesys"
 )
 
 // Destination represents a backup destination for a source folder.  A source folder may have
 // multiple backup destinations.
 type Destination struct {
-	backend    *backend
-	LocalRoot  *string
-	remoteRoot *string
-	encrypt    bool
+	backend     *backend
+	LocalRoot   *string
+	remoteRoot  *string
+	encrypt     bool
+	mutex       sync.Mutex
+	lastBackup  time.Time    // time of the last successful action or check that found the source folder backed up
+	failed      bool         // true if an action has failed since the source folder was last scanned
+	watched     int          // number of watched directories
+	suspended   bool         // true if the source folder is not available, e.g. its filesystem is not mounted
+	scanLimiter *rateLimiter // limits the rate of file checks by Resync (optional)
+	scanWorkers int          // maximum number of directories scanned concurrently (0 for the default)
+	exclude     []string     // patterns for the names of files and directories that are not backed up
+	symlinks    string       // policy for symbolic links (see config.Source.Symlinks)
+	hardLinks   *hardLinks   // files in the source folder that have multiple paths
 }
 
 func newDestination(b *backend, localPath *string, remotePath *string, encrypt bool) *Destination {
-	return &Destination{backend: b, LocalRoot: localPath, remoteRoot: remotePath, encrypt: encrypt}
+	d := &Destination{backend: b, LocalRoot: localPath, remoteRoot: remotePath, encrypt: encrypt,
+		hardLinks: newHardLinks()}
+	if b != nil && b.cache != nil {
+		d.lastBackup = b.cache.GetLastBackup(*localPath)
+	}
+	return d
 }
 
 // Init checks the status of the file and adds it to the backup queue if it has changed or if it has never been backed up.
-// Used for startup.
-func (d *Destination) Init(localPath string) {
+// Files with multiple hard links are recorded so that their content is only uploaded once.  Used for startup.
+func (d *Destination) Init(localPath string) (bool, error) {
+	d.hardLinks.add(localPath)
 	remotePath := d.RemotePath(localPath)
-	d.backend.Init(localPath, remotePath)
+	return d.backend.Init(localPath, remotePath, d)
+}
+
+// Scan checks the status of all of the files in the source folder.  Returns the number of files or directories that
+// could not be read.
+func (d *Destination) Scan() int {
+	if d.Suspended() {
+		return 0
+	}
+	errors, queued := d.scanDir(*d.LocalRoot, nil, false)
+	if errors == 0 && queued == 0 {
+		d.upToDate(true)
+	}
+	return errors
+}
+
+// Rescan checks the status of the files in a directory of the source folder and its subdirectories.  Backups of files
+// that no longer exist in the directory are added to the backup queue.  Used when changes to the directory may have
+// been missed.
+func (d *Destination) Rescan(dir string) {
+	if d.Suspended() {
+		return
+	}
+	d.scanDir(dir, nil, false)
+	for _, remotePath := range d.deletedFilesIn(dir, nil) {
+		d.queueTrash(d.LocalPath(remotePath))
+	}
+}
+
+// Resync compares the source folder with its backups like the scan at startup and adds the differences to the backup
+// queue.  Files that are already queued are skipped, so the result is the number of changes that were missed by the
+// file watcher.  The rate of file checks is limited by the rescanRate setting.
+func (d *Destination) Resync() int {
+	if d.Suspended() {
+		return 0
+	}
+	errors, queued := d.scanDir(*d.LocalRoot, d.scanLimiter, true)
+	for _, remotePath := range d.deletedFilesIn(*d.LocalRoot, d.scanLimiter) {
+		if localPath := d.LocalPath(remotePath); !d.backend.queue.Pending(localPath) {
+			d.queueTrash(localPath)
+			queued++
+		}
+	}
+	missedChangesTotal.Add(float64(queued), *d.LocalRoot)
+	if errors == 0 && queued == 0 {
+		d.upToDate(true)
+	}
+	return queued
+}
+
+// scanDir checks the files in a directory and its subdirectories.  Symbolic links are skipped, followed or checked as
+// files depending on the source's symlinks option.  If skipPending is true then files that are already queued are not
+// checked.  Returns the number of files or directories that could not be read and the number of files
+// that were added to the queue.
+func (d *Destination) scanDir(dir string, limiter *rateLimiter, skipPending bool) (errors int, queued int) {
+	var errorCount, queuedCount int64
+	preserveLinks := d.symlinks == config.PreserveSymlinks
+	filesys.Walk(dir, d.walkOptions(), func(path string, typ os.FileMode, err error) {
+		if err != nil {
+			log.Printf("Error walking %s: %v\n", path, err)
+			atomic.AddInt64(&errorCount, 1)
+		} else if (typ.IsRegular() || preserveLinks && typ&os.ModeSymlink != 0) &&
+			!(skipPending && d.backend.queue.Pending(path)) {
+			limiter.wait()
+			if queued, err := d.Init(path); err != nil {
+				log.Printf("Error checking %s: %v\n", path, err)
+				atomic.AddInt64(&errorCount, 1)
+			} else if queued {
+				atomic.AddInt64(&queuedCount, 1)
+			}
+		}
+	})
+	return int(errorCount), int(queuedCount)
+}
+
+// walkOptions returns the options for walking the source folder.  Excluded files are skipped and symbolic links are
+// followed if the source's symlinks option is FollowSymlinks.
+func (d *Destination) walkOptions() filesys.WalkOptions {
+	return filesys.WalkOptions{Workers: d.scanWorkers, Exclude: func(path string, typ os.FileMode) bool {
+		return d.Excluded(path)
+	}, FollowLinks: d.symlinks == config.FollowSymlinks, Boundary: *d.LocalRoot}
+}
+
+// linkTarget returns the target of a file if it is a symbolic link that is backed up as a link.
+func (d *Destination) linkTarget(localPath string) (string, bool) {
+	if d == nil || d.symlinks != config.PreserveSymlinks {
+		return "", false
+	}
+	if info, err := os.Lstat(localPath); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return "", false
+	}
+	target, err := os.Readlink(localPath)
+	return target, err == nil
 }
 
-// RemotePath converts a local path to its corresponding remote path.
+// Excluded returns true if the name of a file or one of its parent directories in the source folder matches one of
+// the exclude patterns.
+func (d *Destination) Excluded(localPath string) bool {
+	if len(d.exclude) == 0 || !strings.HasPrefix(localPath, *d.LocalRoot+string(filepath.Separator)) {
+		return false
+	}
+	for _, name := range strings.Split(localPath[len(*d.LocalRoot):], string(filepath.Separator)) {
+		for _, pattern := range d.exclude {
+			if matched, _ := filepath.Match(pattern, name); matched && name != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// QueueDeleted adds the backups of files that no longer exist in the source folder to the backup queue.
+func (d *Destination) QueueDeleted() {
+	for _, remotePath := range d.deletedFiles() {
+		d.queueTrash(d.LocalPath(remotePath))
+	}
+}
+
+// deletedFiles returns the remote paths of the backups of files that no longer exist in the source folder.
+func (d *Destination) deletedFiles() []string {
+	return d.deletedFilesIn(*d.LocalRoot, nil)
+}
+
+// deletedFilesIn returns the remote paths of the backups of files that no longer exist in a directory of the source
+// folder.  Files whose filesystem is not mounted are omitted.  limiter limits the rate of file checks (optional).
+func (d *Destination) deletedFilesIn(dir string, limiter *rateLimiter) []string {
+	var paths []string
+	fsIDs := make(map[string]string)
+	unmounted := make(map[string]int) // number of omitted files by directory
+	for remotePath, rf := range d.backend.cache.FindByPrefix(d.RemotePath(dir)) {
+		if !d.backend.srv.isFolder(rf) {
+			limiter.wait()
+			localPath := d.LocalPath(remotePath)
+			if _, err := os.Lstat(localPath); os.IsNotExist(err) {
+				if parent, ok := d.onBackedUpFileSystem(localPath, rf, fsIDs); ok {
+					paths = append(paths, remotePath)
+				} else {
+					unmounted[parent]++
+				}
+			}
+		}
+	}
+	for parent, count := range unmounted {
+		log.Printf("Not trashing %d backups in %s: their filesystem is not mounted\n", count, parent)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// onBackedUpFileSystem returns true if the nearest existing directory above a deleted file is on the filesystem
+// that the file was backed up from.  Otherwise the file may only appear to be deleted because its filesystem is not
+// mounted or a different filesystem is mounted in its place.  Also returns the directory that was checked.  fsIDs
+// holds the filesystem IDs of the directories that have already been checked.
+func (d *Destination) onBackedUpFileSystem(localPath string, rf *database.RemoteFile, fsIDs map[string]string) (string, bool) {
+	if rf.LocalID == nil {
+		return "", true // the file ID was not recorded
+	}
+	for dir := filepath.Dir(localPath); ; dir = filepath.Dir(dir) {
+		fsID, ok := fsIDs[dir]
+		if !ok {
+			var err error
+			if fsID, err = filesys.FileSystemID(dir); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error getting filesystem of %s: %v\n", dir, err)
+				return dir, false
+			}
+			fsIDs[dir] = fsID
+		}
+		if fsID != "" {
+			return dir, fsID == filesys.IDFileSystem(*rf.LocalID)
+		}
+		if dir == *d.LocalRoot || !strings.HasPrefix(dir, *d.LocalRoot) {
+			return *d.LocalRoot, false
+		}
+	}
+}
+
+// RemotePath converts a local path to its corresponding remote path.  Remote paths are absolute.
 func (d *Destination) RemotePath(localPath string) string {
-	return filepath.Join(*d.remoteRoot, localPath[len(*d.LocalRoot):])
+	return filepath.Join(d.remoteRootPath(), localPath[len(*d.LocalRoot):])
 }
 
 // LocalPath converts a remote path to its corresponding local path.
 func (d *Destination) LocalPath(remotePath string) string {
-	return filepath.Join(*d.LocalRoot, remotePath[len(*d.remoteRoot):])
+	return filepath.Join(*d.LocalRoot, remotePath[len(d.remoteRootPath()):])
 }
 
-// Add is called when a new file is created in a watched directory.  Adds the file to the backup queue.
+func (d *Destination) remoteRootPath() string {
+	return filepath.Join(string(filepath.Separator), *d.remoteRoot)
+}
+
+// Add is called when a new file is created in a watched directory.  Adds the file to the backup queue.  The file is
+// updated instead of stored if it replaced a file that has been backed up or if a change to the path is already queued.
 func (d *Destination) Add(localPath string) {
-	//d.backend.queue.Add(&message{&localPath, d, StoreAction})
+	if !d.backedUpFile(localPath) {
+		return
+	}
+	remotePath := d.RemotePath(localPath)
+	action := StoreAction
+	if d.backend.queue.Pending(localPath) || d.backend.cache.FindByPath(remotePath) != nil {
+		action = UpdateAction
+	}
+	d.backend.queue.Add(&Message{&localPath, &remotePath, action, d})
 }
 
 // Update is called when a file in a watched directory is modified.  Adds the file to the backup queue.
 // Used for content change, rename or move.
 func (d *Destination) Update(localPath string) {
-	//d.backend.queue.Add(&message{&localPath, d, UpdateAction})
+	if !d.backedUpFile(localPath) {
+		return
+	}
+	remotePath := d.RemotePath(localPath)
+	d.backend.queue.Add(&Message{&localPath, &remotePath, UpdateAction, d})
 }
 
-// Delete is called when a file is deleted from a watched directory.  Moves the backup copy to the trash folder (maybe).
+// Delete is called when a file or directory is deleted from a watched directory.  Adds the backups of the deleted
+// files to the backup queue to be moved to the trash folder.  Ignored while the destination is suspended or if the
+// file's filesystem is not mounted.
 func (d *Destination) Delete(localPath string) {
-	//d.backend.queue.Add(&message{&localPath, d, TrashAction})
+	if d.Suspended() {
+		return
+	}
+	rf := d.backend.cache.FindByPath(d.RemotePath(localPath))
+	if rf != nil && d.backend.srv.isFolder(rf) {
+		for _, remotePath := range d.deletedFilesIn(localPath, nil) {
+			d.queueTrash(d.LocalPath(remotePath))
+		}
+		return
+	}
+	if rf != nil {
+		if _, ok := d.onBackedUpFileSystem(localPath, rf, make(map[string]string)); !ok {
+			log.Printf("Not trashing %s: its filesystem is not mounted\n", localPath)
+			return
+		}
+	}
+	d.queueTrash(localPath)
+}
+
+// HandleEvent adds the change reported by a file watcher to the backup queue.
+func (d *Destination) HandleEvent(event filesys.Event) {
+	switch event.Op {
+	case filesys.Create:
+		d.Add(event.Path)
+	case filesys.Write:
+		d.Update(event.Path)
+	case filesys.Remove:
+		d.Delete(event.Path)
+	case filesys.Rescan:
+		d.Rescan(event.Path)
+	}
+}
+
+// backedUpFile returns true if a file exists and is backed up, i.e. it is a regular file or a symbolic link that is
+// backed up according to the source's symlinks option.  Returns false while the destination is suspended.
+func (d *Destination) backedUpFile(localPath string) bool {
+	if d.Suspended() {
+		return false
+	}
+	info, err := os.Lstat(localPath)
+	if err != nil {
+		return false // removed before the event was handled
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch d.symlinks {
+		case config.PreserveSymlinks:
+			return true
+		case config.FollowSymlinks:
+			root, err := filepath.EvalSymlinks(*d.LocalRoot)
+			if err != nil {
+				return false
+			}
+			target, err := filepath.EvalSymlinks(localPath)
+			if err != nil || !strings.HasPrefix(target, root+string(filepath.Separator)) {
+				return false
+			}
+			if info, err = os.Stat(target); err != nil {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return info.Mode().IsRegular()
+}
+
+// queueTrash adds the backup of a file that was found to be deleted by a scan to the backup queue.  Ignored while the
+// destination is suspended.
+func (d *Destination) queueTrash(localPath string) {
+	if d.Suspended() {
+		return
+	}
+	remotePath := d.RemotePath(localPath)
+	d.backend.queue.Add(&Message{&localPath, &remotePath, TrashAction, d})
+}
+
+// WatchAdded is called when a watch has been added for a directory in the source folder.
+func (d *Destination) WatchAdded() {
+	d.mutex.Lock()
+	d.watched++
+	d.mutex.Unlock()
+}
+
+// WatchRemoved is called when the watch for a directory in the source folder has been removed.
+func (d *Destination) WatchRemoved() {
+	d.mutex.Lock()
+	d.watched--
+	d.mutex.Unlock()
+}
+
+// Suspend stops scanning the source folder and trashing backups until Resume is called.  Used when the filesystem
+// of the source folder (or one of its subdirectories) is not mounted, so that its files don't appear to be deleted.
+func (d *Destination) Suspend() {
+	d.mutex.Lock()
+	d.suspended = true
+	d.mutex.Unlock()
+}
+
+// Resume ends the suspension of the destination.
+func (d *Destination) Resume() {
+	d.mutex.Lock()
+	d.suspended = false
+	d.mutex.Unlock()
+}
+
+// Suspended returns true if the destination has been suspended.
+func (d *Destination) Suspended() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.suspended
+}
+
+// backedUp records the time of a successful backup action.  The time is saved in the cache so that it is known after
+// a restart.
+func (d *Destination) backedUp(t time.Time) {
+	d.mutex.Lock()
+	d.lastBackup = t
+	d.mutex.Unlock()
+	if d.backend != nil && d.backend.cache != nil {
+		if err := d.backend.cache.SaveLastBackup(*d.LocalRoot, t); err != nil {
+			log.Printf("Error saving the last backup time of %s: %v\n", *d.LocalRoot, err)
+		}
+	}
+}
+
+// actionFailed records that a backup action for a file in the source folder has failed.  The source folder is not
+// considered backed up until it is scanned again.
+func (d *Destination) actionFailed() {
+	d.mutex.Lock()
+	d.failed = true
+	d.mutex.Unlock()
+}
+
+// upToDate records the current time as the last backup if none of the files in the source folder are queued and no
+// action has failed since the last scan.  scanned is true if a scan has just found that all of the files are backed
+// up.  Not recorded for a dry run.
+func (d *Destination) upToDate(scanned bool) {
+	if d.backend.plan != nil {
+		return
+	}
+	d.mutex.Lock()
+	if scanned {
+		d.failed = false
+	}
+	failed := d.failed
+	d.mutex.Unlock()
+	if !failed && !d.backend.queue.PendingIn(*d.LocalRoot) {
+		d.backedUp(time.Now())
+	}
+}
+
+// status returns the state of the source folder.
+func (d *Destination) status() *SourceStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	status := &SourceStatus{Path: *d.LocalRoot, Folder: d.remoteRootPath(), Watched: d.watched,
+		Suspended: d.suspended}
+	if d.backend != nil {
+		status.Backend = d.backend.name
+	}
+	if !d.lastBackup.IsZero() {
+		lastBackup := d.lastBackup
+		status.LastBackup = &lastBackup
+	}
+	return status
 }
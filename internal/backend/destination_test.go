@@ -0,0 +1,549 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/config"
+	"github.com/jonestimd/backupd/internal/filesys"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDestination_RemotePath(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteRoot string
+		expected   string
+	}{
+		{"relative root", "Backups/me", "/Backups/me/dir/file.txt"},
+		{"absolute root", "/Backups/me", "/Backups/me/dir/file.txt"},
+		{"empty root", "", "/dir/file.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newDestination(nil, addrOf("/home/me"), &test.remoteRoot, false)
+
+			assert.Equal(t, test.expected, d.RemotePath("/home/me/dir/file.txt"))
+			assert.Equal(t, "/home/me/dir/file.txt", d.LocalPath(test.expected))
+		})
+	}
+}
+
+func TestDestination_Rescan(t *testing.T) {
+	source, _ := ioutil.TempDir("", "rescan")
+	defer os.RemoveAll(source)
+	os.MkdirAll(filepath.Join(source, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(source, "dir", "new.txt"), []byte("new"), 0644)
+	ioutil.WriteFile(filepath.Join(source, "other.txt"), []byte("other"), 0644)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	folder := newCacheFile("dir", "dirId", "backupsId")
+	folder.MimeType = defaultFolderMimeType
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	cache.Save(folder)
+	cache.Save(newCacheFile("deleted.txt", "deletedId", "dirId"))
+	cache.Save(newCacheFile("outside.txt", "outsideId", "backupsId"))
+	b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+
+	d.Rescan(filepath.Join(source, "dir"))
+
+	var queued []string
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		queued = append(queued, m.action.String()+" "+*m.remote)
+	}
+	assert.ElementsMatch(t, []string{"store /Backups/dir/new.txt", "trash /Backups/dir/deleted.txt"}, queued)
+}
+
+func TestDestination_Rescan_PatternCharacters(t *testing.T) {
+	source, _ := ioutil.TempDir("", "rescan")
+	defer os.RemoveAll(source)
+	os.MkdirAll(filepath.Join(source, "d[i]r"), 0755)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	for _, name := range []string{"d[i]r", "dir"} {
+		folder := newCacheFile(name, name+"Id", "backupsId")
+		folder.MimeType = defaultFolderMimeType
+		cache.Save(folder)
+		cache.Save(newCacheFile("deleted.txt", name+"DeletedId", name+"Id"))
+	}
+	b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+
+	d.Rescan(filepath.Join(source, "d[i]r"))
+
+	var queued []string
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		queued = append(queued, m.action.String()+" "+*m.remote)
+	}
+	assert.Equal(t, []string{"trash /Backups/d[i]r/deleted.txt"}, queued)
+}
+
+func TestDestination_Suspend(t *testing.T) {
+	source, _ := ioutil.TempDir("", "suspend")
+	defer os.RemoveAll(source)
+	ioutil.WriteFile(filepath.Join(source, "new.txt"), []byte("new"), 0644)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	cache.Save(newCacheFile("deleted.txt", "deletedId", "backupsId"))
+	b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+
+	d.Suspend()
+	d.Scan()
+	d.Rescan(source)
+	d.QueueDeleted()
+	d.Delete(filepath.Join(source, "new.txt"))
+
+	assert.True(t, d.Suspended())
+	assert.True(t, d.status().Suspended)
+	assert.Nil(t, b.queue.TryGet())
+
+	d.Resume()
+	d.Rescan(source)
+
+	var queued []string
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		queued = append(queued, m.action.String()+" "+*m.remote)
+	}
+	assert.False(t, d.Suspended())
+	assert.ElementsMatch(t, []string{"store /Backups/new.txt", "trash /Backups/deleted.txt"}, queued)
+}
+
+func TestDestination_QueueDeleted_Unmounted(t *testing.T) {
+	source, _ := ioutil.TempDir("", "unmounted")
+	defer os.RemoveAll(source)
+	os.Mkdir(filepath.Join(source, "mnt"), 0755) // empty mount point
+	fsID, _ := filesys.FileSystemID(source)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	for _, folder := range []string{"mnt", "gone"} {
+		rf := newCacheFile(folder, folder+"Id", "backupsId")
+		rf.MimeType = defaultFolderMimeType
+		cache.Save(rf)
+	}
+	cacheFile := func(name string, parentID string, localID *string) {
+		rf := newCacheFile(name, name+"Id", parentID)
+		rf.LocalID = localID
+		cache.Save(rf)
+	}
+	cacheFile("deleted.txt", "backupsId", addrOf(fsID+"-0000000000000001"))
+	cacheFile("legacy.txt", "backupsId", nil)
+	cacheFile("a.txt", "mntId", addrOf("ffffffffffffffff-0000000000000002"))
+	cacheFile("b.txt", "goneId", addrOf(fsID+"-0000000000000003"))
+	b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+
+	d.QueueDeleted()
+	d.Delete(filepath.Join(source, "mnt", "a.txt"))
+
+	var queued []string
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		queued = append(queued, m.action.String()+" "+*m.remote)
+	}
+	assert.ElementsMatch(t, []string{"trash /Backups/deleted.txt", "trash /Backups/legacy.txt",
+		"trash /Backups/gone/b.txt"}, queued)
+}
+
+func TestDestination_Resync(t *testing.T) {
+	source, _ := ioutil.TempDir("", "resync")
+	defer os.RemoveAll(source)
+	ioutil.WriteFile(filepath.Join(source, "new.txt"), []byte("new"), 0644)
+	ioutil.WriteFile(filepath.Join(source, "queued.txt"), []byte("queued"), 0644)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	folder := newCacheFile("Backups", "backupsId", "")
+	folder.MimeType = defaultFolderMimeType
+	cache.Save(folder)
+	cache.Save(newCacheFile("deleted.txt", "deletedId", "backupsId"))
+	cache.Save(newCacheFile("trashed.txt", "trashedId", "backupsId"))
+	b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	d.scanLimiter = newTestLimiter(clock, 1, 1)
+	d.queueTrash(filepath.Join(source, "trashed.txt"))
+	b.queue.Add(&Message{addrOf(filepath.Join(source, "queued.txt")), addrOf("/Backups/queued.txt"), StoreAction, d})
+
+	missed := d.Resync()
+
+	var queued []string
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		queued = append(queued, m.action.String()+" "+*m.remote)
+	}
+	assert.Equal(t, 2, missed)
+	assert.ElementsMatch(t, []string{"trash /Backups/trashed.txt", "store /Backups/queued.txt",
+		"store /Backups/new.txt", "trash /Backups/deleted.txt"}, queued)
+	assert.Len(t, clock.sleeps, 2, "expected file checks to be rate limited")
+}
+
+func TestDestination_Excluded(t *testing.T) {
+	d := newDestination(nil, addrOf("/home/me"), addrOf("Backups"), false)
+	d.exclude = []string{".cache", "*.tmp"}
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"/home/me/file.txt", false},
+		{"/home/me/file.tmp", true},
+		{"/home/me/.cache", true},
+		{"/home/me/.cache/dir/file.txt", true},
+		{"/home/me/dir/.cache/file.txt", true},
+		{"/home/me/.cached/file.txt", false},
+		{"/home/meet/file.tmp", false},
+		{"/home/me", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			assert.Equal(t, test.expected, d.Excluded(test.path))
+		})
+	}
+}
+
+func TestDestination_Scan_Exclude(t *testing.T) {
+	source, _ := ioutil.TempDir("", "scan")
+	defer os.RemoveAll(source)
+	os.MkdirAll(filepath.Join(source, ".cache"), 0755)
+	ioutil.WriteFile(filepath.Join(source, ".cache", "cached.txt"), []byte("cached"), 0644)
+	ioutil.WriteFile(filepath.Join(source, "file.tmp"), []byte("tmp"), 0644)
+	ioutil.WriteFile(filepath.Join(source, "file.txt"), []byte("file"), 0644)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+	d.exclude = []string{".cache", "*.tmp"}
+
+	assert.Equal(t, 0, d.Scan())
+
+	var queued []string
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		queued = append(queued, m.action.String()+" "+*m.remote)
+	}
+	assert.Equal(t, []string{"store /Backups/file.txt"}, queued)
+}
+
+func TestDestination_Scan_Symlinks(t *testing.T) {
+	source, _ := ioutil.TempDir("", "scan")
+	defer os.RemoveAll(source)
+	outside, _ := ioutil.TempDir("", "outside")
+	defer os.RemoveAll(outside)
+	os.MkdirAll(filepath.Join(source, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(source, "dir", "file.txt"), []byte("file"), 0644)
+	ioutil.WriteFile(filepath.Join(outside, "file.txt"), []byte("file"), 0644)
+	os.Symlink("dir", filepath.Join(source, "link"))
+	os.Symlink(outside, filepath.Join(source, "outside"))
+	os.Symlink(source, filepath.Join(source, "dir", "loop"))
+	tests := []struct {
+		symlinks string
+		errors   int
+		expected []string
+	}{
+		{"", 0, []string{"store /Backups/dir/file.txt"}},
+		{config.SkipSymlinks, 0, []string{"store /Backups/dir/file.txt"}},
+		{config.FollowSymlinks, 2, []string{"store /Backups/dir/file.txt", "store /Backups/link/file.txt"}},
+		{config.PreserveSymlinks, 0, []string{"store /Backups/dir/file.txt", "store /Backups/dir/loop",
+			"store /Backups/link", "store /Backups/outside"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.symlinks, func(t *testing.T) {
+			cache := initCache()
+			defer func() {
+				cache.Close()
+				os.Remove(dbPath)
+			}()
+			b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+			d := newDestination(b, &source, addrOf("Backups"), false)
+			d.symlinks = test.symlinks
+
+			assert.Equal(t, test.errors, d.Scan())
+
+			var queued []string
+			for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+				queued = append(queued, m.action.String()+" "+*m.remote)
+			}
+			assert.ElementsMatch(t, test.expected, queued)
+		})
+	}
+}
+
+func TestDestination_Init_PreservedSymlink(t *testing.T) {
+	source, _ := ioutil.TempDir("", "init")
+	defer os.RemoveAll(source)
+	os.Symlink("file.txt", filepath.Join(source, "link"))
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	rf := newCacheFile("link", "linkId", "backupsId")
+	rf.LinkTarget = addrOf("file.txt")
+	cache.Save(rf)
+	b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+	d.symlinks = config.PreserveSymlinks
+
+	queued, err := d.Init(filepath.Join(source, "link"))
+	assert.Nil(t, err)
+	assert.False(t, queued, "unchanged link should not be queued")
+
+	os.Remove(filepath.Join(source, "link"))
+	os.Symlink("other.txt", filepath.Join(source, "link"))
+
+	queued, err = d.Init(filepath.Join(source, "link"))
+	assert.Nil(t, err)
+	assert.True(t, queued, "changed link should be queued")
+	assert.Equal(t, UpdateAction, b.queue.TryGet().action)
+}
+
+func TestDestination_Add(t *testing.T) {
+	source, _ := ioutil.TempDir("", "add")
+	defer os.RemoveAll(source)
+	os.Mkdir(filepath.Join(source, "dir"), 0755)
+	for _, name := range []string{"new.txt", "cached.txt", "queued.txt"} {
+		ioutil.WriteFile(filepath.Join(source, name), []byte(name), 0644)
+	}
+	os.Symlink("new.txt", filepath.Join(source, "link"))
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	cache.Save(newCacheFile("cached.txt", "cachedId", "backupsId"))
+	tests := []struct {
+		name     string
+		file     string
+		symlinks string
+		expected []string
+	}{
+		{"new file", "new.txt", "", []string{"store /Backups/new.txt"}},
+		{"replaced backed up file", "cached.txt", "", []string{"update /Backups/cached.txt"}},
+		{"replaced queued file", "queued.txt", "", []string{"trash /Backups/queued.txt", "update /Backups/queued.txt"}},
+		{"missing file", "missing.txt", "", nil},
+		{"directory", "dir", "", nil},
+		{"skipped symlink", "link", config.SkipSymlinks, nil},
+		{"followed symlink", "link", config.FollowSymlinks, []string{"store /Backups/link"}},
+		{"preserved symlink", "link", config.PreserveSymlinks, []string{"store /Backups/link"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+			d := newDestination(b, &source, addrOf("Backups"), false)
+			d.symlinks = test.symlinks
+			if test.file == "queued.txt" {
+				d.queueTrash(filepath.Join(source, test.file))
+			}
+
+			d.Add(filepath.Join(source, test.file))
+
+			var queued []string
+			for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+				queued = append(queued, m.action.String()+" "+*m.remote)
+			}
+			assert.Equal(t, test.expected, queued)
+		})
+	}
+}
+
+func TestDestination_Delete_Directory(t *testing.T) {
+	source, _ := ioutil.TempDir("", "delete")
+	defer os.RemoveAll(source)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	folder := newCacheFile("dir", "dirId", "backupsId")
+	folder.MimeType = defaultFolderMimeType
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	cache.Save(folder)
+	cache.Save(newCacheFile("file1.txt", "file1Id", "dirId"))
+	cache.Save(newCacheFile("file2.txt", "file2Id", "dirId"))
+	b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+
+	d.Delete(filepath.Join(source, "dir"))
+
+	var queued []string
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		queued = append(queued, m.action.String()+" "+*m.remote)
+	}
+	assert.Equal(t, []string{"trash /Backups/dir/file1.txt", "trash /Backups/dir/file2.txt"}, queued)
+}
+
+// newBackedUpSource creates a source folder containing file.txt and backs it up using a mock service.
+func newBackedUpSource(t *testing.T) (string, *backend, *Destination, *mockService) {
+	source, _ := ioutil.TempDir("", "events")
+	ioutil.WriteFile(filepath.Join(source, "file.txt"), []byte("original"), 0644)
+	srv := &mockService{}
+	b := &backend{queue: NewQueue(), cache: initCache(), srv: srv}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+	d.Scan()
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		assert.Nil(t, b.process(m, nil))
+	}
+	srv.calls = nil
+	return source, b, d, srv
+}
+
+func TestDestination_HandleEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(source string) []filesys.Event
+		expected []string
+		backups  []string
+	}{
+		{"rename", func(source string) []filesys.Event {
+			os.Rename(filepath.Join(source, "file.txt"), filepath.Join(source, "moved.txt"))
+			return []filesys.Event{{Op: filesys.Remove, Path: filepath.Join(source, "file.txt")},
+				{Op: filesys.Create, Path: filepath.Join(source, "moved.txt")}}
+		}, []string{"trash file.txt", "store moved.txt"}, []string{"/Backups/moved.txt"}},
+		{"save by renaming the original", func(source string) []filesys.Event {
+			os.Rename(filepath.Join(source, "file.txt"), filepath.Join(source, "file.txt~"))
+			ioutil.WriteFile(filepath.Join(source, "file.txt"), []byte("changed"), 0644)
+			return []filesys.Event{{Op: filesys.Remove, Path: filepath.Join(source, "file.txt")},
+				{Op: filesys.Create, Path: filepath.Join(source, "file.txt~")},
+				{Op: filesys.Create, Path: filepath.Join(source, "file.txt")},
+				{Op: filesys.Write, Path: filepath.Join(source, "file.txt")}}
+		}, []string{"store file.txt~", "update file.txt", "update file.txt"},
+			[]string{"/Backups/file.txt", "/Backups/file.txt~"}},
+		{"save by renaming a temporary file", func(source string) []filesys.Event {
+			ioutil.WriteFile(filepath.Join(source, ".file.txt.tmp"), []byte("changed"), 0644)
+			os.Rename(filepath.Join(source, ".file.txt.tmp"), filepath.Join(source, "file.txt"))
+			return []filesys.Event{{Op: filesys.Create, Path: filepath.Join(source, ".file.txt.tmp")},
+				{Op: filesys.Write, Path: filepath.Join(source, ".file.txt.tmp")},
+				{Op: filesys.Remove, Path: filepath.Join(source, ".file.txt.tmp")},
+				{Op: filesys.Create, Path: filepath.Join(source, "file.txt")}}
+		}, []string{"update file.txt"}, []string{"/Backups/file.txt"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, b, d, srv := newBackedUpSource(t)
+			defer func() {
+				os.RemoveAll(source)
+				b.cache.Close()
+				os.Remove(dbPath)
+			}()
+			remoteID := *b.cache.FindByPath("/Backups/file.txt").RemoteID
+
+			for _, event := range test.change(source) {
+				d.HandleEvent(event)
+			}
+			for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+				assert.Nil(t, b.process(m, nil))
+			}
+
+			assert.Equal(t, test.expected, srv.calls)
+			var backups []string
+			for remotePath, rf := range b.cache.FindByPrefix("/Backups") {
+				if rf.MimeType != defaultFolderMimeType && remotePath != "/Backups" {
+					backups = append(backups, remotePath)
+				}
+			}
+			sort.Strings(backups)
+			assert.Equal(t, test.backups, backups)
+			if rf := b.cache.FindByPath("/Backups/file.txt"); rf != nil {
+				assert.Equal(t, remoteID, *rf.RemoteID, "should keep the existing backup")
+			}
+		})
+	}
+}
+
+func TestDestination_HandleEvent_NewDirectory(t *testing.T) {
+	source, _ := ioutil.TempDir("", "events")
+	defer os.RemoveAll(source)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+	watcher, err := filesys.NewFileWatcher(filesys.WatcherOptions{}, source)
+	if err != nil {
+		t.Fatalf("Error creating watcher: %v", err)
+	}
+	defer watcher.Close()
+	newFile := filepath.Join(source, "dir", "sub", "file.txt")
+
+	os.MkdirAll(filepath.Join(source, "dir"), 0755)
+	go func() {
+		os.MkdirAll(filepath.Join(source, "dir", "sub"), 0755)
+		ioutil.WriteFile(newFile, []byte("new"), 0644)
+	}()
+
+	timeout := time.After(2 * time.Second)
+	for !b.queue.Pending(newFile) {
+		select {
+		case event := <-watcher.Events():
+			d.HandleEvent(event)
+		case <-timeout:
+			t.Fatal("expected new file to be queued")
+		}
+	}
+}
+
+func TestDestination_Scan_UpToDate(t *testing.T) {
+	source, _ := ioutil.TempDir("", "scan")
+	defer os.RemoveAll(source)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{}}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+	b.dests = []*Destination{d}
+
+	d.actionFailed()
+	b.drained()
+	assert.Nil(t, d.status().LastBackup, "Expected no backup time after a failed action")
+	b.queue.Add(newMessage(filepath.Join(source, "file.txt"), "/Backups/file.txt", StoreAction))
+	d.Scan()
+	assert.Nil(t, d.status().LastBackup, "Expected no backup time while a file is queued")
+	b.queue.TryGet()
+	d.Scan()
+
+	assert.NotNil(t, d.status().LastBackup)
+	assert.True(t, d.status().LastBackup.Equal(cache.GetLastBackup(source)), "Expected the backup time to be saved")
+	restarted := newDestination(b, &source, addrOf("Backups"), false)
+	assert.True(t, d.status().LastBackup.Equal(*restarted.status().LastBackup), "Expected the saved backup time after a restart")
+}
+
+func TestDestination_upToDate_DryRun(t *testing.T) {
+	source, _ := ioutil.TempDir("", "scan")
+	defer os.RemoveAll(source)
+	b := &backend{queue: NewQueue(), srv: &mockService{}, plan: NewPlan(ioutil.Discard)}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+
+	d.Scan()
+
+	assert.Nil(t, d.status().LastBackup)
+}
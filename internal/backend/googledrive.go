@@ -2,31 +2,55 @@ package backend
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jonestimd/backupd/internal/config"
 	"github.com/jonestimd/backupd/internal/database"
-	"github.com/jonestimd/backupd/internal/filesys"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 )
 
 const (
 	defaultSecretFile     = "gd_client_secret.json"
 	defaultTokenFile      = "gd_token.json"
 	defaultFolderMimeType = "application/vnd.google-apps.folder"
+	shortcutMimeType      = "application/vnd.google-apps.shortcut"
 	defaultRootFolderID   = "root"
-	fileFields            = "nextPageToken, files(id, name, parents, mimeType, md5Checksum, size, modifiedTime, trashed, shared, version)"
+	defaultScope          = "drive.file"
+	defaultRequestRate    = 10 // requests per second
+	defaultRequestBurst   = 10
+	fileProperties        = "id, name, parents, mimeType, md5Checksum, size, createdTime, modifiedTime, trashed, shared, version, appProperties, headRevisionId, shortcutDetails"
+	revisionFields        = "nextPageToken, revisions(id, modifiedTime, md5Checksum)"
+	fileFields            = "nextPageToken, files(" + fileProperties + ")"
+	folderBatchSize       = 20 // max number of parents in a single list query
+	listWorkers           = 4  // max number of concurrent list queries
 )
 
+// driveScopes maps the values of the scope parameter to OAuth scopes.  With the drive.file scope, only files created
+// by backupd are visible.
+var driveScopes = map[string]string{
+	"drive":      drive.DriveScope,
+	"drive.file": drive.DriveFileScope,
+}
+
+// legacyScope is the scope of tokens saved before the scope was configurable.
+const legacyScope = drive.DriveScope
+
 /* for mocking in tests */
 var configFromJSON = google.ConfigFromJSON
 var newDrive = drive.New
@@ -35,8 +59,16 @@ var newDrive = drive.New
 type GoogleDrive struct {
 	folderMimeType string
 	rootFolderID   string
+	scope          string   // OAuth scope
+	folders        []string // backup folders, relative to rootFolderID
 	srv            *drive.Service
-	listFiles      func(cb func(*drive.FileList) error) error
+	limiter        *rateLimiter // limits the rate of API requests
+	listFiles      func(ctx context.Context, query string, cb func(*drive.FileList) error) error
+	createFile     func(file *drive.File, content io.Reader) (*drive.File, error)
+	updateFile     func(fileID string, file *drive.File, content io.Reader) (*drive.File, error)
+	downloadFile   func(fileID string) (io.ReadCloser, error)
+	listRevisions  func(fileID string, cb func(*drive.RevisionList) error) error
+	getRevision    func(fileID string, revisionID string) (io.ReadCloser, error)
 }
 
 // PathMapper converts between local and remote file paths.
@@ -45,60 +77,97 @@ type PathMapper interface {
 	LocalPath(remotePath string) string
 }
 
+// savedToken is the format of the token file.  Scope is empty for tokens saved before the scope was configurable.
+type savedToken struct {
+	oauth2.Token
+	Scope string `json:"scope,omitempty"`
+}
+
+// scope returns the OAuth scope that was granted for the token.
+func (t *savedToken) scope() string {
+	if t.Scope == "" {
+		return legacyScope
+	}
+	return t.Scope
+}
+
+// tokenScopeError indicates that the saved token was granted for a different scope than the configured scope.
+type tokenScopeError struct {
+	saved      string
+	configured string
+}
+
+func (e *tokenScopeError) Error() string {
+	return fmt.Sprintf("Saved token is for scope %s but scope %s is configured", e.saved, e.configured)
+}
+
 // getClient uses a Context and Config to retrieve a Token
 // then generate a Client. It returns the generated Client.
-func getClient(ctx context.Context, tokenFile string, config *oauth2.Config) *http.Client {
+// Returns a tokenScopeError instead of requesting a new token if the saved token was granted for a different scope.
+func getClient(ctx context.Context, tokenFile string, scope string, config *oauth2.Config) (*http.Client, error) {
 	tok, err := tokenFromFile(tokenFile)
+	if err == nil && tok.scope() != scope {
+		return nil, &tokenScopeError{tok.scope(), scope}
+	}
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokenFile, tok)
+		webTok, err := getTokenFromWeb(config)
+		if err != nil {
+			return nil, err
+		}
+		tok = &savedToken{*webTok, scope}
+		if err := saveToken(tokenFile, tok); err != nil {
+			return nil, err
+		}
 	}
-	return config.Client(ctx, tok)
+	return config.Client(ctx, &tok.Token), nil
 }
 
 // getTokenFromWeb uses Config to request a Token.
 // It returns the retrieved Token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
 	fmt.Printf("Go to the following link in your browser then type the "+
 		"authorization code: \n%v\n", authURL)
 
 	var code string
 	if _, err := fmt.Scan(&code); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+		return nil, fmt.Errorf("Unable to read authorization code: %v", err)
 	}
 
 	tok, err := config.Exchange(oauth2.NoContext, code)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+		return nil, fmt.Errorf("Unable to retrieve token from web: %v", err)
 	}
-	return tok
+	return tok, nil
 }
 
 // tokenFromFile retrieves a Token from a given file path.
 // It returns the retrieved Token and any read error encountered.
-func tokenFromFile(file string) (*oauth2.Token, error) {
+func tokenFromFile(file string) (*savedToken, error) {
 	log.Printf("Looking for token in %s\n", file)
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	t := &oauth2.Token{}
+	t := &savedToken{}
 	err = json.NewDecoder(f).Decode(t)
 	return t, err
 }
 
 // saveToken uses a file path to create a file and store the
-// token in it.
-func saveToken(file string, token *oauth2.Token) {
+// token in it.  Returns an error if the token could not be written.
+func saveToken(file string, token *savedToken) error {
 	fmt.Printf("Saving credential file to: %s\n", file)
 	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return fmt.Errorf("Unable to cache oauth token: %v", err)
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+	if err := json.NewEncoder(f).Encode(token); err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to cache oauth token: %v", err)
+	}
+	return f.Close()
 }
 
 // Generates a credential file path/filename.  Creates the path if it does not exist.
@@ -110,10 +179,33 @@ func tokenCacheFile(dataDir *string, tokenFile string) string {
 }
 
 // Create a connection to Google Drive
-func newGoogleDrive(configDir *string, dataDir *string, cfg *config.Backend) (*GoogleDrive, error) {
+func newGoogleDrive(configDir *string, dataDir *string, cfg *config.Backend, folders []string) (*GoogleDrive, error) {
+	scope, err := driveScope(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rate, err := cfg.GetIntParameter("requestsPerSecond", defaultRequestRate)
+	if err != nil {
+		return nil, err
+	}
+	burst, err := cfg.GetIntParameter("requestBurst", defaultRequestBurst)
+	if err != nil {
+		return nil, err
+	}
+	if rate < 0 {
+		return nil, fmt.Errorf("Invalid value for requestsPerSecond: %d", rate)
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("Invalid value for requestBurst: %d", burst)
+	}
 	gd := &GoogleDrive{
 		folderMimeType: cfg.GetParameter("folderMimeType", defaultFolderMimeType),
 		rootFolderID:   cfg.GetParameter("rootFolderId", defaultRootFolderID),
+		scope:          scope,
+		folders:        folders,
+	}
+	if rate > 0 { // 0 for no limit
+		gd.limiter = newRateLimiter(float64(rate), int(burst))
 	}
 	if err := gd.connect(configDir, dataDir, cfg); err != nil {
 		return nil, err
@@ -121,74 +213,471 @@ func newGoogleDrive(configDir *string, dataDir *string, cfg *config.Backend) (*G
 	return gd, nil
 }
 
+// driveScope returns the configured OAuth scope.
+func driveScope(cfg *config.Backend) (string, error) {
+	scopeName := cfg.GetParameter("scope", defaultScope)
+	scope, ok := driveScopes[scopeName]
+	if !ok {
+		return "", errors.New("Unknown Google Drive scope: " + scopeName)
+	}
+	return scope, nil
+}
+
+// oauthConfig reads the client secret file.
+func oauthConfig(configDir *string, cfg *config.Backend, scope string) (*oauth2.Config, error) {
+	clientSecretFile := cfg.GetParameter("clientSecretFile", defaultSecretFile)
+	csBytes, err := ioutil.ReadFile(filepath.Join(*configDir, clientSecretFile))
+	if err != nil {
+		log.Printf("Unable to read client secret file: %v", err)
+		return nil, err
+	}
+	oauthConfig, err := configFromJSON(csBytes, scope)
+	if err != nil {
+		log.Printf("Unable to parse client secret file to config: %v", err)
+		return nil, err
+	}
+	return oauthConfig, nil
+}
+
+// authorizeGoogleDrive requests a new token for the configured scope and replaces the saved token.
+func authorizeGoogleDrive(configDir *string, dataDir *string, cfg *config.Backend) error {
+	scope, err := driveScope(cfg)
+	if err != nil {
+		return err
+	}
+	oauthConfig, err := oauthConfig(configDir, cfg, scope)
+	if err != nil {
+		return err
+	}
+	tok, err := getTokenFromWeb(oauthConfig)
+	if err != nil {
+		return err
+	}
+	return saveToken(tokenCacheFile(dataDir, cfg.GetParameter("tokenFile", defaultTokenFile)), &savedToken{*tok, scope})
+}
+
 // Connect to google drive.
 func (gd *GoogleDrive) connect(configDir *string, dataDir *string, cfg *config.Backend) error {
 	tokenFile := tokenCacheFile(dataDir, cfg.GetParameter("tokenFile", defaultTokenFile))
 
 	ctx := context.Background()
 
-	clientSecretFile := cfg.GetParameter("clientSecretFile", defaultSecretFile)
-	csBytes, err := ioutil.ReadFile(filepath.Join(*configDir, clientSecretFile))
+	oauthConfig, err := oauthConfig(configDir, cfg, gd.scope)
 	if err != nil {
-		log.Printf("Unable to read client secret file: %v", err)
 		return err
 	}
-
-	// If modifying these scopes, delete your previously saved credentials
-	// at ~/.backupd/gd_token.json
-	oauthConfig, err := configFromJSON(csBytes, drive.DriveScope)
+	client, err := getClient(ctx, tokenFile, gd.scope, oauthConfig)
 	if err != nil {
-		log.Printf("Unable to parse client secret file to config: %v", err)
 		return err
 	}
-	client := getClient(ctx, tokenFile, oauthConfig)
 
 	gd.srv, err = newDrive(client)
 	if err != nil {
 		log.Printf("Unable to create drive Client %v", err)
 		return err
 	}
-	gd.listFiles = func(cb func(*drive.FileList) error) error {
-		return gd.srv.Files.List().Fields(fileFields).OrderBy("folder").Q("not trashed").Pages(nil, cb)
+	gd.listFiles = func(ctx context.Context, query string, cb func(*drive.FileList) error) error {
+		call := gd.srv.Files.List().Fields(fileFields).OrderBy("folder").Q(query).Context(ctx)
+		for {
+			gd.limiter.wait()
+			page, err := call.Do()
+			if err != nil {
+				return err
+			}
+			if err = cb(page); err != nil {
+				return err
+			}
+			if page.NextPageToken == "" {
+				return nil
+			}
+			call.PageToken(page.NextPageToken)
+		}
+	}
+	gd.createFile = func(file *drive.File, content io.Reader) (*drive.File, error) {
+		gd.limiter.wait()
+		call := gd.srv.Files.Create(file).Fields(fileProperties)
+		if content != nil {
+			call.Media(content)
+		}
+		return call.Do()
+	}
+	gd.updateFile = func(fileID string, file *drive.File, content io.Reader) (*drive.File, error) {
+		gd.limiter.wait()
+		call := gd.srv.Files.Update(fileID, file).Fields(fileProperties)
+		if content != nil {
+			call.Media(content)
+		}
+		return call.Do()
+	}
+	gd.downloadFile = func(fileID string) (io.ReadCloser, error) {
+		gd.limiter.wait()
+		resp, err := gd.srv.Files.Get(fileID).Download()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	gd.listRevisions = func(fileID string, cb func(*drive.RevisionList) error) error {
+		call := gd.srv.Revisions.List(fileID).Fields(revisionFields)
+		for {
+			gd.limiter.wait()
+			page, err := call.Do()
+			if err != nil {
+				return err
+			}
+			if err = cb(page); err != nil {
+				return err
+			}
+			if page.NextPageToken == "" {
+				return nil
+			}
+			call.PageToken(page.NextPageToken)
+		}
+	}
+	gd.getRevision = func(fileID string, revisionID string) (io.ReadCloser, error) {
+		gd.limiter.wait()
+		resp, err := gd.srv.Revisions.Get(fileID, revisionID).Download()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
 	}
 	return nil
 }
 
-// loadFiles gets names and properties of all files in the backup location.
-func (gd *GoogleDrive) loadFiles() (chan database.FileOrError, error) {
+// loadFiles gets names and properties of all files in the backup location.  Only the backup folders (and their
+// ancestors below rootFolderID) are loaded.  If no backup folders are configured then all descendants of rootFolderID
+// are loaded.  With the drive.file scope, all of the files created by backupd are loaded.
+// The listing stops at the first error or when ctx is cancelled.  The channel is always closed when the listing stops.
+func (gd *GoogleDrive) loadFiles(ctx context.Context) (chan database.FileOrError, error) {
 	fileCh := make(chan database.FileOrError)
-	go gd.listFiles(func(page *drive.FileList) error {
+	go func() {
+		defer close(fileCh)
+		l := newFileLoader(ctx, gd, fileCh)
+		defer l.cancel()
+		if gd.scope == drive.DriveFileScope {
+			l.loadAll()
+			return
+		}
+		startIDs := []string{gd.rootFolderID}
+		if len(gd.folders) > 0 {
+			startIDs = l.findFolders(gd.folders)
+		}
+		l.loadTree(startIDs)
+	}()
+	return fileCh, nil
+}
+
+// fileLoader tracks the state of a breadth-first listing of the backup folders.
+type fileLoader struct {
+	gd      *GoogleDrive
+	ctx     context.Context
+	cancel  context.CancelFunc // stops the listing after an error
+	fileCh  chan database.FileOrError
+	mutex   sync.Mutex
+	loaded  map[string]bool // IDs of files that have been sent to fileCh
+	errOnce sync.Once
+}
+
+func newFileLoader(ctx context.Context, gd *GoogleDrive, fileCh chan database.FileOrError) *fileLoader {
+	ctx, cancel := context.WithCancel(ctx)
+	return &fileLoader{gd: gd, ctx: ctx, cancel: cancel, fileCh: fileCh, loaded: make(map[string]bool)}
+}
+
+// send writes a file to the channel unless it is shared or has already been sent.  Returns true if the file is a
+// folder that has not been seen before.
+func (l *fileLoader) send(f *drive.File) bool {
+	if f.Shared {
+		return false
+	}
+	l.mutex.Lock()
+	isNew := !l.loaded[f.Id]
+	l.loaded[f.Id] = true
+	l.mutex.Unlock()
+	if isNew {
+		select {
+		case l.fileCh <- database.FileOrError{File: toRemoteFile(f)}:
+		case <-l.ctx.Done():
+			return false
+		}
+	}
+	return isNew && f.MimeType == l.gd.folderMimeType
+}
+
+// fail sends the first error to the channel and stops the listing.  Errors caused by stopping the listing are ignored.
+func (l *fileLoader) fail(err error) {
+	l.errOnce.Do(func() {
+		if l.ctx.Err() == nil {
+			select {
+			case l.fileCh <- database.FileOrError{Error: err}:
+			case <-l.ctx.Done():
+			}
+		}
+		l.cancel()
+	})
+}
+
+// list calls listFiles and sends each file to the callback.  Returns false if the listing failed or was stopped.
+func (l *fileLoader) list(query string, cb func(f *drive.File)) bool {
+	err := l.gd.listFiles(l.ctx, query, func(page *drive.FileList) error {
 		for _, f := range page.Files {
-			if !f.Shared {
-				fileCh <- database.FileOrError{File: &database.RemoteFile{
-					RemoteID:     &f.Id,
-					Name:         f.Name,
-					MimeType:     f.MimeType,
-					Size:         uint64(f.Size),
-					Md5Checksum:  &f.Md5Checksum,
-					ParentIDs:    f.Parents,
-					LastModified: &f.ModifiedTime,
-				}}
+			cb(f)
+		}
+		return l.ctx.Err()
+	})
+	if err != nil {
+		l.fail(err)
+		return false
+	}
+	return l.ctx.Err() == nil
+}
+
+// loadAll sends all of the visible files to the channel.
+func (l *fileLoader) loadAll() {
+	l.list("not trashed", func(f *drive.File) {
+		l.send(f)
+	})
+}
+
+// findFolders looks up the IDs of the backup folders.  The folders on each path are sent to the channel.  Folders that
+// don't exist yet are skipped.
+func (l *fileLoader) findFolders(folders []string) []string {
+	ids := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		parentID := l.gd.rootFolderID
+		for _, name := range strings.Split(path.Clean("/"+folder), "/") {
+			if name == "" {
+				continue
+			}
+			if parentID = l.findFolder(parentID, name); parentID == "" {
+				if l.ctx.Err() != nil {
+					return nil
+				}
+				log.Printf("Backup folder %s not found\n", folder)
+				break
 			}
 		}
-		if page.NextPageToken == "" {
-			close(fileCh)
+		if parentID != "" {
+			ids = append(ids, parentID)
+		}
+	}
+	return ids
+}
+
+// findFolder looks up a child folder by name.  Returns an empty string if the folder does not exist.
+func (l *fileLoader) findFolder(parentID string, name string) (folderID string) {
+	query := fmt.Sprintf("name = '%s' and '%s' in parents and mimeType = '%s' and not trashed",
+		escapeQuery(name), escapeQuery(parentID), l.gd.folderMimeType)
+	ok := l.list(query, func(f *drive.File) {
+		if folderID == "" && !f.Shared {
+			folderID = f.Id
+			l.send(f)
+		}
+	})
+	if !ok {
+		return ""
+	}
+	return folderID
+}
+
+// loadTree sends all descendants of the folders to the channel, one level at a time.  The children of each level are
+// listed using concurrent queries.
+func (l *fileLoader) loadTree(folderIDs []string) {
+	for len(folderIDs) > 0 && l.ctx.Err() == nil {
+		batches := make(chan []string)
+		var nextLevel []string
+		var wg sync.WaitGroup
+		for i := 0; i < listWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for batch := range batches {
+					folders := l.loadChildren(batch)
+					l.mutex.Lock()
+					nextLevel = append(nextLevel, folders...)
+					l.mutex.Unlock()
+				}
+			}()
+		}
+		for start := 0; start < len(folderIDs) && l.ctx.Err() == nil; start += folderBatchSize {
+			end := start + folderBatchSize
+			if end > len(folderIDs) {
+				end = len(folderIDs)
+			}
+			batches <- folderIDs[start:end]
 		}
+		close(batches)
+		wg.Wait()
+		folderIDs = nextLevel
+	}
+}
+
+// loadChildren sends the children of the folders to the channel.  Returns the IDs of the child folders.
+func (l *fileLoader) loadChildren(parentIDs []string) []string {
+	if l.ctx.Err() != nil {
 		return nil
+	}
+	conditions := make([]string, len(parentIDs))
+	for i, id := range parentIDs {
+		conditions[i] = fmt.Sprintf("'%s' in parents", escapeQuery(id))
+	}
+	query := fmt.Sprintf("(%s) and not trashed", strings.Join(conditions, " or "))
+	var folders []string
+	l.list(query, func(f *drive.File) {
+		if l.send(f) {
+			folders = append(folders, f.Id)
+		}
 	})
-	return fileCh, nil
+	return folders
+}
+
+// escapeQuery escapes a string value for use in a Drive search query.
+func escapeQuery(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
+
+func toRemoteFile(f *drive.File) *database.RemoteFile {
+	rf := &database.RemoteFile{
+		RemoteID:    &f.Id,
+		Name:        f.Name,
+		MimeType:    f.MimeType,
+		Size:        uint64(f.Size),
+		Md5Checksum: &f.Md5Checksum,
+		ParentIDs:   f.Parents,
+	}
+	if modTime, err := time.Parse(time.RFC3339Nano, f.ModifiedTime); err == nil {
+		rf.ModTime = modTime
+	}
+	if created, err := time.Parse(time.RFC3339Nano, f.CreatedTime); err == nil {
+		rf.Created = &created
+	}
+	if f.HeadRevisionId != "" {
+		rf.RevisionID = &f.HeadRevisionId
+	}
+	if f.ShortcutDetails != nil {
+		rf.TargetID = &f.ShortcutDetails.TargetId
+	}
+	setProperties(rf, f.AppProperties)
+	return rf
+}
+
+// parentID returns the ID to use for a parent folder.  An empty ID is replaced with rootFolderID.
+func (gd *GoogleDrive) parentID(folderID string) string {
+	if folderID == "" {
+		return gd.rootFolderID
+	}
+	return folderID
+}
+
+// isFolder returns true if the file is a folder.
+func (gd *GoogleDrive) isFolder(rf *database.RemoteFile) bool {
+	return rf.MimeType == gd.folderMimeType
+}
+
+// Create a folder.
+func (gd *GoogleDrive) createFolder(name string, parentID string) (*database.RemoteFile, error) {
+	log.Printf("Create folder %s\n", name)
+	folder := &drive.File{Name: name, MimeType: gd.folderMimeType, Parents: []string{gd.parentID(parentID)}}
+	created, err := gd.createFile(folder, nil)
+	if err != nil {
+		return nil, err
+	}
+	return toRemoteFile(created), nil
 }
 
 // Backup a new file.
-func (gd *GoogleDrive) store(localPath *string, finfo *filesys.FileInfo, remotePath *string) {
-	log.Printf("Store %s\n", *localPath)
-	_, file := path.Split(*remotePath)
-	log.Print(file)
+func (gd *GoogleDrive) store(localPath string, name string, parentID string, meta *fileMetadata) (*database.RemoteFile, error) {
+	log.Printf("Store %s\n", localPath)
+	f, err := meta.open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	file := &drive.File{Name: name, Parents: []string{gd.parentID(parentID)},
+		ModifiedTime: meta.modTime.UTC().Format(time.RFC3339Nano), AppProperties: meta.properties()}
+	created, err := gd.createFile(file, meta.reader(f))
+	if err != nil {
+		return nil, err
+	}
+	return toRemoteFile(created), nil
 }
 
 // Update the backup for an existing file.
-func (gd *GoogleDrive) update(localPath *string) {
-	log.Printf("Update %s\n", *localPath)
+func (gd *GoogleDrive) update(localPath string, rf *database.RemoteFile, meta *fileMetadata) (*database.RemoteFile, error) {
+	log.Printf("Update %s\n", localPath)
+	f, err := meta.open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	file := &drive.File{ModifiedTime: meta.modTime.UTC().Format(time.RFC3339Nano), AppProperties: meta.properties()}
+	updated, err := gd.updateFile(*rf.RemoteID, file, meta.reader(f))
+	if err != nil {
+		return nil, err
+	}
+	return toRemoteFile(updated), nil
+}
+
+// Update the properties of a backup without uploading its content.
+func (gd *GoogleDrive) updateMetadata(rf *database.RemoteFile, meta *fileMetadata) (*database.RemoteFile, error) {
+	log.Printf("Update metadata %s\n", meta.localPath)
+	file := &drive.File{ModifiedTime: meta.modTime.UTC().Format(time.RFC3339Nano), AppProperties: meta.properties()}
+	updated, err := gd.updateFile(*rf.RemoteID, file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return toRemoteFile(updated), nil
+}
+
+// Create a shortcut to the backup of another path of a hard linked file.
+func (gd *GoogleDrive) link(name string, parentID string, target *database.RemoteFile, meta *fileMetadata) (*database.RemoteFile, error) {
+	log.Printf("Link %s to %s\n", meta.localPath, target.Name)
+	file := &drive.File{Name: name, MimeType: shortcutMimeType, Parents: []string{gd.parentID(parentID)},
+		ShortcutDetails: &drive.FileShortcutDetails{TargetId: *target.RemoteID}, AppProperties: meta.properties()}
+	created, err := gd.createFile(file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return toRemoteFile(created), nil
+}
+
+// Download the content of a file.
+func (gd *GoogleDrive) download(rf *database.RemoteFile, w io.Writer) error {
+	content, err := gd.downloadFile(*rf.RemoteID)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	_, err = io.Copy(w, content)
+	return err
+}
+
+// Get the uploaded versions of a file.  The modification time of a revision in Drive is the time that it was uploaded.
+// Drive doesn't keep the local file's modification time for each revision, so it is left unset.
+func (gd *GoogleDrive) revisions(rf *database.RemoteFile) ([]*database.Revision, error) {
+	var revs []*database.Revision
+	err := gd.listRevisions(*rf.RemoteID, func(page *drive.RevisionList) error {
+		for _, r := range page.Revisions {
+			uploaded, err := time.Parse(time.RFC3339, r.ModifiedTime)
+			if err != nil {
+				return err
+			}
+			revs = append(revs, &database.Revision{ID: r.Id, Uploaded: uploaded, Md5Checksum: r.Md5Checksum})
+		}
+		return nil
+	})
+	return revs, err
+}
+
+// Download the content of a version of a file.
+func (gd *GoogleDrive) downloadRevision(rf *database.RemoteFile, revisionID string, w io.Writer) error {
+	content, err := gd.getRevision(*rf.RemoteID, revisionID)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	_, err = io.Copy(w, content)
+	return err
 }
 
 // Update the location and/or name of a file.
@@ -196,7 +685,27 @@ func (gd *GoogleDrive) move(localPath *string, rf *database.RemoteFile) {
 	log.Printf("Move %s to %s\n", *localPath, rf.Name)
 }
 
+// retryable returns true for errors caused by rate limiting, server errors and network timeouts.
+func (gd *GoogleDrive) retryable(err error) bool {
+	switch e := err.(type) {
+	case *googleapi.Error:
+		if e.Code == http.StatusTooManyRequests || e.Code >= http.StatusInternalServerError {
+			return true
+		}
+		for _, item := range e.Errors {
+			if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	case net.Error:
+		return e.Timeout()
+	}
+	return false
+}
+
 // Move a backup to the trash folder.
-func (gd *GoogleDrive) trash(localPath *string) {
-	log.Printf("Trash %s\n", *localPath)
+func (gd *GoogleDrive) trash(rf *database.RemoteFile) error {
+	log.Printf("Trash %s\n", rf.Name)
+	_, err := gd.updateFile(*rf.RemoteID, &drive.File{Trashed: true}, nil)
+	return err
 }
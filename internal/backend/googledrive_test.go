@@ -1,18 +1,29 @@
 package backend
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jonestimd/backupd/internal/config"
+	"github.com/jonestimd/backupd/internal/database"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 )
 
 type googleMock struct {
@@ -48,12 +59,18 @@ func TestNewGoogleDrive(t *testing.T) {
 	}{
 		{"error for no client secret file", &config.Backend{Config: map[string]*string{"clientSecretFile": &badFile}},
 			nil, nil, nil, nil, addrOf("open testdata/.auth/no_such_file.json: no such file or directory")},
+		{"error for unknown scope", &config.Backend{Config: map[string]*string{"scope": addrOf("drive.unknown")}},
+			nil, nil, nil, nil, addrOf("Unknown Google Drive scope: drive.unknown")},
 		{"error for oauth config", &config.Backend{Config: map[string]*string{}},
 			nil, errors.New(authCfgErr), nil, nil, &authCfgErr},
 		{"use saved token", &config.Backend{Config: map[string]*string{}},
 			&oauth2.Config{}, nil, nil, nil, nil},
 		{"return error from drive.New", &config.Backend{Config: map[string]*string{}},
 			&oauth2.Config{}, nil, nil, errors.New(svcError), &svcError},
+		{"error for negative request rate", &config.Backend{Config: map[string]*string{"requestsPerSecond": addrOf("-1")}},
+			nil, nil, nil, nil, addrOf("Invalid value for requestsPerSecond: -1")},
+		{"error for request burst less than 1", &config.Backend{Config: map[string]*string{"requestBurst": addrOf("0")}},
+			nil, nil, nil, nil, addrOf("Invalid value for requestBurst: 0")},
 		// {"get new token", &config.Backend{Config: map[string]*string{"tokenFile": &tokenFile}},
 		// 	&oauth2.Config{}, nil, nil, nil, nil},
 	}
@@ -67,10 +84,10 @@ func TestNewGoogleDrive(t *testing.T) {
 		newDrive = mg.newDrive
 		t.Run(test.name, func(t *testing.T) {
 			mg.Test(t)
-			mg.On("configFromJSON", jsonkey, []string{drive.DriveScope}).Return(test.authCfg, test.authCfgErr)
+			mg.On("configFromJSON", jsonkey, []string{drive.DriveFileScope}).Return(test.authCfg, test.authCfgErr)
 			mg.On("newDrive", mock.Anything).Return(test.svc, test.svcError)
 
-			gd, err := newGoogleDrive(&configDir, &dataDir, test.cfg)
+			gd, err := newGoogleDrive(&configDir, &dataDir, test.cfg, nil)
 
 			if test.expectedErr != nil {
 				assert.Equal(t, *test.expectedErr, err.Error())
@@ -82,6 +99,84 @@ func TestNewGoogleDrive(t *testing.T) {
 	}
 }
 
+func TestNewGoogleDrive_requestRate(t *testing.T) {
+	dataDir := "testdata"
+	configDir := filepath.Join(dataDir, ".auth")
+	tests := []struct {
+		name          string
+		rate          string
+		expectLimiter bool
+	}{
+		{"limit requests", "5", true},
+		{"no limit", "0", false},
+	}
+	for _, test := range tests {
+		var mg googleMock
+		configFromJSON = mg.configFromJSON
+		newDrive = mg.newDrive
+		t.Run(test.name, func(t *testing.T) {
+			mg.Test(t)
+			mg.On("configFromJSON", mock.Anything, mock.Anything).Return(&oauth2.Config{}, nil)
+			mg.On("newDrive", mock.Anything).Return((*drive.Service)(nil), nil)
+			cfg := &config.Backend{Config: map[string]*string{"requestsPerSecond": &test.rate}}
+
+			gd, err := newGoogleDrive(&configDir, &dataDir, cfg, nil)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectLimiter, gd.limiter != nil)
+		})
+	}
+}
+
+func TestSavedToken_scope(t *testing.T) {
+	legacy, err := tokenFromFile(filepath.Join("testdata", "legacy_token.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, drive.DriveScope, legacy.scope())
+
+	current, err := tokenFromFile(filepath.Join("testdata", ".auth", defaultTokenFile))
+	assert.Nil(t, err)
+	assert.Equal(t, drive.DriveFileScope, current.scope())
+}
+
+func TestSaveToken(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "token")
+	defer os.RemoveAll(dir)
+	token := &savedToken{oauth2.Token{AccessToken: "access"}, drive.DriveFileScope}
+
+	assert.Nil(t, saveToken(filepath.Join(dir, "token.json"), token))
+	saved, err := tokenFromFile(filepath.Join(dir, "token.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, token, saved)
+
+	err = saveToken(filepath.Join(dir, "missing", "token.json"), token)
+	assert.Contains(t, err.Error(), "Unable to cache oauth token")
+}
+
+func TestGetClient_ScopeChanged(t *testing.T) {
+	client, err := getClient(context.Background(), filepath.Join("testdata", "legacy_token.json"), drive.DriveFileScope, &oauth2.Config{})
+
+	assert.Nil(t, client)
+	assert.Equal(t, &tokenScopeError{drive.DriveScope, drive.DriveFileScope}, err)
+}
+
+func TestLoadFiles_FileScope(t *testing.T) {
+	gd := &GoogleDrive{folderMimeType: defaultFolderMimeType, rootFolderID: defaultRootFolderID,
+		scope: drive.DriveFileScope, folders: []string{"Backups/me"}}
+	gd.listFiles = func(ctx context.Context, query string, cb func(*drive.FileList) error) error {
+		assert.Equal(t, "not trashed", query)
+		return cb(&drive.FileList{Files: []*drive.File{{Id: "f1", MimeType: defaultFolderMimeType}, {Id: "f2"}}})
+	}
+
+	fileCh, err := gd.loadFiles(context.Background())
+
+	assert.Nil(t, err)
+	var ids []string
+	for file := range fileCh {
+		ids = append(ids, *file.File.RemoteID)
+	}
+	assert.Equal(t, []string{"f1", "f2"}, ids)
+}
+
 func TestLoadFiles_FieldMapping(t *testing.T) {
 	remoteFile := drive.File{
 		Id:           "remote ID",
@@ -90,16 +185,19 @@ func TestLoadFiles_FieldMapping(t *testing.T) {
 		Size:         123,
 		Md5Checksum:  "md5 checksum",
 		Parents:      []string{"the parent"},
+		CreatedTime:  "2018-05-01T12:00:00Z",
 		ModifiedTime: "yesterday",
+		AppProperties: map[string]string{"host": "host name", "path0": "/local/path", "localId": "local ID",
+			"mtime": "2018-06-01T12:00:00.5Z", "mode": "644"},
 	}
 	page := drive.FileList{Files: []*drive.File{&remoteFile}, NextPageToken: ""}
 	gd := &GoogleDrive{}
-	gd.listFiles = func(cb func(*drive.FileList) error) error {
+	gd.listFiles = func(ctx context.Context, query string, cb func(*drive.FileList) error) error {
 		cb(&page)
 		return nil
 	}
 
-	fileCh, err := gd.loadFiles()
+	fileCh, err := gd.loadFiles(context.Background())
 
 	assert.Nil(t, err)
 	file := <-fileCh
@@ -109,7 +207,126 @@ func TestLoadFiles_FieldMapping(t *testing.T) {
 	assert.Equal(t, uint64(remoteFile.Size), file.File.Size)
 	assert.Equal(t, remoteFile.Md5Checksum, *file.File.Md5Checksum)
 	assert.Equal(t, remoteFile.Parents, file.File.ParentIDs)
-	assert.Equal(t, remoteFile.ModifiedTime, *file.File.LastModified)
+	assert.Equal(t, time.Date(2018, 6, 1, 12, 0, 0, 500000000, time.UTC), file.File.ModTime)
+	assert.Equal(t, time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC), *file.File.Created)
+	assert.Equal(t, "host name", *file.File.Host)
+	assert.Equal(t, "/local/path", *file.File.LocalPath)
+	assert.Equal(t, "local ID", *file.File.LocalID)
+	assert.Equal(t, uint32(0644), *file.File.Mode)
+}
+
+func TestGoogleDrive_createFolder(t *testing.T) {
+	tests := []struct {
+		name           string
+		parentID       string
+		expectedParent string
+	}{
+		{"root folder", "", "rootId"},
+		{"child folder", "parentId", "parentId"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gd := &GoogleDrive{folderMimeType: defaultFolderMimeType, rootFolderID: "rootId"}
+			gd.createFile = func(file *drive.File, content io.Reader) (*drive.File, error) {
+				assert.Nil(t, content)
+				assert.Equal(t, &drive.File{Name: "folder", MimeType: defaultFolderMimeType, Parents: []string{test.expectedParent}}, file)
+				return &drive.File{Id: "folderId", Name: file.Name, MimeType: file.MimeType, Parents: file.Parents}, nil
+			}
+
+			rf, err := gd.createFolder("folder", test.parentID)
+
+			assert.Nil(t, err)
+			assert.Equal(t, "folderId", *rf.RemoteID)
+			assert.Equal(t, []string{test.expectedParent}, rf.ParentIDs)
+		})
+	}
+}
+
+func TestGoogleDrive_store(t *testing.T) {
+	localFile := filepath.Join("testdata", "to_be_backed_up.txt")
+	meta := &fileMetadata{host: "host", localPath: localFile, localID: "local ID",
+		modTime: time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), mode: 0644}
+	gd := &GoogleDrive{rootFolderID: "rootId"}
+	gd.createFile = func(file *drive.File, content io.Reader) (*drive.File, error) {
+		assert.NotNil(t, content)
+		assert.Equal(t, "file.txt", file.Name)
+		assert.Equal(t, []string{"parentId"}, file.Parents)
+		assert.Equal(t, "2018-06-01T12:00:00Z", file.ModifiedTime)
+		assert.Equal(t, meta.properties(), file.AppProperties)
+		return &drive.File{Id: "fileId", Name: file.Name, Parents: file.Parents, AppProperties: file.AppProperties}, nil
+	}
+
+	rf, err := gd.store(localFile, "file.txt", "parentId", meta)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "fileId", *rf.RemoteID)
+	assert.Equal(t, localFile, *rf.LocalPath)
+}
+
+func TestGoogleDrive_update(t *testing.T) {
+	localFile := filepath.Join("testdata", "to_be_backed_up.txt")
+	meta := &fileMetadata{host: "host", localPath: localFile, localID: "local ID",
+		modTime: time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), mode: 0644}
+	gd := &GoogleDrive{rootFolderID: "rootId"}
+	gd.updateFile = func(fileID string, file *drive.File, content io.Reader) (*drive.File, error) {
+		assert.NotNil(t, content)
+		assert.Equal(t, "fileId", fileID)
+		assert.Equal(t, &drive.File{ModifiedTime: "2018-06-01T12:00:00Z", AppProperties: meta.properties()}, file)
+		return &drive.File{Id: fileID, Name: "file.txt", AppProperties: file.AppProperties}, nil
+	}
+
+	rf, err := gd.update(localFile, newCacheFile("file.txt", "fileId", ""), meta)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "fileId", *rf.RemoteID)
+	assert.Equal(t, "local ID", *rf.LocalID)
+}
+
+func TestGoogleDrive_updateMetadata(t *testing.T) {
+	meta := &fileMetadata{host: "host", localPath: "/home/me/file.txt", localID: "local ID",
+		modTime: time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), mode: 0600, uid: 1000, gid: 100}
+	gd := &GoogleDrive{rootFolderID: "rootId"}
+	gd.updateFile = func(fileID string, file *drive.File, content io.Reader) (*drive.File, error) {
+		assert.Nil(t, content)
+		assert.Equal(t, "fileId", fileID)
+		assert.Equal(t, &drive.File{ModifiedTime: "2018-06-01T12:00:00Z", AppProperties: meta.properties()}, file)
+		return &drive.File{Id: fileID, Name: "file.txt", AppProperties: file.AppProperties}, nil
+	}
+
+	rf, err := gd.updateMetadata(newCacheFile("file.txt", "fileId", ""), meta)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "fileId", *rf.RemoteID)
+	assert.Equal(t, uint32(0600), *rf.Mode)
+	assert.Equal(t, uint32(1000), *rf.Uid)
+}
+
+func TestGoogleDrive_link(t *testing.T) {
+	meta := &fileMetadata{host: "host", localPath: "/home/me/link.txt", localID: "local ID",
+		modTime: time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), mode: 0644}
+	gd := &GoogleDrive{rootFolderID: "rootId"}
+	gd.createFile = func(file *drive.File, content io.Reader) (*drive.File, error) {
+		assert.Nil(t, content)
+		assert.Equal(t, &drive.File{Name: "link.txt", MimeType: shortcutMimeType, Parents: []string{"parentId"},
+			ShortcutDetails: &drive.FileShortcutDetails{TargetId: "fileId"}, AppProperties: meta.properties()}, file)
+		return &drive.File{Id: "linkId", Name: file.Name, MimeType: file.MimeType, Parents: file.Parents,
+			ShortcutDetails: file.ShortcutDetails, AppProperties: file.AppProperties}, nil
+	}
+
+	rf, err := gd.link("link.txt", "parentId", newCacheFile("file.txt", "fileId", ""), meta)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "linkId", *rf.RemoteID)
+	assert.Equal(t, "fileId", *rf.TargetID)
+	assert.Equal(t, "local ID", *rf.LocalID)
+}
+
+func TestGoogleDrive_store_Error(t *testing.T) {
+	gd := &GoogleDrive{rootFolderID: "rootId"}
+
+	_, err := gd.store("unknown.txt", "file.txt", "", &fileMetadata{})
+
+	assert.True(t, os.IsNotExist(err))
 }
 
 func TestLoadFiles(t *testing.T) {
@@ -130,15 +347,16 @@ func TestLoadFiles(t *testing.T) {
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			gd := &GoogleDrive{}
-			gd.listFiles = func(cb func(*drive.FileList) error) error {
+			gd := &GoogleDrive{folderMimeType: defaultFolderMimeType, rootFolderID: defaultRootFolderID}
+			gd.listFiles = func(ctx context.Context, query string, cb func(*drive.FileList) error) error {
+				assert.Equal(t, "('root' in parents) and not trashed", query)
 				for _, fl := range test.pages {
 					cb(&fl)
 				}
 				return nil
 			}
 
-			fileCh, err := gd.loadFiles()
+			fileCh, err := gd.loadFiles(context.Background())
 
 			assert.Nil(t, err)
 			var ids []*string
@@ -149,3 +367,267 @@ func TestLoadFiles(t *testing.T) {
 		})
 	}
 }
+
+// fakeDrive answers the list queries generated by loadFiles.
+type fakeDrive struct {
+	files   []*drive.File
+	mutex   sync.Mutex
+	queries []string
+	failOn  string // return an error for queries containing this string
+}
+
+var parentQuery = regexp.MustCompile(`'([^']*)' in parents`)
+var nameQuery = regexp.MustCompile(`^name = '([^']*)'`)
+
+func (fd *fakeDrive) listFiles(ctx context.Context, query string, cb func(*drive.FileList) error) error {
+	fd.mutex.Lock()
+	fd.queries = append(fd.queries, query)
+	fd.mutex.Unlock()
+	if fd.failOn != "" && strings.Contains(query, fd.failOn) {
+		return errors.New("list failed: " + query)
+	}
+	parents := make(map[string]bool)
+	for _, match := range parentQuery.FindAllStringSubmatch(query, -1) {
+		parents[match[1]] = true
+	}
+	name := nameQuery.FindStringSubmatch(query)
+	page := &drive.FileList{}
+	for _, f := range fd.files {
+		if name != nil && (f.Name != name[1] || f.MimeType != defaultFolderMimeType) {
+			continue
+		}
+		for _, parentID := range f.Parents {
+			if parents[parentID] {
+				page.Files = append(page.Files, f)
+				break
+			}
+		}
+	}
+	return cb(page)
+}
+
+func newFakeFile(id string, mimeType string, parents ...string) *drive.File {
+	return &drive.File{Id: id, Name: id, MimeType: mimeType, Parents: parents}
+}
+
+func TestLoadFiles_BackupFolders(t *testing.T) {
+	folder := defaultFolderMimeType
+	fd := &fakeDrive{files: []*drive.File{
+		newFakeFile("Backups", folder, "root"),
+		newFakeFile("Documents", folder, "root"),
+		newFakeFile("personal.txt", "text/plain", "Documents"),
+		newFakeFile("me", folder, "Backups"),
+		newFakeFile("you", folder, "Backups"),
+		newFakeFile("other.txt", "text/plain", "you"),
+		newFakeFile("file1.txt", "text/plain", "me"),
+		newFakeFile("subdir", folder, "me"),
+		newFakeFile("file2.txt", "text/plain", "subdir"),
+		newFakeFile("linked.txt", "text/plain", "subdir", "me"),
+	}}
+	gd := &GoogleDrive{folderMimeType: folder, rootFolderID: "root", folders: []string{"Backups/me", "missing"}, listFiles: fd.listFiles}
+
+	fileCh, err := gd.loadFiles(context.Background())
+
+	assert.Nil(t, err)
+	var ids []string
+	for file := range fileCh {
+		assert.Nil(t, file.Error)
+		ids = append(ids, *file.File.RemoteID)
+	}
+	sort.Strings(ids)
+	assert.Equal(t, []string{"Backups", "file1.txt", "file2.txt", "linked.txt", "me", "subdir"}, ids)
+}
+
+func TestLoadFiles_BatchesParents(t *testing.T) {
+	folder := defaultFolderMimeType
+	fd := &fakeDrive{}
+	for i := 0; i < folderBatchSize+1; i++ {
+		fd.files = append(fd.files, newFakeFile(fmt.Sprintf("folder%d", i), folder, "root"))
+	}
+	gd := &GoogleDrive{folderMimeType: folder, rootFolderID: "root", listFiles: fd.listFiles}
+
+	fileCh, _ := gd.loadFiles(context.Background())
+
+	count := 0
+	for range fileCh {
+		count++
+	}
+	assert.Equal(t, folderBatchSize+1, count)
+	assert.Equal(t, 3, len(fd.queries), "expected 1 query for root and 2 for its children")
+}
+
+func TestEscapeQuery(t *testing.T) {
+	assert.Equal(t, `it\'s a \\ test`, escapeQuery(`it's a \ test`))
+}
+
+// readFiles reads from the channel until it is closed.  Fails the test if the channel is not closed.
+func readFiles(t *testing.T, fileCh chan database.FileOrError) (ids []string, errs []error) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case file, ok := <-fileCh:
+			if !ok {
+				sort.Strings(ids)
+				return
+			}
+			if file.Error != nil {
+				errs = append(errs, file.Error)
+			} else {
+				ids = append(ids, *file.File.RemoteID)
+			}
+		case <-timeout:
+			t.Fatal("channel not closed")
+		}
+	}
+}
+
+func TestLoadFiles_ListError(t *testing.T) {
+	folder := defaultFolderMimeType
+	tests := []struct {
+		name        string
+		folders     []string
+		failOn      string
+		expectedIDs []string
+	}{
+		{"error finding folder", []string{"Backups/me"}, "name = 'me'", []string{"Backups"}},
+		{"error listing children", []string{"Backups"}, "'me' in parents", []string{"Backups", "file1.txt", "me"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fd := &fakeDrive{failOn: test.failOn, files: []*drive.File{
+				newFakeFile("Backups", folder, "root"),
+				newFakeFile("me", folder, "Backups"),
+				newFakeFile("file1.txt", "text/plain", "Backups"),
+				newFakeFile("file2.txt", "text/plain", "me"),
+			}}
+			gd := &GoogleDrive{folderMimeType: folder, rootFolderID: "root", folders: test.folders, listFiles: fd.listFiles}
+
+			fileCh, err := gd.loadFiles(context.Background())
+
+			assert.Nil(t, err)
+			ids, errs := readFiles(t, fileCh)
+			assert.Equal(t, test.expectedIDs, ids)
+			assert.Equal(t, 1, len(errs))
+		})
+	}
+}
+
+func TestLoadFiles_OnlyFirstError(t *testing.T) {
+	folder := defaultFolderMimeType
+	fd := &fakeDrive{failOn: "in parents"}
+	for i := 0; i < folderBatchSize*listWorkers; i++ {
+		fd.files = append(fd.files, newFakeFile(fmt.Sprintf("folder%d", i), folder, "root"))
+	}
+	gd := &GoogleDrive{folderMimeType: folder, rootFolderID: "root", listFiles: fd.listFiles}
+
+	fileCh, _ := gd.loadFiles(context.Background())
+
+	_, errs := readFiles(t, fileCh)
+	assert.Equal(t, 1, len(errs))
+}
+
+func TestLoadFiles_Cancelled(t *testing.T) {
+	folder := defaultFolderMimeType
+	fd := &fakeDrive{}
+	for i := 0; i < 10; i++ {
+		fd.files = append(fd.files, newFakeFile(fmt.Sprintf("file%d", i), "text/plain", "root"))
+	}
+	gd := &GoogleDrive{folderMimeType: folder, rootFolderID: "root", listFiles: fd.listFiles}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fileCh, _ := gd.loadFiles(ctx)
+	<-fileCh
+	cancel()
+
+	ids, errs := readFiles(t, fileCh)
+	assert.True(t, len(ids) < 9, "expected listing to stop")
+	assert.Empty(t, errs)
+}
+
+func TestGoogleDrive_download(t *testing.T) {
+	gd := &GoogleDrive{}
+	gd.downloadFile = func(fileID string) (io.ReadCloser, error) {
+		assert.Equal(t, "fileId", fileID)
+		return ioutil.NopCloser(strings.NewReader("file content")), nil
+	}
+	var buf bytes.Buffer
+
+	err := gd.download(newCacheFile("file.txt", "fileId", ""), &buf)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "file content", buf.String())
+}
+
+func TestGoogleDrive_revisions(t *testing.T) {
+	gd := &GoogleDrive{}
+	gd.listRevisions = func(fileID string, cb func(*drive.RevisionList) error) error {
+		assert.Equal(t, "fileId", fileID)
+		cb(&drive.RevisionList{Revisions: []*drive.Revision{{Id: "rev1", ModifiedTime: "2018-06-01T12:00:00.5Z", Md5Checksum: "md5 1"}}})
+		return cb(&drive.RevisionList{Revisions: []*drive.Revision{{Id: "rev2", ModifiedTime: "2018-06-02T12:00:00Z", Md5Checksum: "md5 2"}}})
+	}
+
+	revs, err := gd.revisions(newCacheFile("file.txt", "fileId", ""))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*database.Revision{
+		{ID: "rev1", Uploaded: time.Date(2018, 6, 1, 12, 0, 0, 500000000, time.UTC), Md5Checksum: "md5 1"},
+		{ID: "rev2", Uploaded: time.Date(2018, 6, 2, 12, 0, 0, 0, time.UTC), Md5Checksum: "md5 2"},
+	}, revs)
+}
+
+func TestGoogleDrive_downloadRevision(t *testing.T) {
+	gd := &GoogleDrive{}
+	gd.getRevision = func(fileID string, revisionID string) (io.ReadCloser, error) {
+		assert.Equal(t, "fileId", fileID)
+		assert.Equal(t, "rev1", revisionID)
+		return ioutil.NopCloser(strings.NewReader("old content")), nil
+	}
+	var buf bytes.Buffer
+
+	err := gd.downloadRevision(newCacheFile("file.txt", "fileId", ""), "rev1", &buf)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "old content", buf.String())
+}
+
+func TestGoogleDrive_trash(t *testing.T) {
+	gd := &GoogleDrive{}
+	gd.updateFile = func(fileID string, file *drive.File, content io.Reader) (*drive.File, error) {
+		assert.Equal(t, "fileId", fileID)
+		assert.Equal(t, &drive.File{Trashed: true}, file)
+		assert.Nil(t, content)
+		return file, nil
+	}
+
+	err := gd.trash(newCacheFile("file.txt", "fileId", ""))
+
+	assert.Nil(t, err)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestGoogleDrive_retryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"too many requests", &googleapi.Error{Code: 429}, true},
+		{"server error", &googleapi.Error{Code: 503}, true},
+		{"rate limit", &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, true},
+		{"forbidden", &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "insufficientPermissions"}}}, false},
+		{"not found", &googleapi.Error{Code: 404}, false},
+		{"timeout", timeoutError{}, true},
+		{"other error", errors.New("failed"), false},
+	}
+	gd := &GoogleDrive{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, gd.retryable(test.err))
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package backend
+
+import (
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/jonestimd/backupd/internal/database"
+	"github.com/jonestimd/backupd/internal/filesys"
+)
+
+// hardLinks records the paths in a source folder that share a file (inode).  The content of a group of hard links is
+// uploaded once and the other paths are backed up as links to it.
+type hardLinks struct {
+	mutex sync.Mutex
+	paths map[string][]string // local paths by local ID
+	ids   map[string]string   // local IDs by local path
+}
+
+func newHardLinks() *hardLinks {
+	return &hardLinks{paths: make(map[string][]string), ids: make(map[string]string)}
+}
+
+// add records a local file if it has multiple hard links.
+func (h *hardLinks) add(localPath string) {
+	info, err := os.Lstat(localPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Nlink < 2 {
+		return
+	}
+	if finfo, err := filesys.Stat(localPath); err == nil {
+		h.addID(finfo.ID(), localPath)
+	}
+}
+
+// addID records a path of a file with multiple hard links.  A path that is moved to a different file is removed from
+// its previous group.
+func (h *hardLinks) addID(localID string, localPath string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.ids[localPath] == localID {
+		return
+	}
+	h.removePath(localPath)
+	h.ids[localPath] = localID
+	h.paths[localID] = append(h.paths[localID], localPath)
+}
+
+// remove forgets a path.  Returns the other paths of the file that the path was linked to.
+func (h *hardLinks) remove(localPath string) []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	localID := h.ids[localPath]
+	h.removePath(localPath)
+	return append([]string(nil), h.paths[localID]...)
+}
+
+func (h *hardLinks) removePath(localPath string) {
+	localID, ok := h.ids[localPath]
+	if !ok {
+		return
+	}
+	delete(h.ids, localPath)
+	paths := h.paths[localID]
+	for i, path := range paths {
+		if path == localPath {
+			paths = append(paths[:i:i], paths[i+1:]...)
+			break
+		}
+	}
+	if len(paths) == 0 {
+		delete(h.paths, localID)
+	} else {
+		h.paths[localID] = paths
+	}
+}
+
+// others returns the other known paths of a file.
+func (h *hardLinks) others(localID string, localPath string) []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var paths []string
+	for _, path := range h.paths[localID] {
+		if path != localPath {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// hardLinkTarget returns the backup of another path of a file that has multiple hard links.  Returns nil if none of
+// the other paths has been backed up.
+func (b *backend) hardLinkTarget(m *Message, meta *fileMetadata) *database.RemoteFile {
+	if meta.links < 2 || meta.linkTarget != "" || m.dest == nil {
+		return nil
+	}
+	m.dest.hardLinks.addID(meta.localID, *m.local)
+	for _, localPath := range m.dest.hardLinks.others(meta.localID, *m.local) {
+		rf := b.cache.FindByPath(m.dest.RemotePath(localPath))
+		if rf != nil && rf.TargetID == nil && rf.LocalID != nil && *rf.LocalID == meta.localID {
+			return rf
+		}
+	}
+	return nil
+}
+
+// hardLinkChanged returns true if a path that was backed up as a link is no longer a hard link to the same file or
+// the backup of the file's content no longer exists.
+func (b *backend) hardLinkChanged(localPath string, rf *database.RemoteFile) bool {
+	finfo, err := filesys.Stat(localPath)
+	if err != nil || rf.LocalID == nil || *rf.LocalID != finfo.ID() {
+		return true
+	}
+	return b.cache.FindByRemoteID(*rf.TargetID) == nil
+}
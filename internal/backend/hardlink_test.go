@@ -0,0 +1,138 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHardLinks(t *testing.T) {
+	h := newHardLinks()
+
+	h.addID("id1", "/a")
+	h.addID("id1", "/b")
+	h.addID("id1", "/b")
+	h.addID("id2", "/c")
+
+	assert.Equal(t, []string{"/b"}, h.others("id1", "/a"))
+	assert.Equal(t, []string{"/a", "/b"}, h.others("id1", "/x"))
+	assert.Nil(t, h.others("id2", "/c"))
+
+	h.addID("id2", "/b")
+
+	assert.Nil(t, h.others("id1", "/a"), "moved path should be removed from its previous group")
+	assert.Equal(t, []string{"/c"}, h.remove("/b"))
+	assert.Empty(t, h.remove("/c"))
+	assert.Empty(t, h.remove("/a"))
+	assert.Empty(t, h.paths)
+	assert.Empty(t, h.ids)
+}
+
+func TestHardLinks_add(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hardlink")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("file"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "single.txt"), []byte("file"), 0644)
+	os.Link(filepath.Join(dir, "file.txt"), filepath.Join(dir, "link.txt"))
+	h := newHardLinks()
+
+	h.add(filepath.Join(dir, "file.txt"))
+	h.add(filepath.Join(dir, "link.txt"))
+	h.add(filepath.Join(dir, "single.txt"))
+
+	assert.Len(t, h.paths, 1)
+	assert.Equal(t, []string{filepath.Join(dir, "link.txt")}, h.others(h.ids[filepath.Join(dir, "file.txt")], filepath.Join(dir, "file.txt")))
+}
+
+// newHardLinkSource creates a source folder containing a file with two hard links.
+func newHardLinkSource() string {
+	source, _ := ioutil.TempDir("", "hardlink")
+	os.MkdirAll(filepath.Join(source, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(source, "file.txt"), []byte("file"), 0644)
+	os.Link(filepath.Join(source, "file.txt"), filepath.Join(source, "dir", "link.txt"))
+	return source
+}
+
+func TestBackend_HardLinks(t *testing.T) {
+	source := newHardLinkSource()
+	defer os.RemoveAll(source)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	srv := &mockService{}
+	b := &backend{queue: NewQueue(), cache: cache, srv: srv}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+
+	d.Scan()
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		assert.Nil(t, b.process(m, nil))
+	}
+
+	var stored, linked []string
+	for _, call := range srv.calls {
+		if strings.HasPrefix(call, "store ") {
+			stored = append(stored, call)
+		} else if strings.HasPrefix(call, "link ") {
+			linked = append(linked, call)
+		}
+	}
+	assert.Len(t, stored, 1, "content should be uploaded once")
+	assert.Len(t, linked, 1, "other path should be linked")
+	content := filepath.Join(source, "file.txt")
+	link := filepath.Join(source, "dir", "link.txt")
+	if strings.HasSuffix(stored[0], "link.txt") {
+		content, link = link, content
+	}
+	queued, err := d.Init(link)
+	assert.Nil(t, err)
+	assert.False(t, queued, "link should be unchanged")
+
+	// deleting the content's path moves the content to the other path
+	os.Remove(content)
+	srv.calls = nil
+	d.queueTrash(content)
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		assert.Nil(t, b.process(m, nil))
+	}
+
+	assert.Equal(t, []string{"trash " + filepath.Base(content), "trash " + filepath.Base(link), "store " + filepath.Base(link)},
+		srv.calls)
+	assert.Nil(t, cache.FindByPath(d.RemotePath(link)).TargetID)
+}
+
+func TestBackend_update_BrokenHardLink(t *testing.T) {
+	source := newHardLinkSource()
+	defer os.RemoveAll(source)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	srv := &mockService{}
+	b := &backend{queue: NewQueue(), cache: cache, srv: srv}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+	d.Scan()
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		b.process(m, nil)
+	}
+	link := filepath.Join(source, "dir", "link.txt")
+	if rf := cache.FindByPath(d.RemotePath(link)); rf.TargetID == nil {
+		link = filepath.Join(source, "file.txt")
+	}
+	os.Remove(link)
+	ioutil.WriteFile(link, []byte("copy"), 0644)
+	srv.calls = nil
+
+	queued, err := d.Init(link)
+	assert.Nil(t, err)
+	assert.True(t, queued, "broken link should be queued")
+	assert.Nil(t, b.process(b.queue.TryGet(), nil))
+
+	assert.Equal(t, []string{"trash " + filepath.Base(link), "store " + filepath.Base(link)}, srv.calls)
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+
+	"github.com/jonestimd/backupd/internal/database"
+	"github.com/jonestimd/backupd/internal/filesys"
+)
+
+// localHash returns the checksums of a local file's content.  The saved checksums are used if the file has not changed
+// since they were calculated.
+func (b *backend) localHash(localPath string) (*database.LocalHash, error) {
+	finfo, err := filesys.Stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if hash := b.cache.GetLocalHash(finfo.ID()); hash != nil && hash.Matches(finfo.Size(), finfo.ModTime(), finfo.ChangeTime()) {
+		return hash, nil
+	}
+	hash := &database.LocalHash{Size: finfo.Size(), ModTime: finfo.ModTime(), ChangeTime: finfo.ChangeTime()}
+	if hash.Md5, hash.Sha256, err = hashFile(localPath); err != nil {
+		return nil, err
+	}
+	return hash, b.cache.SaveLocalHash(finfo.ID(), hash)
+}
+
+// hashFile calculates the MD5 and SHA-256 checksums of a local file.
+func hashFile(localPath string) (string, string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), f); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(md5Hash.Sum(nil)), hex.EncodeToString(sha256Hash.Sum(nil)), nil
+}
+
+// changed returns true if a local file has been modified since it was backed up (see changeReason).
+func (b *backend) changed(localPath string, info os.FileInfo, rf *database.RemoteFile) bool {
+	return b.changeReason(localPath, info, rf) != ""
+}
+
+// changeReason describes how a local file has been modified since it was backed up.  Returns an empty string if the
+// file is unchanged.  The content is compared if the checksum of the backup is known.  Otherwise, the local file has
+// changed if its modification time is later than the backup's by more than the backend's tolerance.  A path that was
+// backed up as a hard link has changed if it is no longer linked to the backed up content.
+func (b *backend) changeReason(localPath string, info os.FileInfo, rf *database.RemoteFile) string {
+	if rf.TargetID != nil {
+		if b.hardLinkChanged(localPath, rf) {
+			return "hard link changed"
+		}
+		return ""
+	}
+	if uint64(info.Size()) != rf.Size {
+		return "size changed"
+	}
+	if checksum := checksum(rf); checksum != "" {
+		hash, err := b.localHash(localPath)
+		if err == nil {
+			if hash.Md5 != checksum {
+				return "checksum changed"
+			}
+			return ""
+		}
+		log.Printf("Error calculating checksum of %s: %v\n", localPath, err)
+	}
+	if info.ModTime().Sub(rf.ModTime) > b.modTimeTolerance {
+		return "modification time changed"
+	}
+	return ""
+}
+
+// unchanged returns true if the content of a local file matches the checksum of its backup.
+func (b *backend) unchanged(localPath string, rf *database.RemoteFile) bool {
+	checksum := checksum(rf)
+	if checksum == "" {
+		return false
+	}
+	hash, err := b.localHash(localPath)
+	return err == nil && hash.Md5 == checksum
+}
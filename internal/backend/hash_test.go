@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/filesys"
+	"github.com/stretchr/testify/assert"
+)
+
+const helloSha256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // SHA-256 of "hello"
+
+func TestHashFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hash")
+	defer os.RemoveAll(dir)
+	localFile := filepath.Join(dir, "file.txt")
+	ioutil.WriteFile(localFile, []byte("hello"), 0644)
+
+	md5Checksum, sha256Checksum, err := hashFile(localFile)
+
+	assert.Nil(t, err)
+	assert.Equal(t, helloMd5, md5Checksum)
+	assert.Equal(t, helloSha256, sha256Checksum)
+}
+
+func TestBackend_localHash(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hash")
+	defer os.RemoveAll(dir)
+	localFile := filepath.Join(dir, "file.txt")
+	ioutil.WriteFile(localFile, []byte("hello"), 0644)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	b := &backend{cache: cache}
+
+	hash, err := b.localHash(localFile)
+
+	assert.Nil(t, err)
+	assert.Equal(t, helloMd5, hash.Md5)
+	assert.Equal(t, helloSha256, hash.Sha256)
+	assert.Equal(t, uint64(5), hash.Size)
+	finfo, _ := filesys.Stat(localFile)
+	assert.Equal(t, hash, cache.GetLocalHash(finfo.ID()))
+
+	hash.Md5 = "saved checksum"
+	cache.SaveLocalHash(finfo.ID(), hash)
+	cached, _ := b.localHash(localFile)
+	assert.Equal(t, "saved checksum", cached.Md5, "expected saved checksums to be used")
+
+	ioutil.WriteFile(localFile, []byte("world"), 0644)
+	modTime := finfo.ModTime().Add(time.Second)
+	os.Chtimes(localFile, modTime, modTime) // the timestamp granularity may be too coarse to detect the write
+	updated, _ := b.localHash(localFile)
+	assert.Equal(t, "7d793037a0760186574b0282f2f435e7", updated.Md5)
+}
+
+func TestBackend_changed_ModTime(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hash")
+	defer os.RemoveAll(dir)
+	localFile := filepath.Join(dir, "file.txt")
+	ioutil.WriteFile(localFile, []byte("hello"), 0644)
+	localTime := time.Date(2018, 6, 1, 12, 0, 0, 123456789, time.Local)
+	os.Chtimes(localFile, localTime, localTime)
+	info, _ := os.Stat(localFile)
+	tests := []struct {
+		description string
+		remoteTime  time.Time
+		tolerance   time.Duration
+		expected    bool
+	}{
+		{"same time", localTime, 0, false},
+		{"same time in other zone", localTime.UTC(), 0, false},
+		{"newer remote time", localTime.Add(time.Second), 0, false},
+		{"older remote time", localTime.Add(-time.Millisecond), 0, true},
+		{"truncated remote time", localTime.Truncate(time.Millisecond), 0, true},
+		{"truncated remote time within tolerance", localTime.Truncate(time.Millisecond), time.Millisecond, false},
+		{"older remote time outside tolerance", localTime.Add(-2 * time.Second), time.Second, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			b := &backend{modTimeTolerance: test.tolerance}
+			rf := newCacheFile("file.txt", "fileId", "")
+			rf.Size = 5
+			rf.ModTime = test.remoteTime
+
+			assert.Equal(t, test.expected, b.changed(localFile, info, rf))
+		})
+	}
+}
+
+func TestBackend_process_UpdateUnchanged(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hash")
+	defer os.RemoveAll(dir)
+	localFile := filepath.Join(dir, "file.txt")
+	ioutil.WriteFile(localFile, []byte("hello"), 0644)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	tests := []struct {
+		name          string
+		checksum      string
+		mode          uint32
+		expectedCalls []string
+	}{
+		{"skips unchanged content", helloMd5, 0644, []string{}},
+		{"uploads changed content", "other", 0644, []string{"update file.txt"}},
+		{"updates changed permissions", helloMd5, 0600, []string{"updateMetadata file.txt"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rf := newCacheFile("file.txt", "fileId", "")
+			rf.Md5Checksum = addrOf(test.checksum)
+			rf.Mode = &test.mode
+			cache.Save(rf)
+			srv := &mockService{calls: []string{}}
+			b := backend{queue: NewQueue(), cache: cache, srv: srv}
+
+			b.process(newMessage(localFile, "/file.txt", UpdateAction), nil)
+
+			assert.Equal(t, test.expectedCalls, srv.calls)
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jonestimd/backupd/internal/database"
+	"github.com/jonestimd/backupd/internal/filesys"
+)
+
+// Keys for the properties that are saved with a backup.
+const (
+	hostProperty       = "host"
+	pathProperty       = "path"
+	localIDProperty    = "localId"
+	modTimeProperty    = "mtime"
+	modeProperty       = "mode"
+	linkProperty       = "link"
+	uidProperty        = "uid"
+	gidProperty        = "gid"
+	accessTimeProperty = "atime"
+	xattrProperty      = "xattr"
+	maxPropertyValue   = 100 // Drive limits the combined size of a property's key and value to 124 bytes
+	maxXattrParts      = 8   // limits the number of properties used for extended attributes
+	maxProperties      = 30  // Drive limits the number of properties that an app can add to a file
+)
+
+// fileMetadata contains the properties of a local file that are saved with its backup.  The properties are used to
+// rebuild the cache from the remote files.
+type fileMetadata struct {
+	host       string
+	localPath  string
+	localID    string
+	modTime    time.Time
+	mode       os.FileMode
+	links      uint64 // number of hard links
+	uid        uint32
+	gid        uint32
+	accessTime time.Time
+	xattrs     map[string][]byte // extended attributes, including ACLs
+	linkTarget string            // target of a symbolic link that is backed up as a link
+	progress   *int64            // receives the number of bytes uploaded (optional)
+
+	unsavedXattrs []string // names of the extended attributes that are too large to be saved
+}
+
+// newFileMetadata gets the properties of a local file.  If preserveLink is true and the file is a symbolic link then
+// the properties describe the link instead of its target.  Extended attributes that are too large to be saved are
+// logged.
+func newFileMetadata(localPath string, preserveLink bool) (*fileMetadata, error) {
+	meta, isLink, err := statMetadata(localPath, preserveLink)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.unsavedXattrs) > 0 {
+		log.Printf("Not saving extended attributes of %s: %s (too large)\n", localPath,
+			strings.Join(meta.unsavedXattrs, ", "))
+	}
+	if meta.host, err = os.Hostname(); err != nil {
+		return nil, err
+	}
+	if isLink {
+		if meta.linkTarget, err = os.Readlink(localPath); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// statMetadata gets the status and attributes of a local file.  If preserveLink is true and the file is a symbolic
+// link then the link is described instead of its target and isLink is true.
+func statMetadata(localPath string, preserveLink bool) (meta *fileMetadata, isLink bool, err error) {
+	var finfo *filesys.FileInfo
+	if preserveLink {
+		if finfo, err = filesys.Lstat(localPath); err != nil {
+			return nil, false, err
+		}
+		isLink = finfo.Mode()&os.ModeSymlink != 0
+	}
+	var xattrs map[string][]byte
+	if isLink {
+		xattrs, err = filesys.LgetXattrs(localPath)
+	} else if finfo, err = filesys.Stat(localPath); err == nil {
+		xattrs, err = filesys.GetXattrs(localPath)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	meta = &fileMetadata{localPath: localPath, localID: finfo.ID(), modTime: finfo.ModTime(), mode: finfo.Mode(),
+		links: finfo.Links(), uid: finfo.Uid(), gid: finfo.Gid(), accessTime: finfo.AccessTime()}
+	meta.xattrs, meta.unsavedXattrs = savedXattrs(xattrs)
+	return meta, isLink, nil
+}
+
+// attributesChanged returns true if the permissions, ownership or extended attributes of a local file differ from
+// its backup.  Attributes that were not recorded with the backup (e.g. by an older version) are not compared.
+func attributesChanged(localPath string, preserveLink bool, rf *database.RemoteFile) bool {
+	meta, _, err := statMetadata(localPath, preserveLink)
+	return err == nil && meta.attributesChanged(rf)
+}
+
+// attributesChanged returns true if the permissions, ownership or extended attributes differ from a backup.
+func (meta *fileMetadata) attributesChanged(rf *database.RemoteFile) bool {
+	if rf.Mode != nil && *rf.Mode != unixMode(meta.mode) {
+		return true
+	}
+	if rf.Uid == nil {
+		return false
+	}
+	if *rf.Uid != meta.uid || rf.Gid == nil || *rf.Gid != meta.gid || len(rf.Xattrs) != len(meta.xattrs) {
+		return true
+	}
+	for name, value := range meta.xattrs {
+		if saved, ok := rf.Xattrs[name]; !ok || !bytes.Equal(saved, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// savedXattrs returns the extended attributes that fit in the properties of a backup.  Attributes are added in order
+// of name until the limit is reached.  Also returns the names of the attributes that don't fit.
+func savedXattrs(xattrs map[string][]byte) (saved map[string][]byte, unsaved []string) {
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	saved = make(map[string][]byte)
+	for _, name := range names {
+		saved[name] = xattrs[name]
+		if len(encodeXattrs(saved)) > maxXattrParts*maxPropertyValue {
+			delete(saved, name)
+			unsaved = append(unsaved, name)
+		}
+	}
+	return saved, unsaved
+}
+
+// encodeXattrs converts extended attributes to a property value.
+func encodeXattrs(xattrs map[string][]byte) string {
+	value, _ := json.Marshal(xattrs)
+	return string(value)
+}
+
+// unixMode converts permissions to the bits used by chmod(2).
+func unixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// fileMode converts the bits used by chmod(2) to permissions.
+func fileMode(bits uint32) os.FileMode {
+	mode := os.FileMode(bits).Perm()
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// open returns the content to upload for a local file.  The content of a symbolic link that is backed up as a link is
+// its target.
+func (meta *fileMetadata) open() (io.ReadCloser, error) {
+	if meta.linkTarget != "" {
+		return ioutil.NopCloser(strings.NewReader(meta.linkTarget)), nil
+	}
+	return os.Open(meta.localPath)
+}
+
+// reader wraps the file's content to record the upload progress.
+func (meta *fileMetadata) reader(content io.Reader) io.Reader {
+	if meta.progress == nil {
+		return content
+	}
+	return &progressReader{content, meta.progress}
+}
+
+// properties converts the metadata to key/value pairs.  Long values are split into multiple properties.  The local path
+// and link target are omitted (and logged) if they would exceed Drive's limit on the number of properties.
+func (meta *fileMetadata) properties() map[string]string {
+	props := map[string]string{
+		hostProperty:    meta.host,
+		localIDProperty: meta.localID,
+		modTimeProperty: meta.modTime.UTC().Format(time.RFC3339Nano),
+		modeProperty:    strconv.FormatUint(uint64(unixMode(meta.mode)), 8),
+		uidProperty:     strconv.FormatUint(uint64(meta.uid), 10),
+		gidProperty:     strconv.FormatUint(uint64(meta.gid), 10),
+	}
+	if !meta.accessTime.IsZero() {
+		props[accessTimeProperty] = meta.accessTime.UTC().Format(time.RFC3339Nano)
+	}
+	if len(meta.xattrs) > 0 {
+		addParts(props, xattrProperty, encodeXattrs(meta.xattrs))
+	}
+	if !addParts(props, pathProperty, meta.localPath) {
+		log.Printf("Not saving the path of %s: too long\n", meta.localPath)
+	}
+	if meta.linkTarget != "" && !addParts(props, linkProperty, meta.linkTarget) {
+		log.Printf("Not saving the link target of %s: too long\n", meta.localPath)
+	}
+	return props
+}
+
+// addParts adds a value to the properties using numbered keys for each part.  The value is not added if its parts
+// would exceed maxProperties.  Returns false if the value was not added.
+func addParts(props map[string]string, key string, value string) bool {
+	parts := splitValue(value, maxPropertyValue)
+	if len(props)+len(parts) > maxProperties {
+		return false
+	}
+	for i, part := range parts {
+		props[fmt.Sprintf("%s%d", key, i)] = part
+	}
+	return true
+}
+
+// splitValue splits a string into parts of at most max bytes without splitting any characters.
+func splitValue(value string, max int) []string {
+	var parts []string
+	for len(value) > max {
+		end := max
+		for end > 0 && !utf8.RuneStart(value[end]) {
+			end--
+		}
+		parts = append(parts, value[:end])
+		value = value[end:]
+	}
+	return append(parts, value)
+}
+
+// setProperties copies the saved metadata to a cache record.
+func setProperties(rf *database.RemoteFile, props map[string]string) {
+	if value, ok := props[hostProperty]; ok {
+		rf.Host = &value
+	}
+	if value, ok := props[localIDProperty]; ok {
+		rf.LocalID = &value
+	}
+	if modTime, err := time.Parse(time.RFC3339Nano, props[modTimeProperty]); err == nil {
+		rf.ModTime = modTime
+	}
+	if mode, err := strconv.ParseUint(props[modeProperty], 8, 32); err == nil {
+		value := uint32(mode)
+		rf.Mode = &value
+	}
+	if uid, err := strconv.ParseUint(props[uidProperty], 10, 32); err == nil {
+		value := uint32(uid)
+		rf.Uid = &value
+	}
+	if gid, err := strconv.ParseUint(props[gidProperty], 10, 32); err == nil {
+		value := uint32(gid)
+		rf.Gid = &value
+	}
+	if accessTime, err := time.Parse(time.RFC3339Nano, props[accessTimeProperty]); err == nil {
+		rf.AccessTime = &accessTime
+	}
+	if value, ok := joinValue(props, xattrProperty); ok {
+		var xattrs map[string][]byte
+		if err := json.Unmarshal([]byte(value), &xattrs); err == nil {
+			rf.Xattrs = xattrs
+		}
+	}
+	if localPath, ok := joinValue(props, pathProperty); ok {
+		rf.LocalPath = &localPath
+	}
+	if target, ok := joinValue(props, linkProperty); ok {
+		rf.LinkTarget = &target
+	}
+}
+
+// joinValue combines the parts of a property that was split by splitValue.  Returns false if the property is not set.
+func joinValue(props map[string]string, key string) (string, bool) {
+	if _, ok := props[key+"0"]; !ok {
+		return "", false
+	}
+	value := ""
+	for i := 0; ; i++ {
+		part, ok := props[fmt.Sprintf("%s%d", key, i)]
+		if !ok {
+			return value, true
+		}
+		value += part
+	}
+}
@@ -0,0 +1,180 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFileMetadata(t *testing.T) {
+	localFile := filepath.Join("testdata", "to_be_backed_up.txt")
+	stat, _ := os.Stat(localFile)
+	host, _ := os.Hostname()
+
+	meta, err := newFileMetadata(localFile, false)
+
+	assert.Nil(t, err)
+	assert.Equal(t, host, meta.host)
+	assert.Equal(t, localFile, meta.localPath)
+	assert.NotEmpty(t, meta.localID)
+	assert.Equal(t, stat.ModTime(), meta.modTime)
+	assert.Equal(t, stat.Mode(), meta.mode)
+}
+
+func TestNewFileMetadata_Symlink(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "metadata")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("file"), 0644)
+	link := filepath.Join(dir, "link")
+	os.Symlink("file.txt", link)
+	tests := []struct {
+		name         string
+		preserveLink bool
+		linkTarget   string
+		content      string
+	}{
+		{"follow", false, "", "file"},
+		{"preserve", true, "file.txt", "file.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			meta, err := newFileMetadata(link, test.preserveLink)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.linkTarget, meta.linkTarget)
+			content, _ := meta.open()
+			defer content.Close()
+			data, _ := ioutil.ReadAll(content)
+			assert.Equal(t, test.content, string(data))
+		})
+	}
+}
+
+func TestNewFileMetadata_UnknownFile(t *testing.T) {
+	_, err := newFileMetadata("unknown.txt", false)
+
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileMetadata_properties(t *testing.T) {
+	longPath := "/" + strings.Repeat("é", maxPropertyValue)
+	meta := &fileMetadata{host: "host", localPath: longPath, localID: "local ID",
+		modTime: time.Date(2018, 6, 1, 12, 30, 15, 123456789, time.UTC), mode: 0640 | os.ModeSetgid,
+		uid: 1000, gid: 100, accessTime: time.Date(2018, 6, 2, 0, 0, 0, 0, time.UTC),
+		xattrs: map[string][]byte{"user.test": []byte("value")}}
+
+	props := meta.properties()
+
+	assert.Equal(t, map[string]string{
+		"host":    "host",
+		"localId": "local ID",
+		"mtime":   "2018-06-01T12:30:15.123456789Z",
+		"mode":    "2640",
+		"uid":     "1000",
+		"gid":     "100",
+		"atime":   "2018-06-02T00:00:00Z",
+		"xattr0":  `{"user.test":"dmFsdWU="}`,
+		"path0":   longPath[:maxPropertyValue-1],
+		"path1":   longPath[maxPropertyValue-1 : 2*maxPropertyValue-1],
+		"path2":   longPath[2*maxPropertyValue-1:],
+	}, props)
+}
+
+func TestFileMetadata_properties_Limit(t *testing.T) {
+	longPath := "/" + strings.Repeat("x", 20*maxPropertyValue)
+	meta := &fileMetadata{host: "host", localPath: "/path", localID: "local ID", linkTarget: longPath,
+		xattrs: map[string][]byte{"user.test": []byte(strings.Repeat("z", 5*maxPropertyValue))}}
+
+	props := meta.properties()
+	meta.localPath = longPath
+	longProps := meta.properties()
+
+	assert.Equal(t, "/path", props["path0"])
+	assert.Empty(t, props["link0"], "expected long link target to be omitted")
+	assert.Equal(t, 14, len(props))
+	assert.Empty(t, longProps["path0"], "expected long path to be omitted")
+	assert.Empty(t, longProps["link0"], "expected long link target to be omitted")
+}
+
+func TestSetProperties(t *testing.T) {
+	meta := &fileMetadata{host: "host", localPath: "/" + strings.Repeat("x", 2*maxPropertyValue), localID: "local ID",
+		modTime: time.Date(2018, 6, 1, 12, 30, 15, 0, time.UTC), mode: 0640,
+		linkTarget: "../" + strings.Repeat("y", maxPropertyValue), uid: 1000, gid: 100,
+		accessTime: time.Date(2018, 6, 2, 0, 0, 0, 0, time.UTC),
+		xattrs:     map[string][]byte{"user.test": []byte(strings.Repeat("z", maxPropertyValue))}}
+	rf := &database.RemoteFile{}
+
+	setProperties(rf, meta.properties())
+
+	assert.Equal(t, "host", *rf.Host)
+	assert.Equal(t, meta.localPath, *rf.LocalPath)
+	assert.Equal(t, "local ID", *rf.LocalID)
+	assert.Equal(t, meta.modTime, rf.ModTime)
+	assert.Equal(t, uint32(0640), *rf.Mode)
+	assert.Equal(t, meta.linkTarget, *rf.LinkTarget)
+	assert.Equal(t, uint32(1000), *rf.Uid)
+	assert.Equal(t, uint32(100), *rf.Gid)
+	assert.Equal(t, meta.accessTime, *rf.AccessTime)
+	assert.Equal(t, meta.xattrs, rf.Xattrs)
+}
+
+func TestFileMetadata_attributesChanged(t *testing.T) {
+	meta := &fileMetadata{mode: 0640, uid: 1000, gid: 100, xattrs: map[string][]byte{"user.test": []byte("value")}}
+	tests := []struct {
+		name     string
+		rf       *database.RemoteFile
+		expected bool
+	}{
+		{"not recorded", &database.RemoteFile{}, false},
+		{"same", &database.RemoteFile{Mode: addrOfUint32(0640), Uid: addrOfUint32(1000), Gid: addrOfUint32(100),
+			Xattrs: map[string][]byte{"user.test": []byte("value")}}, false},
+		{"mode", &database.RemoteFile{Mode: addrOfUint32(0644)}, true},
+		{"owner", &database.RemoteFile{Uid: addrOfUint32(0), Gid: addrOfUint32(100),
+			Xattrs: map[string][]byte{"user.test": []byte("value")}}, true},
+		{"group", &database.RemoteFile{Uid: addrOfUint32(1000), Gid: addrOfUint32(0),
+			Xattrs: map[string][]byte{"user.test": []byte("value")}}, true},
+		{"xattr value", &database.RemoteFile{Uid: addrOfUint32(1000), Gid: addrOfUint32(100),
+			Xattrs: map[string][]byte{"user.test": []byte("other")}}, true},
+		{"xattr added", &database.RemoteFile{Uid: addrOfUint32(1000), Gid: addrOfUint32(100)}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, meta.attributesChanged(test.rf))
+		})
+	}
+}
+
+func TestSavedXattrs(t *testing.T) {
+	large := []byte(strings.Repeat("x", maxXattrParts*maxPropertyValue))
+	xattrs := map[string][]byte{"user.a": []byte("a"), "user.b": large, "user.c": []byte("c")}
+
+	saved, unsaved := savedXattrs(xattrs)
+
+	assert.Equal(t, map[string][]byte{"user.a": []byte("a"), "user.c": []byte("c")}, saved)
+	assert.Equal(t, []string{"user.b"}, unsaved)
+	saved, unsaved = savedXattrs(nil)
+	assert.Nil(t, saved)
+	assert.Nil(t, unsaved)
+}
+
+func TestFileMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0644, 0755 | os.ModeSetuid, 0750 | os.ModeSetgid, 0777 | os.ModeSticky} {
+		assert.Equal(t, mode.Perm()|mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky), fileMode(unixMode(mode)))
+	}
+	assert.Equal(t, uint32(04755), unixMode(0755|os.ModeSetuid))
+}
+
+func TestSetProperties_NoProperties(t *testing.T) {
+	rf := &database.RemoteFile{}
+
+	setProperties(rf, nil)
+
+	assert.Equal(t, &database.RemoteFile{}, rf)
+}
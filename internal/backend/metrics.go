@@ -0,0 +1,64 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/jonestimd/backupd/internal/metrics"
+)
+
+// latencyBuckets are the upper bounds (in seconds) of the operation duration histogram buckets.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var (
+	operationsTotal = metrics.Default.NewCounter("backupd_operations_total",
+		"Number of backup actions by action and result.", "backend", "action", "result")
+	uploadedBytes = metrics.Default.NewCounter("backupd_uploaded_bytes_total",
+		"Number of bytes uploaded.", "backend")
+	operationDuration = metrics.Default.NewHistogram("backupd_backend_operation_duration_seconds",
+		"Duration of backend operations, including all of the requests for resumable uploads.", latencyBuckets,
+		"backend", "operation")
+	retriesTotal = metrics.Default.NewCounter("backupd_retries_total",
+		"Number of backup actions that were retried after a transient error.", "backend")
+	missedChangesTotal = metrics.Default.NewCounter("backupd_rescan_missed_changes_total",
+		"Number of changes found by periodic rescans that were not reported by the file watcher.", "source")
+)
+
+// RegisterMetrics adds gauges for the state of the destinations and their backends to the registry.
+func RegisterMetrics(r *metrics.Registry, dests []*Destination) {
+	r.NewGaugeFunc("backupd_queue_depth", "Number of pending backup actions.", []string{"backend"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, b := range GetStatus(dests).Backends {
+			samples = append(samples, metrics.Sample{Labels: []string{b.Name}, Value: float64(b.Queued)})
+		}
+		return samples
+	})
+	r.NewGaugeFunc("backupd_db_size_bytes", "Size of the cache database.", []string{"backend"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, b := range GetStatus(dests).Backends {
+			samples = append(samples, metrics.Sample{Labels: []string{b.Name}, Value: float64(b.DbSize)})
+		}
+		return samples
+	})
+	r.NewGaugeFunc("backupd_watched_directories", "Number of watched directories.", []string{"source"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, s := range GetStatus(dests).Sources {
+			samples = append(samples, metrics.Sample{Labels: []string{s.Path}, Value: float64(s.Watched)})
+		}
+		return samples
+	})
+	r.NewGaugeFunc("backupd_last_backup_age_seconds", "Time since the source folder was last found to be backed up.",
+		[]string{"source"}, func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, s := range GetStatus(dests).Sources {
+				if s.LastBackup != nil {
+					samples = append(samples, metrics.Sample{Labels: []string{s.Path}, Value: time.Since(*s.LastBackup).Seconds()})
+				}
+			}
+			return samples
+		})
+}
+
+// observe records the duration of a backend operation.  Each attempt of a retried operation is recorded separately.
+func (b *backend) observe(operation string, start time.Time) {
+	operationDuration.Observe(time.Since(start).Seconds(), b.name, operation)
+}
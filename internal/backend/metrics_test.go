@@ -0,0 +1,39 @@
+package backend
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.SaveLastBackup("/source1", time.Now().Add(-2*time.Hour))
+	b := &backend{name: "backend", queue: NewQueue(), cache: cache}
+	b.queue.Add(newMessage("local", "/remote", StoreAction))
+	d1 := newDestination(b, addrOf("/source1"), addrOf("Backups/one"), false)
+	d2 := newDestination(b, addrOf("/source2"), addrOf("Backups/two"), false)
+	d1.WatchAdded()
+	d2.backedUp(time.Now().Add(-time.Hour))
+	r := metrics.NewRegistry()
+	var buf bytes.Buffer
+
+	RegisterMetrics(r, []*Destination{d1, d2})
+	r.Write(&buf)
+
+	output := buf.String()
+	assert.Contains(t, output, "backupd_queue_depth{backend=\"backend\"} 1\n")
+	assert.Regexp(t, "backupd_db_size_bytes\\{backend=\"backend\"\\} [1-9]", output)
+	assert.Contains(t, output, "backupd_watched_directories{source=\"/source1\"} 1\n")
+	assert.Contains(t, output, "backupd_watched_directories{source=\"/source2\"} 0\n")
+	assert.Contains(t, output, "backupd_last_backup_age_seconds{source=\"/source2\"} 3600")
+	assert.Contains(t, output, "backupd_last_backup_age_seconds{source=\"/source1\"} 7200", "Expected the saved time")
+}
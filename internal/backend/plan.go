@@ -0,0 +1,179 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Remote operations that are reported by a dry run.
+const (
+	createFolderOperation   = "createFolder"
+	storeOperation          = "store"
+	linkOperation           = "link"
+	updateOperation         = "update"
+	updateMetadataOperation = "updateMetadata"
+	trashOperation          = "trash"
+	moveOperation           = "move"
+)
+
+var planOperations = []string{createFolderOperation, storeOperation, linkOperation, updateOperation,
+	updateMetadataOperation, trashOperation, moveOperation}
+
+// Plan records the remote operations that would be performed for the queued messages without calling the backends.
+// A renamed file is stored at its new path and the backup at its old path is trashed, so a move is reported when the
+// store and the trash of the same local file are both recorded.
+type Plan struct {
+	mutex    sync.Mutex
+	out      io.Writer
+	folders  map[string]bool   // folders that would be created, by backend name and remote path
+	stored   map[string]bool   // local IDs of the files with multiple hard links that would be stored
+	newPaths map[string]string // remote paths of the stored files that could be moves, by backend name and local ID
+	trashed  map[string]string // remote paths of the trashed files that could be moves, by backend name and local ID
+	Files    map[string]int    // number of files by operation
+	Bytes    map[string]int64  // number of bytes by operation
+}
+
+// NewPlan creates a plan that writes each operation to out.
+func NewPlan(out io.Writer) *Plan {
+	return &Plan{out: out, folders: make(map[string]bool), stored: make(map[string]bool),
+		newPaths: make(map[string]string), trashed: make(map[string]string), Files: make(map[string]int),
+		Bytes: make(map[string]int64)}
+}
+
+// add resolves a message to the remote operations that would be performed.
+func (p *Plan) add(b *backend, m *Message) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch m.action {
+	case StoreAction:
+		return p.store(b, m)
+	case UpdateAction:
+		return p.update(b, m)
+	case TrashAction:
+		if rf := b.cache.FindByPath(*m.remote); rf != nil {
+			p.record(b, trashOperation, *m.remote, int64(rf.Size))
+			if rf.LocalID != nil {
+				key := b.name + ":" + *rf.LocalID
+				if newPath, ok := p.newPaths[key]; ok {
+					delete(p.newPaths, key)
+					p.recordMove(b, *m.remote, newPath, int64(rf.Size))
+				} else {
+					p.trashed[key] = *m.remote
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// store records the upload of a new file, or a link if another path of the file has been backed up or would be
+// stored first.
+func (p *Plan) store(b *backend, m *Message) error {
+	meta, err := newFileMetadata(*m.local, m.preserveLink())
+	if err != nil {
+		return err
+	}
+	p.createFolders(b, filepath.Dir(*m.remote))
+	if b.hardLinkTarget(m, meta) != nil || m.dest != nil && p.stored[meta.localID] {
+		p.record(b, linkOperation, *m.remote, 0)
+		return nil
+	}
+	size, err := contentSize(*m.local, meta)
+	if err != nil {
+		return err
+	}
+	if meta.links > 1 && meta.linkTarget == "" {
+		p.stored[meta.localID] = true
+	}
+	p.record(b, storeOperation, *m.remote, size)
+	key := b.name + ":" + meta.localID
+	if oldPath, ok := p.trashed[key]; ok {
+		delete(p.trashed, key)
+		p.recordMove(b, oldPath, *m.remote, size)
+	} else {
+		p.newPaths[key] = *m.remote
+	}
+	return nil
+}
+
+// update records the operations that would be performed for a changed file.  Only the metadata is updated if the
+// content of the file matches its backup.
+func (p *Plan) update(b *backend, m *Message) error {
+	rf := b.cache.FindByPath(*m.remote)
+	if rf == nil {
+		return p.store(b, m)
+	}
+	if rf.TargetID != nil && b.hardLinkChanged(*m.local, rf) {
+		p.record(b, trashOperation, *m.remote, int64(rf.Size))
+		return p.store(b, m)
+	}
+	meta, err := newFileMetadata(*m.local, m.preserveLink())
+	if err != nil {
+		return err
+	}
+	if b.contentUnchanged(m, rf) {
+		if meta.attributesChanged(rf) {
+			p.record(b, updateMetadataOperation, *m.remote, 0)
+		}
+		return nil
+	}
+	size, err := contentSize(*m.local, meta)
+	if err != nil {
+		return err
+	}
+	p.record(b, updateOperation, *m.remote, size)
+	return nil
+}
+
+// contentSize returns the number of bytes that would be uploaded for a file.  The content of a preserved symbolic link
+// is its target.
+func contentSize(localPath string, meta *fileMetadata) (int64, error) {
+	if meta.linkTarget != "" {
+		return int64(len(meta.linkTarget)), nil
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// createFolders records the creation of the missing folders in a remote path.
+func (p *Plan) createFolders(b *backend, remotePath string) {
+	if remotePath == string(filepath.Separator) || remotePath == "." {
+		return
+	}
+	key := b.name + ":" + remotePath
+	if p.folders[key] || b.cache.FindByPath(remotePath) != nil {
+		return
+	}
+	p.createFolders(b, filepath.Dir(remotePath))
+	p.folders[key] = true
+	p.record(b, createFolderOperation, remotePath, 0)
+}
+
+func (p *Plan) record(b *backend, operation string, remotePath string, size int64) {
+	p.Files[operation]++
+	p.Bytes[operation] += size
+	fmt.Fprintf(p.out, "%s %s:%s (%d bytes)\n", operation, b.name, remotePath, size)
+}
+
+// recordMove links the store and the trash of a renamed file.
+func (p *Plan) recordMove(b *backend, oldPath string, newPath string, size int64) {
+	p.Files[moveOperation]++
+	p.Bytes[moveOperation] += size
+	fmt.Fprintf(p.out, "%s %s:%s -> %s (%d bytes, stored at the new path and trashed at the old path)\n", moveOperation,
+		b.name, oldPath, newPath, size)
+}
+
+// PrintSummary writes the number of files and bytes for each operation.
+func (p *Plan) PrintSummary(w io.Writer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, operation := range planOperations {
+		fmt.Fprintf(w, "%s: %d files, %d bytes\n", operation, p.Files[operation], p.Bytes[operation])
+	}
+}
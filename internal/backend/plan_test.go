@@ -0,0 +1,157 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jonestimd/backupd/internal/filesys"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlan_add(t *testing.T) {
+	localFile := filepath.Join("testdata", "to_be_backed_up.txt")
+	stat, _ := os.Stat(localFile)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.Save(newCacheFile("existing", "existingId", ""))
+	existing := newCacheFile("file.txt", "fileId", "existingId")
+	existing.Size = 10
+	cache.Save(existing)
+	srv := &mockService{}
+	var out bytes.Buffer
+	plan := NewPlan(&out)
+	b := &backend{name: "backend", queue: NewQueue(), cache: cache, srv: srv, plan: plan}
+
+	b.process(newMessage(localFile, "/new/dir/file.txt", StoreAction), nil)
+	b.process(newMessage(localFile, "/new/dir/other.txt", UpdateAction), nil)
+	b.process(newMessage(localFile, "/existing/file.txt", UpdateAction), nil)
+	b.process(newMessage(localFile, "/existing/file.txt", TrashAction), nil)
+	b.process(newMessage(localFile, "/existing/unknown.txt", TrashAction), nil)
+
+	assert.Empty(t, srv.calls)
+	assert.Equal(t, "createFolder backend:/new (0 bytes)\n"+
+		"createFolder backend:/new/dir (0 bytes)\n"+
+		fmt.Sprintf("store backend:/new/dir/file.txt (%d bytes)\n", stat.Size())+
+		fmt.Sprintf("store backend:/new/dir/other.txt (%d bytes)\n", stat.Size())+
+		fmt.Sprintf("update backend:/existing/file.txt (%d bytes)\n", stat.Size())+
+		"trash backend:/existing/file.txt (10 bytes)\n", out.String())
+	assert.Equal(t, map[string]int{"createFolder": 2, "store": 2, "update": 1, "trash": 1}, plan.Files)
+	assert.Equal(t, map[string]int64{"createFolder": 0, "store": 2 * stat.Size(), "update": stat.Size(), "trash": 10}, plan.Bytes)
+	assert.NotNil(t, cache.FindByPath("/existing/file.txt"))
+}
+
+func TestPlan_add_HardLinks(t *testing.T) {
+	source := newHardLinkSource()
+	defer os.RemoveAll(source)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	var out bytes.Buffer
+	plan := NewPlan(&out)
+	srv := &mockService{}
+	b := &backend{name: "backend", queue: NewQueue(), cache: cache, srv: srv, plan: plan}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+
+	d.Scan()
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		assert.Nil(t, b.process(m, nil))
+	}
+
+	assert.Empty(t, srv.calls)
+	assert.Equal(t, map[string]int{createFolderOperation: 1, storeOperation: 1, linkOperation: 1}, plan.Files)
+	assert.Equal(t, int64(len("file")), plan.Bytes[storeOperation]+plan.Bytes[linkOperation])
+}
+
+func TestPlan_add_MetadataOnly(t *testing.T) {
+	source, _ := ioutil.TempDir("", "plan")
+	defer os.RemoveAll(source)
+	localFile := filepath.Join(source, "file.txt")
+	ioutil.WriteFile(localFile, []byte("hello"), 0600)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	rf := newRestoreFile("file.txt", "fileId", helloMd5, 0644, "2018-06-01T12:00:00Z")
+	rf.ParentIDs = []string{"backupsId"}
+	rf.Size = 5
+	rf.Uid = addrOfUint32(uint32(os.Getuid()))
+	rf.Gid = addrOfUint32(uint32(os.Getgid()))
+	cache.Save(rf)
+	var out bytes.Buffer
+	plan := NewPlan(&out)
+	b := &backend{name: "backend", queue: NewQueue(), cache: cache, srv: &mockService{}, plan: plan}
+
+	assert.Nil(t, b.process(newMessage(localFile, "/Backups/file.txt", UpdateAction), nil))
+	os.Chmod(localFile, 0644)
+	assert.Nil(t, b.process(newMessage(localFile, "/Backups/file.txt", UpdateAction), nil))
+
+	assert.Equal(t, "updateMetadata backend:/Backups/file.txt (0 bytes)\n", out.String())
+	assert.Equal(t, map[string]int{updateMetadataOperation: 1}, plan.Files)
+}
+
+func TestPlan_add_Move(t *testing.T) {
+	source, _ := ioutil.TempDir("", "plan")
+	defer os.RemoveAll(source)
+	localFile := filepath.Join(source, "new.txt")
+	ioutil.WriteFile(localFile, []byte("hello"), 0644)
+	info, _ := filesys.Stat(localFile)
+	tests := []struct {
+		name     string
+		messages []*Message
+	}{
+		{"store before trash", []*Message{newMessage(localFile, "/Backups/new.txt", StoreAction),
+			newMessage(filepath.Join(source, "old.txt"), "/Backups/old.txt", TrashAction)}},
+		{"trash before store", []*Message{newMessage(filepath.Join(source, "old.txt"), "/Backups/old.txt", TrashAction),
+			newMessage(localFile, "/Backups/new.txt", StoreAction)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := initCache()
+			defer func() {
+				cache.Close()
+				os.Remove(dbPath)
+			}()
+			cache.Save(newCacheFile("Backups", "backupsId", ""))
+			old := newCacheFile("old.txt", "oldId", "backupsId")
+			old.Size = 5
+			old.LocalID = addrOf(info.ID())
+			cache.Save(old)
+			var out bytes.Buffer
+			plan := NewPlan(&out)
+			b := &backend{name: "backend", queue: NewQueue(), cache: cache, srv: &mockService{}, plan: plan}
+
+			for _, m := range test.messages {
+				assert.Nil(t, b.process(m, nil))
+			}
+
+			assert.Contains(t, out.String(),
+				"move backend:/Backups/old.txt -> /Backups/new.txt (5 bytes, stored at the new path and trashed at the old path)\n")
+			assert.Equal(t, map[string]int{storeOperation: 1, trashOperation: 1, moveOperation: 1}, plan.Files)
+		})
+	}
+}
+
+func TestPlan_PrintSummary(t *testing.T) {
+	plan := NewPlan(nil)
+	plan.Files[storeOperation] = 2
+	plan.Bytes[storeOperation] = 100
+	var out bytes.Buffer
+
+	plan.PrintSummary(&out)
+
+	assert.Equal(t, "createFolder: 0 files, 0 bytes\nstore: 2 files, 100 bytes\nlink: 0 files, 0 bytes\n"+
+		"update: 0 files, 0 bytes\nupdateMetadata: 0 files, 0 bytes\ntrash: 0 files, 0 bytes\nmove: 0 files, 0 bytes\n",
+		out.String())
+}
@@ -2,7 +2,11 @@ package backend
 
 import (
 	"container/list"
+	"path/filepath"
+	"strings"
 	"sync"
+
+	"github.com/jonestimd/backupd/internal/config"
 )
 
 // Action is an enum of actions to perform for a file.
@@ -17,42 +21,138 @@ const (
 	TrashAction
 )
 
+var actionNames = map[Action]string{
+	StoreAction:  "store",
+	UpdateAction: "update",
+	TrashAction:  "trash",
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
 // Message contains a pending action for a file.
 type Message struct {
 	local  *string
 	remote *string
 	action Action
+	dest   *Destination
+}
+
+// preserveLink returns true if symbolic links are backed up as links for the file's destination.
+func (m *Message) preserveLink() bool {
+	return m.dest != nil && m.dest.symlinks == config.PreserveSymlinks
 }
 
 // Queue maintains a list of pending backup updates.
 type Queue struct {
-	items *list.List
-	mutex *sync.Mutex
-	ready *sync.Cond
+	items   *list.List
+	mutex   *sync.Mutex
+	ready   *sync.Cond
+	pending map[string]int // number of queued messages by local path
 }
 
 // NewQueue creates an empty queue.
 func NewQueue() *Queue {
 	mutex := &sync.Mutex{}
-	return &Queue{list.New(), mutex, sync.NewCond(mutex)}
+	return &Queue{list.New(), mutex, sync.NewCond(mutex), make(map[string]int)}
 }
 
 // Add appends a message to the queue.
 func (q *Queue) Add(m *Message) {
 	q.mutex.Lock()
 	q.items.PushBack(m)
+	q.pending[*m.local]++
 	q.mutex.Unlock()
 	q.ready.Signal()
 }
 
-// Get gets a message from the queue.
-func (q *Queue) Get() *Message {
+// Get gets a message from the queue, waiting for one to be added if the queue is empty.  Returns nil if halt is closed.
+func (q *Queue) Get(halt chan bool) *Message {
+	if halt != nil {
+		done := make(chan bool)
+		defer close(done)
+		go func() {
+			select {
+			case <-halt:
+				q.mutex.Lock()
+				q.ready.Broadcast()
+				q.mutex.Unlock()
+			case <-done:
+			}
+		}()
+	}
 	q.mutex.Lock()
-	for q.items.Len() == 0 {
+	defer q.mutex.Unlock()
+	for {
+		select {
+		case <-halt:
+			return nil
+		default:
+		}
+		if q.items.Len() > 0 {
+			break
+		}
 		q.ready.Wait()
 	}
 	e := q.items.Front()
-	q.items.Remove(e)
+	q.remove(e)
+	return e.Value.(*Message)
+}
+
+// Requeue puts a message that was not processed back at the front of the queue.
+func (q *Queue) Requeue(m *Message) {
+	q.mutex.Lock()
+	q.items.PushFront(m)
+	q.pending[*m.local]++
 	q.mutex.Unlock()
+	q.ready.Signal()
+}
+
+// Len returns the number of messages in the queue.
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.items.Len()
+}
+
+// TryGet gets a message from the queue.  Returns nil if the queue is empty.
+func (q *Queue) TryGet() *Message {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	e := q.items.Front()
+	if e == nil {
+		return nil
+	}
+	q.remove(e)
 	return e.Value.(*Message)
 }
+
+// Pending returns true if there is a queued message for a local file.
+func (q *Queue) Pending(localPath string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.pending[localPath] > 0
+}
+
+// PendingIn returns true if there is a queued message for a file in a directory or its subdirectories.
+func (q *Queue) PendingIn(dir string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	prefix := strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+	for localPath := range q.pending {
+		if localPath == dir || strings.HasPrefix(localPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// remove removes a message from the queue.  Must be called with the mutex locked.
+func (q *Queue) remove(e *list.Element) {
+	q.items.Remove(e)
+	local := *e.Value.(*Message).local
+	if q.pending[local]--; q.pending[local] <= 0 {
+		delete(q.pending, local)
+	}
+}
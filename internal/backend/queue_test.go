@@ -6,7 +6,7 @@ import (
 )
 
 func newMessage(local string, remote string, action Action) *Message {
-	return &Message{&local, &remote, action}
+	return &Message{&local, &remote, action, nil}
 }
 
 func TestQueue_IsFifo(t *testing.T) {
@@ -21,7 +21,7 @@ func TestQueue_IsFifo(t *testing.T) {
 	}
 
 	for _, expected := range messages {
-		actual := q.Get()
+		actual := q.Get(nil)
 		if !reflect.DeepEqual(actual, expected) {
 			t.Errorf("Expected %v but got %v", expected, actual)
 		}
@@ -37,7 +37,7 @@ func TestQueue_GetWaitsForMessage(t *testing.T) {
 	ch := make(chan *Message)
 	go func() {
 		for range messages {
-			ch <- q.Get()
+			ch <- q.Get(nil)
 		}
 		close(ch)
 	}()
@@ -53,3 +53,101 @@ func TestQueue_GetWaitsForMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestQueue_GetHalted(t *testing.T) {
+	q := NewQueue()
+	halt := make(chan bool)
+	ch := make(chan *Message)
+	go func() {
+		ch <- q.Get(halt)
+	}()
+
+	close(halt)
+
+	if actual := <-ch; actual != nil {
+		t.Errorf("Expected nil but got %v", actual)
+	}
+	q.Add(newMessage("local path", "remote path", StoreAction))
+	if actual := q.Get(halt); actual != nil {
+		t.Errorf("Expected nil but got %v", actual)
+	}
+}
+
+func TestQueue_Requeue(t *testing.T) {
+	first := newMessage("local path 1", "remote path 1", StoreAction)
+	second := newMessage("local path 2", "remote path 2", StoreAction)
+	q := NewQueue()
+	q.Add(second)
+
+	q.Requeue(first)
+
+	if !q.Pending("local path 1") {
+		t.Error("Expected local path 1 to be pending")
+	}
+	for _, expected := range []*Message{first, second} {
+		if actual := q.TryGet(); actual != expected {
+			t.Errorf("Expected %v but got %v", expected, actual)
+		}
+	}
+}
+
+func TestQueue_Len(t *testing.T) {
+	q := NewQueue()
+	q.Add(newMessage("local path 1", "remote path 1", StoreAction))
+	q.Add(newMessage("local path 2", "remote path 2", StoreAction))
+	q.Get(nil)
+
+	if q.Len() != 1 {
+		t.Errorf("Expected 1 but got %d", q.Len())
+	}
+}
+
+func TestQueue_TryGet(t *testing.T) {
+	m := newMessage("local path", "remote path", StoreAction)
+	q := NewQueue()
+	q.Add(m)
+
+	if actual := q.TryGet(); actual != m {
+		t.Errorf("Expected %v but got %v", m, actual)
+	}
+	if actual := q.TryGet(); actual != nil {
+		t.Errorf("Expected nil but got %v", actual)
+	}
+}
+
+func TestQueue_Pending(t *testing.T) {
+	q := NewQueue()
+	q.Add(newMessage("local path 1", "remote path 1", StoreAction))
+	q.Add(newMessage("local path 1", "remote path 1", UpdateAction))
+	q.Add(newMessage("local path 2", "remote path 2", StoreAction))
+
+	q.Get(nil)
+	if !q.Pending("local path 1") {
+		t.Error("Expected local path 1 to be pending")
+	}
+	q.TryGet()
+	if q.Pending("local path 1") {
+		t.Error("Expected local path 1 not to be pending")
+	}
+	if !q.Pending("local path 2") {
+		t.Error("Expected local path 2 to be pending")
+	}
+	if q.Pending("local path 3") {
+		t.Error("Expected local path 3 not to be pending")
+	}
+}
+
+func TestQueue_PendingIn(t *testing.T) {
+	q := NewQueue()
+	q.Add(newMessage("/source/dir/file.txt", "remote path", StoreAction))
+
+	if !q.PendingIn("/source") {
+		t.Error("Expected /source to have pending messages")
+	}
+	if !q.PendingIn("/source/dir/") {
+		t.Error("Expected /source/dir/ to have pending messages")
+	}
+	if q.PendingIn("/source/di") {
+		t.Error("Expected /source/di not to have pending messages")
+	}
+}
@@ -0,0 +1,68 @@
+package backend
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/database"
+)
+
+const dayFormat = "2006-01-02"
+
+// quotaStore persists the upload usage.
+type quotaStore interface {
+	GetUploadQuota() *database.UploadQuota
+	SaveUploadQuota(quota *database.UploadQuota) error
+}
+
+// uploadQuota enforces a daily limit on the number of bytes uploaded to a backend.
+type uploadQuota struct {
+	limit uint64
+	store quotaStore
+	usage *database.UploadQuota
+	mutex sync.Mutex
+	now   func() time.Time
+}
+
+func newUploadQuota(limit uint64, store quotaStore) *uploadQuota {
+	usage := store.GetUploadQuota()
+	if usage == nil {
+		usage = &database.UploadQuota{}
+	}
+	return &uploadQuota{limit: limit, store: store, usage: usage, now: time.Now}
+}
+
+// check returns the time that the daily limit will be reset if uploading a file of the given size would exceed the
+// limit.  Otherwise, returns the zero time.  A file is always allowed if nothing has been uploaded on the current day.
+// The usage is not updated.
+func (q *uploadQuota) check(size uint64) time.Time {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	now := q.today()
+	if q.usage.Bytes > 0 && q.usage.Bytes+size > q.limit {
+		year, month, day := now.Date()
+		return time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+	}
+	return time.Time{}
+}
+
+// add adds the number of bytes that were uploaded to the daily usage.
+func (q *uploadQuota) add(size uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.today()
+	q.usage.Bytes += size
+	if err := q.store.SaveUploadQuota(q.usage); err != nil {
+		log.Printf("Error saving upload quota: %v\n", err)
+	}
+}
+
+// today resets the usage if the day has changed.  Returns the current time.
+func (q *uploadQuota) today() time.Time {
+	now := q.now()
+	if today := now.Format(dayFormat); q.usage.Day != today {
+		q.usage = &database.UploadQuota{Day: today}
+	}
+	return now
+}
@@ -0,0 +1,79 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/database"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockQuotaStore struct {
+	saved *database.UploadQuota
+}
+
+func (s *mockQuotaStore) GetUploadQuota() *database.UploadQuota {
+	return s.saved
+}
+
+func (s *mockQuotaStore) SaveUploadQuota(quota *database.UploadQuota) error {
+	copy := *quota
+	s.saved = &copy
+	return nil
+}
+
+func TestUploadQuota_check(t *testing.T) {
+	now := time.Date(2018, 6, 1, 13, 0, 0, 0, time.Local)
+	tomorrow := time.Date(2018, 6, 2, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name     string
+		saved    *database.UploadQuota
+		size     uint64
+		expected time.Time
+		usage    uint64
+	}{
+		{"nothing saved", nil, 100, time.Time{}, 0},
+		{"under limit", &database.UploadQuota{Day: "2018-06-01", Bytes: 900}, 100, time.Time{}, 900},
+		{"over limit", &database.UploadQuota{Day: "2018-06-01", Bytes: 901}, 100, tomorrow, 901},
+		{"previous day", &database.UploadQuota{Day: "2018-05-31", Bytes: 1000}, 100, time.Time{}, 0},
+		{"large file on new day", nil, 2000, time.Time{}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &mockQuotaStore{test.saved}
+			q := newUploadQuota(1000, store)
+			q.now = func() time.Time { return now }
+
+			resume := q.check(test.size)
+
+			assert.Equal(t, test.expected, resume)
+			assert.Equal(t, test.usage, q.usage.Bytes)
+			assert.Equal(t, "2018-06-01", q.usage.Day)
+			assert.Equal(t, test.saved, store.saved, "check should not save the usage")
+		})
+	}
+}
+
+func TestUploadQuota_add(t *testing.T) {
+	now := time.Date(2018, 6, 1, 13, 0, 0, 0, time.Local)
+	tests := []struct {
+		name  string
+		saved *database.UploadQuota
+		usage uint64
+	}{
+		{"nothing saved", nil, 100},
+		{"same day", &database.UploadQuota{Day: "2018-06-01", Bytes: 900}, 1000},
+		{"previous day", &database.UploadQuota{Day: "2018-05-31", Bytes: 1000}, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &mockQuotaStore{test.saved}
+			q := newUploadQuota(1000, store)
+			q.now = func() time.Time { return now }
+
+			q.add(100)
+
+			assert.Equal(t, &database.UploadQuota{Day: "2018-06-01", Bytes: test.usage}, store.saved)
+		})
+	}
+}
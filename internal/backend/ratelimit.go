@@ -0,0 +1,49 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket for limiting the rate of API requests or file checks.
+type rateLimiter struct {
+	rate   float64 // tokens added per second
+	burst  float64 // max number of tokens
+	tokens float64
+	last   time.Time // time of the last update of tokens
+	mutex  sync.Mutex
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now(),
+		now: time.Now, sleep: time.Sleep}
+}
+
+// wait blocks until a request is allowed.  A nil limiter does not limit requests.
+func (rl *rateLimiter) wait() {
+	if rl == nil {
+		return
+	}
+	for delay := rl.take(); delay > 0; delay = rl.take() {
+		rl.sleep(delay)
+	}
+}
+
+// take removes a token from the bucket.  Returns the time to wait for a token if the bucket is empty.
+func (rl *rateLimiter) take() time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	now := rl.now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+	if rl.tokens >= 1 {
+		rl.tokens--
+		return 0
+	}
+	return time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+}
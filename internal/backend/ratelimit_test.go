@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(clock *fakeClock, rate float64, burst int) *rateLimiter {
+	rl := newRateLimiter(rate, burst)
+	rl.now = clock.Now
+	rl.sleep = clock.Sleep
+	rl.last = clock.now
+	return rl
+}
+
+func TestRateLimiter_AllowsBurst(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	rl := newTestLimiter(clock, 2, 3)
+
+	for i := 0; i < 3; i++ {
+		rl.wait()
+	}
+
+	assert.Empty(t, clock.sleeps)
+}
+
+func TestRateLimiter_WaitsForToken(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	rl := newTestLimiter(clock, 2, 1)
+
+	rl.wait()
+	rl.wait()
+	rl.wait()
+
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, 500 * time.Millisecond}, clock.sleeps)
+}
+
+func TestRateLimiter_RefillsToBurst(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	rl := newTestLimiter(clock, 10, 2)
+	rl.wait()
+	rl.wait()
+
+	clock.now = clock.now.Add(time.Hour)
+
+	assert.Equal(t, time.Duration(0), rl.take())
+	assert.Equal(t, time.Duration(0), rl.take())
+	assert.Equal(t, 100*time.Millisecond, rl.take())
+}
+
+func TestRateLimiter_Nil(t *testing.T) {
+	var rl *rateLimiter
+
+	rl.wait()
+}
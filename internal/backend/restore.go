@@ -0,0 +1,313 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/config"
+	"github.com/jonestimd/backupd/internal/database"
+	"github.com/jonestimd/backupd/internal/filesys"
+)
+
+// RestoreOptions specifies the files to restore.
+type RestoreOptions struct {
+	Backend string    // name of the backend
+	Pattern string    // remote path or glob
+	Target  string    // directory for the restored files
+	InPlace bool      // restore files to their source directories instead of Target
+	AsOf    time.Time // restore the versions that were current at this time (zero for the current versions)
+}
+
+// errNotCreated indicates that a file did not exist at the requested time.
+var errNotCreated = errors.New("file did not exist")
+
+// restorer downloads backed up files.
+type restorer struct {
+	backend  *backend
+	dests    []*Destination
+	opts     *RestoreOptions
+	restored map[string]string // local paths of the restored content by remote ID, for recreating hard links
+}
+
+// Restore downloads the files that match the remote path or glob.  The contents of matching folders are also restored.
+// Returns the number of files that were restored.
+func Restore(configDir *string, dataDir *string, backupConfig *config.Config, opts *RestoreOptions) (int, error) {
+	b, err := openBackend(configDir, dataDir, backupConfig, opts.Backend)
+	if err != nil {
+		return 0, err
+	}
+	defer b.cache.Close()
+	backends := map[string]*backend{opts.Backend: b}
+	dests := newDestinations(backendSources(opts.Backend, backupConfig.Sources), backupConfig.Watch, backends)
+	r := &restorer{backend: b, dests: dests, opts: opts}
+	return r.restore(r.findFiles())
+}
+
+// findFiles returns the files that match the pattern.  For a point in time restore, files that were trashed after
+// that time are included.
+func (r *restorer) findFiles() map[string]*database.RemoteFile {
+	files := r.backend.cache.FindByPattern(r.opts.Pattern)
+	if !r.opts.AsOf.IsZero() {
+		for path, rf := range r.backend.cache.FindTrashedByPattern(r.opts.Pattern, r.opts.AsOf) {
+			files[path] = rf // the existing file was created after the trashed file was deleted
+		}
+	}
+	return files
+}
+
+// restore downloads the files.  Folders are restored before their contents and hard links are recreated after the
+// other files.
+func (r *restorer) restore(files map[string]*database.RemoteFile) (int, error) {
+	if len(files) == 0 {
+		return 0, errors.New("No backups match " + r.opts.Pattern)
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	// hard links are restored after the files that they are linked to
+	sort.SliceStable(paths, func(i, j int) bool {
+		return files[paths[i]].TargetID == nil && files[paths[j]].TargetID != nil
+	})
+	r.restored = make(map[string]string)
+	restored, failed := 0, 0
+	for _, remotePath := range paths {
+		localPath, err := r.localPath(remotePath)
+		if err == nil {
+			err = r.restoreFile(localPath, files[remotePath])
+		}
+		if err == nil && files[remotePath].TargetID == nil {
+			r.restored[*files[remotePath].RemoteID] = localPath
+		}
+		if err == errNotCreated {
+			log.Printf("Skipping %s: created after %s\n", remotePath, r.opts.AsOf.Format(time.RFC3339))
+		} else if err != nil {
+			log.Printf("Error restoring %s: %v\n", remotePath, err)
+			failed++
+		} else {
+			restored++
+		}
+	}
+	if failed > 0 {
+		return restored, fmt.Errorf("Failed to restore %d of %d files", failed, len(paths))
+	}
+	return restored, nil
+}
+
+// localPath returns the restore location for a remote file.
+func (r *restorer) localPath(remotePath string) (string, error) {
+	if !r.opts.InPlace {
+		return filepath.Join(r.opts.Target, remotePath), nil
+	}
+	for _, d := range r.dests {
+		root := d.remoteRootPath()
+		if remotePath == root || strings.HasPrefix(remotePath, root+string(filepath.Separator)) {
+			return d.LocalPath(remotePath), nil
+		}
+	}
+	return "", errors.New("not in a backup folder")
+}
+
+// restoreFile downloads a file or creates a folder or symbolic link.  The file's permissions, ownership, extended
+// attributes and access and modification times are also restored.  Returns errNotCreated if the file did not exist at
+// the time requested for a point in time restore.
+func (r *restorer) restoreFile(localPath string, rf *database.RemoteFile) error {
+	if r.backend.srv.isFolder(rf) {
+		if !r.opts.AsOf.IsZero() && rf.Created != nil && rf.Created.After(r.opts.AsOf) {
+			return errNotCreated
+		}
+		return os.MkdirAll(localPath, 0755)
+	}
+	if rf.TargetID != nil {
+		return r.restoreHardLink(localPath, rf)
+	}
+	rev, err := r.revision(rf)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restoring %s\n", localPath)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	if rf.LinkTarget != nil {
+		return r.restoreLink(localPath, rf, rev)
+	}
+	if err := r.download(localPath, rf, rev); err != nil {
+		return err
+	}
+	if err := restoreAttributes(localPath, rf); err != nil {
+		return err
+	}
+	if rf.Mode != nil {
+		if err := os.Chmod(localPath, fileMode(*rf.Mode)); err != nil {
+			return err
+		}
+	}
+	modTime := rf.ModTime
+	if rev != nil {
+		modTime = rev.ModTime
+		if modTime.IsZero() {
+			modTime = rev.Uploaded // the local modification time is unknown for revisions that aren't cached
+		}
+	}
+	if !modTime.IsZero() {
+		accessTime := modTime
+		if rf.AccessTime != nil {
+			accessTime = *rf.AccessTime
+		}
+		return os.Chtimes(localPath, accessTime, modTime)
+	}
+	return nil
+}
+
+// restoreAttributes sets the ownership and extended attributes (including ACLs) of a restored file.  Ownership is
+// only restored when running as root.  Extended attributes that can't be set are logged and skipped.  Symbolic links
+// are not followed.
+func restoreAttributes(localPath string, rf *database.RemoteFile) error {
+	if rf.Uid != nil && rf.Gid != nil && os.Geteuid() == 0 {
+		if err := os.Lchown(localPath, int(*rf.Uid), int(*rf.Gid)); err != nil {
+			return err
+		}
+	}
+	skipped, err := filesys.SetXattrs(localPath, rf.Xattrs)
+	if len(skipped) > 0 {
+		log.Printf("Unable to restore extended attributes of %s: %s\n", localPath, strings.Join(skipped, ", "))
+	}
+	return err
+}
+
+// restoreLink creates a symbolic link.  The content of a link's backup is its target, so an older version of the link
+// is downloaded to get its target.  The link replaces an existing file.
+func (r *restorer) restoreLink(localPath string, rf *database.RemoteFile, rev *database.Revision) error {
+	target := *rf.LinkTarget
+	if rev != nil {
+		var buf bytes.Buffer
+		if err := r.backend.srv.downloadRevision(rf, rev.ID, &buf); err != nil {
+			return err
+		}
+		target = buf.String()
+	}
+	if err := replaceFile(localPath, func(tmp string) error { return os.Symlink(target, tmp) }); err != nil {
+		return err
+	}
+	return restoreAttributes(localPath, rf)
+}
+
+// restoreHardLink links a file to the restored content of another path of the file.  If the other path was not
+// restored then the content is downloaded.
+func (r *restorer) restoreHardLink(localPath string, rf *database.RemoteFile) error {
+	if target, ok := r.restored[*rf.TargetID]; ok {
+		log.Printf("Linking %s to %s\n", localPath, target)
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		return replaceFile(localPath, func(tmp string) error { return os.Link(target, tmp) })
+	}
+	target := r.backend.cache.FindByRemoteID(*rf.TargetID)
+	if target == nil {
+		return errors.New("linked backup not found")
+	}
+	if err := r.restoreFile(localPath, target); err != nil {
+		return err
+	}
+	r.restored[*rf.TargetID] = localPath
+	return nil
+}
+
+// replaceFile creates a file using a temporary name and then moves it to localPath, replacing an existing file.
+func replaceFile(localPath string, create func(tmp string) error) error {
+	tmp := filepath.Join(filepath.Dir(localPath), ".backupd-restore-"+filepath.Base(localPath))
+	os.Remove(tmp)
+	if err := create(tmp); err != nil {
+		return err
+	}
+	err := os.Rename(tmp, localPath)
+	// rename doesn't remove tmp if localPath is already a hard link to the same file
+	os.Remove(tmp)
+	return err
+}
+
+// revision returns the version of a file that was current at the time requested for a point in time restore.
+// Uploads recorded in the cache are used if one of them is old enough.  Otherwise, the revisions are requested from
+// the backend and merged with the cached uploads.  Returns nil to restore the current version.
+func (r *restorer) revision(rf *database.RemoteFile) (*database.Revision, error) {
+	if r.opts.AsOf.IsZero() {
+		return nil, nil
+	}
+	cached := r.backend.cache.GetRevisions(*rf.RemoteID)
+	if selected := selectRevision(cached, r.opts.AsOf); selected != nil {
+		return selected, nil
+	}
+	revs, err := r.backend.srv.revisions(rf)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*database.Revision, len(cached))
+	for _, rev := range cached {
+		byID[rev.ID] = rev
+	}
+	for i, rev := range revs {
+		if cachedRev, ok := byID[rev.ID]; ok {
+			revs[i] = cachedRev // the local modification time is only known for cached uploads
+		}
+	}
+	if selected := selectRevision(revs, r.opts.AsOf); selected != nil {
+		return selected, nil
+	}
+	return nil, errNotCreated
+}
+
+// selectRevision returns the latest revision that was current at a time.  Returns nil if all of the revisions are
+// later.
+func selectRevision(revs []*database.Revision, asOf time.Time) *database.Revision {
+	var selected *database.Revision
+	for _, rev := range revs {
+		if !rev.Uploaded.After(asOf) && (selected == nil || rev.Uploaded.After(selected.Uploaded)) {
+			selected = rev
+		}
+	}
+	return selected
+}
+
+// download writes the content of a file to a temporary file and verifies its checksum before replacing the local file.
+// Fails if the checksum is not known.  Downloads the current content if rev is nil.
+func (r *restorer) download(localPath string, rf *database.RemoteFile, rev *database.Revision) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(localPath), ".backupd-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := md5.New()
+	expected := checksum(rf)
+	if rev == nil {
+		err = r.backend.srv.download(rf, io.MultiWriter(tmp, hash))
+	} else {
+		expected = rev.Md5Checksum
+		err = r.backend.srv.downloadRevision(rf, rev.ID, io.MultiWriter(tmp, hash))
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if expected == "" {
+		return errors.New("no checksum to verify the download")
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, actual)
+	}
+	return os.Rename(tmp.Name(), localPath)
+}
@@ -0,0 +1,308 @@
+package backend
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/database"
+	"github.com/jonestimd/backupd/internal/filesys"
+	"github.com/stretchr/testify/assert"
+)
+
+const helloMd5 = "5d41402abc4b2a76b9719d911017c592" // MD5 of "hello"
+
+func newRestoreFile(name string, remoteID string, checksum string, mode uint32, modTime string) *database.RemoteFile {
+	rf := newCacheFile(name, remoteID, "")
+	rf.Md5Checksum = &checksum
+	rf.Mode = &mode
+	rf.ModTime, _ = time.Parse(time.RFC3339Nano, modTime)
+	return rf
+}
+
+func newRestorer(srv *mockService, opts *RestoreOptions) *restorer {
+	b := &backend{srv: srv}
+	return &restorer{backend: b, opts: opts, dests: []*Destination{
+		newDestination(b, addrOf(filepath.Join(opts.Target, "source")), addrOf("Backups/me"), false),
+	}}
+}
+
+func TestRestorer_restore(t *testing.T) {
+	target, _ := ioutil.TempDir("", "restore")
+	defer os.RemoveAll(target)
+	srv := &mockService{content: map[string]string{"fileId": "hello"}}
+	r := newRestorer(srv, &RestoreOptions{Pattern: "/Backups", Target: target})
+	folder := newCacheFile("me", "folderId", "")
+	folder.MimeType = defaultFolderMimeType
+
+	count, err := r.restore(map[string]*database.RemoteFile{
+		"/Backups/me":          folder,
+		"/Backups/me/file.txt": newRestoreFile("file.txt", "fileId", helloMd5, 0600, "2018-06-01T12:00:00.5Z"),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	localFile := filepath.Join(target, "Backups", "me", "file.txt")
+	content, _ := ioutil.ReadFile(localFile)
+	assert.Equal(t, "hello", string(content))
+	stat, _ := os.Stat(localFile)
+	assert.Equal(t, os.FileMode(0600), stat.Mode())
+	assert.Equal(t, time.Date(2018, 6, 1, 12, 0, 0, 500000000, time.UTC), stat.ModTime().UTC())
+	assert.Equal(t, []string{"download file.txt"}, srv.calls)
+}
+
+func TestRestorer_restore_InPlace(t *testing.T) {
+	target, _ := ioutil.TempDir("", "restore")
+	defer os.RemoveAll(target)
+	srv := &mockService{content: map[string]string{"fileId": "hello"}}
+	r := newRestorer(srv, &RestoreOptions{Pattern: "/Backups", Target: target, InPlace: true})
+
+	count, err := r.restore(map[string]*database.RemoteFile{
+		"/Backups/me/dir/file.txt": newRestoreFile("file.txt", "fileId", helloMd5, 0644, "2018-06-01T12:00:00Z"),
+		"/Other/file.txt":          newRestoreFile("file.txt", "otherId", helloMd5, 0644, "2018-06-01T12:00:00Z"),
+	})
+
+	assert.EqualError(t, err, "Failed to restore 1 of 2 files")
+	assert.Equal(t, 1, count)
+	content, _ := ioutil.ReadFile(filepath.Join(target, "source", "dir", "file.txt"))
+	assert.Equal(t, "hello", string(content))
+}
+
+func TestRestorer_restore_ChecksumMismatch(t *testing.T) {
+	target, _ := ioutil.TempDir("", "restore")
+	defer os.RemoveAll(target)
+	srv := &mockService{content: map[string]string{"fileId": "corrupted"}}
+	r := newRestorer(srv, &RestoreOptions{Pattern: "/file.txt", Target: target})
+
+	count, err := r.restore(map[string]*database.RemoteFile{
+		"/file.txt": newRestoreFile("file.txt", "fileId", helloMd5, 0644, "2018-06-01T12:00:00Z"),
+	})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, count)
+	files, _ := ioutil.ReadDir(target)
+	assert.Empty(t, files, "expected temporary file to be removed")
+}
+
+func TestRestorer_restore_NoChecksum(t *testing.T) {
+	target, _ := ioutil.TempDir("", "restore")
+	defer os.RemoveAll(target)
+	srv := &mockService{content: map[string]string{"fileId": "hello"}}
+	r := newRestorer(srv, &RestoreOptions{Pattern: "/file.txt", Target: target})
+	rf := newRestoreFile("file.txt", "fileId", "", 0644, "2018-06-01T12:00:00Z")
+	rf.Md5Checksum = nil
+
+	count, err := r.restore(map[string]*database.RemoteFile{"/file.txt": rf})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, count)
+	files, _ := ioutil.ReadDir(target)
+	assert.Empty(t, files, "expected temporary file to be removed")
+}
+
+func TestRestorer_restore_DownloadError(t *testing.T) {
+	target, _ := ioutil.TempDir("", "restore")
+	defer os.RemoveAll(target)
+	srv := &mockService{err: errors.New("download failed")}
+	r := newRestorer(srv, &RestoreOptions{Pattern: "/file.txt", Target: target})
+
+	count, err := r.restore(map[string]*database.RemoteFile{
+		"/file.txt": newRestoreFile("file.txt", "fileId", helloMd5, 0644, "2018-06-01T12:00:00Z"),
+	})
+
+	assert.EqualError(t, err, "Failed to restore 1 of 1 files")
+	assert.Equal(t, 0, count)
+}
+
+func TestRestorer_restore_NoMatch(t *testing.T) {
+	r := newRestorer(&mockService{}, &RestoreOptions{Pattern: "/unknown", Target: "target"})
+
+	_, err := r.restore(map[string]*database.RemoteFile{})
+
+	assert.EqualError(t, err, "No backups match /unknown")
+}
+
+func TestRestorer_restore_AsOf(t *testing.T) {
+	asOf := time.Date(2018, 6, 10, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		cached        []*database.Revision
+		remote        []*database.Revision
+		expectedCalls []string
+		expectedCount int
+	}{
+		{"selects cached revision", []*database.Revision{
+			{ID: "rev1", Uploaded: asOf.Add(-48 * time.Hour), ModTime: asOf.Add(-49 * time.Hour), Md5Checksum: helloMd5},
+			{ID: "rev2", Uploaded: asOf.Add(-time.Hour), ModTime: asOf.Add(-2 * time.Hour), Md5Checksum: helloMd5},
+			{ID: "rev3", Uploaded: asOf.Add(time.Hour), ModTime: asOf, Md5Checksum: "other"},
+		}, nil, []string{"downloadRevision file.txt rev2"}, 1},
+		{"selects remote revision", nil, []*database.Revision{
+			{ID: "rev1", Uploaded: asOf.Add(-2 * time.Hour), Md5Checksum: helloMd5},
+			{ID: "rev2", Uploaded: asOf.Add(time.Hour), Md5Checksum: "other"},
+		}, []string{"revisions file.txt", "downloadRevision file.txt rev1"}, 1},
+		{"selects remote revision older than cached revisions", []*database.Revision{
+			{ID: "rev2", Uploaded: asOf.Add(time.Hour), ModTime: asOf, Md5Checksum: "other"},
+		}, []*database.Revision{
+			{ID: "rev1", Uploaded: asOf.Add(-2 * time.Hour), Md5Checksum: helloMd5},
+			{ID: "rev2", Uploaded: asOf.Add(time.Hour), Md5Checksum: "other"},
+		}, []string{"revisions file.txt", "downloadRevision file.txt rev1"}, 1},
+		{"skips file uploaded later", nil, []*database.Revision{
+			{ID: "rev1", Uploaded: asOf.Add(time.Hour), Md5Checksum: helloMd5},
+		}, []string{"revisions file.txt"}, 0},
+		{"skips file created later", []*database.Revision{
+			{ID: "rev1", Uploaded: asOf.Add(time.Hour), ModTime: asOf.Add(time.Second), Md5Checksum: helloMd5},
+		}, []*database.Revision{
+			{ID: "rev1", Uploaded: asOf.Add(time.Hour), Md5Checksum: helloMd5},
+		}, []string{"revisions file.txt"}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, _ := ioutil.TempDir("", "restore")
+			defer os.RemoveAll(target)
+			cache := initCache()
+			defer func() {
+				cache.Close()
+				os.Remove(dbPath)
+			}()
+			for _, rev := range test.cached {
+				cache.AddRevision("fileId", rev)
+			}
+			srv := &mockService{
+				content: map[string]string{"rev1": "hello", "rev2": "hello"},
+				revs:    map[string][]*database.Revision{"fileId": test.remote},
+			}
+			r := newRestorer(srv, &RestoreOptions{Pattern: "/file.txt", Target: target, AsOf: asOf})
+			r.backend.cache = cache
+
+			count, err := r.restore(map[string]*database.RemoteFile{
+				"/file.txt": newRestoreFile("file.txt", "fileId", "current", 0644, "2018-06-20T12:00:00Z"),
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectedCount, count)
+			assert.Equal(t, test.expectedCalls, srv.calls)
+			if test.expectedCount > 0 {
+				stat, _ := os.Stat(filepath.Join(target, "file.txt"))
+				assert.Equal(t, asOf.Add(-2*time.Hour), stat.ModTime().UTC())
+			}
+		})
+	}
+}
+
+func TestRestorer_restore_AsOfFolders(t *testing.T) {
+	asOf := time.Date(2018, 6, 10, 0, 0, 0, 0, time.UTC)
+	target, _ := ioutil.TempDir("", "restore")
+	defer os.RemoveAll(target)
+	srv := &mockService{}
+	r := newRestorer(srv, &RestoreOptions{Pattern: "/Backups", Target: target, AsOf: asOf})
+	older := newCacheFile("older", "olderId", "")
+	older.MimeType = defaultFolderMimeType
+	older.Created = addrOfTime(asOf.Add(-time.Hour))
+	newer := newCacheFile("newer", "newerId", "")
+	newer.MimeType = defaultFolderMimeType
+	newer.Created = addrOfTime(asOf.Add(time.Hour))
+
+	count, err := r.restore(map[string]*database.RemoteFile{
+		"/Backups/me/older": older,
+		"/Backups/me/newer": newer,
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	_, err = os.Stat(filepath.Join(target, "Backups", "me", "older"))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(target, "Backups", "me", "newer"))
+	assert.True(t, os.IsNotExist(err), "folder created later should not be restored")
+}
+
+func TestRestorer_findFiles_AsOf(t *testing.T) {
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.Save(newCacheFile("current.txt", "currentId", ""))
+	cache.Save(newCacheFile("replaced.txt", "oldId", ""))
+	cache.Save(newCacheFile("deleted.txt", "deletedId", ""))
+	cache.Trash("oldId", time.Date(2018, 6, 15, 0, 0, 0, 0, time.UTC))
+	cache.Trash("deletedId", time.Date(2018, 6, 5, 0, 0, 0, 0, time.UTC))
+	cache.Save(newCacheFile("replaced.txt", "newId", ""))
+	r := newRestorer(&mockService{}, &RestoreOptions{Pattern: "/*.txt", AsOf: time.Date(2018, 6, 10, 0, 0, 0, 0, time.UTC)})
+	r.backend.cache = cache
+
+	files := r.findFiles()
+
+	assert.Equal(t, 2, len(files))
+	assert.Equal(t, "currentId", *files["/current.txt"].RemoteID)
+	assert.Equal(t, "oldId", *files["/replaced.txt"].RemoteID)
+}
+
+func TestRestorer_restore_Symlink(t *testing.T) {
+	target, _ := ioutil.TempDir("", "restore")
+	defer os.RemoveAll(target)
+	srv := &mockService{}
+	r := newRestorer(srv, &RestoreOptions{Pattern: "/link", Target: target})
+	rf := newRestoreFile("link", "linkId", "", 0777, "2018-06-01T12:00:00Z")
+	rf.LinkTarget = addrOf("dir/file.txt")
+	localPath := filepath.Join(target, "link")
+	ioutil.WriteFile(localPath, []byte("existing"), 0644)
+
+	count, err := r.restore(map[string]*database.RemoteFile{"/link": rf})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	linkTarget, _ := os.Readlink(localPath)
+	assert.Equal(t, "dir/file.txt", linkTarget)
+	assert.Empty(t, srv.calls)
+}
+
+func TestRestorer_restore_HardLink(t *testing.T) {
+	target, _ := ioutil.TempDir("", "restore")
+	defer os.RemoveAll(target)
+	srv := &mockService{content: map[string]string{"fileId": "hello"}}
+	r := newRestorer(srv, &RestoreOptions{Pattern: "/*", Target: target})
+	link := newRestoreFile("a-link.txt", "linkId", "", 0644, "2018-06-01T12:00:00Z")
+	link.TargetID = addrOf("fileId")
+
+	count, err := r.restore(map[string]*database.RemoteFile{
+		"/a-link.txt": link,
+		"/file.txt":   newRestoreFile("file.txt", "fileId", helloMd5, 0644, "2018-06-01T12:00:00Z"),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	fileInfo, _ := os.Stat(filepath.Join(target, "file.txt"))
+	linkInfo, _ := os.Stat(filepath.Join(target, "a-link.txt"))
+	assert.True(t, os.SameFile(fileInfo, linkInfo), "should restore hard link")
+	assert.Equal(t, []string{"download file.txt"}, srv.calls)
+}
+
+func TestRestorer_restore_Attributes(t *testing.T) {
+	target, _ := ioutil.TempDir("", "restore")
+	defer os.RemoveAll(target)
+	srv := &mockService{content: map[string]string{"fileId": "hello"}}
+	r := newRestorer(srv, &RestoreOptions{Pattern: "/file.txt", Target: target})
+	rf := newRestoreFile("file.txt", "fileId", helloMd5, 04755, "2018-06-01T12:00:00Z")
+	accessTime := time.Date(2018, 6, 2, 0, 0, 0, 0, time.UTC)
+	rf.AccessTime = &accessTime
+	rf.Uid = addrOfUint32(uint32(os.Getuid()))
+	rf.Gid = addrOfUint32(uint32(os.Getgid()))
+	rf.Xattrs = map[string][]byte{"user.test": []byte("value")}
+
+	count, err := r.restore(map[string]*database.RemoteFile{"/file.txt": rf})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	localFile := filepath.Join(target, "file.txt")
+	info, _ := filesys.Stat(localFile)
+	assert.Equal(t, os.FileMode(0755)|os.ModeSetuid, info.Mode())
+	assert.Equal(t, accessTime, info.AccessTime().UTC())
+	assert.Equal(t, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), info.ModTime().UTC())
+	if skipped, _ := filesys.SetXattrs(localFile, map[string][]byte{"user.probe": nil}); len(skipped) == 0 {
+		xattrs, _ := filesys.GetXattrs(localFile)
+		assert.Equal(t, []byte("value"), xattrs["user.test"])
+	}
+}
@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxFailures is the number of recent failures that are reported for each backend.
+const maxFailures = 10
+
+// Status describes the state of a running daemon.
+type Status struct {
+	Backends []*BackendStatus `json:"backends"`
+	Sources  []*SourceStatus  `json:"sources"`
+}
+
+// BackendStatus describes the activity of a backend.
+type BackendStatus struct {
+	Name     string     `json:"name"`
+	Queued   int        `json:"queued"`
+	InFlight *Operation `json:"inFlight,omitempty"`
+	Failures []*Failure `json:"failures"`
+	DbSize   int64      `json:"dbSize"`
+}
+
+// Operation describes a backup action that is in progress.
+type Operation struct {
+	Action      string    `json:"action"`
+	Path        string    `json:"path"`
+	Started     time.Time `json:"started"`
+	Size        int64     `json:"size"`
+	Transferred int64     `json:"transferred"`
+}
+
+// Failure describes a backup action that failed.
+type Failure struct {
+	Action string    `json:"action"`
+	Path   string    `json:"path"`
+	Time   time.Time `json:"time"`
+	Error  string    `json:"error"`
+}
+
+// SourceStatus describes the state of a source folder.
+type SourceStatus struct {
+	Path       string     `json:"path"`
+	Backend    string     `json:"backend"`
+	Folder     string     `json:"folder"`
+	LastBackup *time.Time `json:"lastBackup,omitempty"`
+	Watched    int        `json:"watched"`
+	Suspended  bool       `json:"suspended,omitempty"`
+}
+
+// GetStatus returns the state of the destinations and their backends.
+func GetStatus(dests []*Destination) *Status {
+	status := &Status{Backends: []*BackendStatus{}, Sources: make([]*SourceStatus, 0, len(dests))}
+	included := make(map[*backend]bool)
+	for _, d := range dests {
+		if d.backend != nil && !included[d.backend] {
+			included[d.backend] = true
+			status.Backends = append(status.Backends, d.backend.status())
+		}
+		status.Sources = append(status.Sources, d.status())
+	}
+	return status
+}
+
+// backendState records the activity of a backend for status reporting.
+type backendState struct {
+	mutex       sync.Mutex
+	current     *Operation
+	transferred int64 // bytes read by the current attempt, updated atomically
+	failures    []*Failure
+}
+
+// start records the beginning of an action.
+func (s *backendState) start(m *Message) {
+	op := &Operation{Action: m.action.String(), Path: *m.local, Started: time.Now()}
+	if m.action != TrashAction {
+		if info, err := os.Stat(*m.local); err == nil {
+			op.Size = info.Size()
+		}
+	}
+	s.mutex.Lock()
+	s.current = op
+	s.mutex.Unlock()
+}
+
+// finish records the result of the current action.  Only the most recent failures are kept.
+func (s *backendState) finish(m *Message, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.current = nil
+	if err != nil {
+		if m.dest != nil {
+			m.dest.actionFailed()
+		}
+		failure := &Failure{Action: m.action.String(), Path: *m.local, Time: time.Now(), Error: err.Error()}
+		s.failures = append(s.failures, failure)
+		if len(s.failures) > maxFailures {
+			s.failures = s.failures[len(s.failures)-maxFailures:]
+		}
+	} else if m.dest != nil {
+		m.dest.backedUp(time.Now())
+	}
+}
+
+// abort clears the current action without recording a result.  Used when the action is interrupted and requeued.
+func (s *backendState) abort() {
+	s.mutex.Lock()
+	s.current = nil
+	s.mutex.Unlock()
+}
+
+// status returns the state of the backend.
+func (b *backend) status() *BackendStatus {
+	status := &BackendStatus{Name: b.name, Queued: b.queue.Len()}
+	if b.cache != nil {
+		status.DbSize, _ = b.cache.Size()
+	}
+	b.state.mutex.Lock()
+	defer b.state.mutex.Unlock()
+	if b.state.current != nil {
+		op := *b.state.current
+		op.Transferred = atomic.LoadInt64(&b.state.transferred)
+		status.InFlight = &op
+	}
+	status.Failures = make([]*Failure, len(b.state.failures))
+	copy(status.Failures, b.state.failures)
+	return status
+}
+
+// progressReader counts the bytes read from a file.
+type progressReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetStatus(t *testing.T) {
+	localFile := filepath.Join("testdata", "to_be_backed_up.txt")
+	b := &backend{name: "backend", queue: NewQueue()}
+	b.queue.Add(newMessage(localFile, "/file.txt", StoreAction))
+	d1 := newDestination(b, addrOf("/source1"), addrOf("Backups/one"), false)
+	d2 := newDestination(b, addrOf("/source2"), addrOf("Backups/two"), false)
+	d1.WatchAdded()
+	d1.WatchAdded()
+	backedUp := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	d2.backedUp(backedUp)
+	b.state.start(newMessage(localFile, "/file.txt", UpdateAction))
+	b.state.transferred = 5
+
+	status := GetStatus([]*Destination{d1, d2})
+
+	assert.Equal(t, 1, len(status.Backends))
+	assert.Equal(t, "backend", status.Backends[0].Name)
+	assert.Equal(t, 1, status.Backends[0].Queued)
+	assert.Equal(t, "update", status.Backends[0].InFlight.Action)
+	assert.Equal(t, localFile, status.Backends[0].InFlight.Path)
+	assert.Equal(t, int64(5), status.Backends[0].InFlight.Transferred)
+	assert.Equal(t, []*SourceStatus{
+		{Path: "/source1", Backend: "backend", Folder: "/Backups/one", Watched: 2},
+		{Path: "/source2", Backend: "backend", Folder: "/Backups/two", LastBackup: &backedUp},
+	}, status.Sources)
+}
+
+func TestBackendState_finish(t *testing.T) {
+	b := &backend{queue: NewQueue()}
+	d := newDestination(b, addrOf("/source"), addrOf("Backups"), false)
+	for i := 0; i < maxFailures+2; i++ {
+		m := &Message{addrOf(fmt.Sprint("file", i)), addrOf("/file"), TrashAction, d}
+		b.state.start(m)
+		b.state.finish(m, errors.New("failed"))
+	}
+	m := &Message{addrOf("file"), addrOf("/file"), TrashAction, d}
+	b.state.start(m)
+	b.state.finish(m, nil)
+
+	status := b.status()
+
+	assert.Nil(t, status.InFlight)
+	assert.Equal(t, maxFailures, len(status.Failures))
+	assert.Equal(t, "file2", status.Failures[0].Path)
+	assert.Equal(t, "trash", status.Failures[0].Action)
+	assert.Equal(t, "failed", status.Failures[0].Error)
+	assert.False(t, d.lastBackup.IsZero())
+}
+
+func TestFileMetadata_reader(t *testing.T) {
+	var count int64
+	meta := &fileMetadata{progress: &count}
+
+	content, _ := ioutil.ReadAll(meta.reader(strings.NewReader("content")))
+
+	assert.Equal(t, "content", string(content))
+	assert.Equal(t, int64(7), count)
+}
+
+func TestBackend_process_Status(t *testing.T) {
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	b := &backend{queue: NewQueue(), cache: cache, srv: &mockService{err: errors.New("upload failed")}}
+
+	b.process(newMessage(filepath.Join("testdata", "to_be_backed_up.txt"), "/file.txt", StoreAction), nil)
+
+	status := b.status()
+	assert.Nil(t, status.InFlight)
+	assert.Equal(t, 1, len(status.Failures))
+	assert.Equal(t, "upload failed", status.Failures[0].Error)
+}
@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/jonestimd/backupd/internal/config"
+)
+
+// SyncOptions specifies the sources to back up.
+type SyncOptions struct {
+	Source string // path of the source to back up (empty for all sources)
+	Plan   *Plan  // records the remote operations instead of performing them (nil if not a dry run)
+}
+
+// SyncSummary contains the results of a sync.
+type SyncSummary struct {
+	Succeeded  map[Action]int
+	Failed     map[Action]int
+	ScanErrors int // files or directories that could not be read
+}
+
+func newSyncSummary() *SyncSummary {
+	return &SyncSummary{Succeeded: make(map[Action]int), Failed: make(map[Action]int)}
+}
+
+func (s *SyncSummary) add(action Action, err error) {
+	if err != nil {
+		s.Failed[action]++
+	} else {
+		s.Succeeded[action]++
+	}
+}
+
+// Failures returns the number of actions that failed and files that could not be read.
+func (s *SyncSummary) Failures() int {
+	failures := s.ScanErrors
+	for _, count := range s.Failed {
+		failures += count
+	}
+	return failures
+}
+
+// ErrHalted indicates that a sync was interrupted before all of the changes were processed.
+var ErrHalted = errors.New("Sync interrupted")
+
+// Sync backs up the new, modified and deleted files in the sources.  Returns after all of the changes have been
+// processed or halt is closed.
+func Sync(configDir *string, dataDir *string, backupConfig *config.Config, opts *SyncOptions, halt chan bool) (*SyncSummary, error) {
+	sources, err := syncSources(backupConfig.Sources, opts.Source)
+	if err != nil {
+		return nil, err
+	}
+	backends := make(map[string]*backend)
+	defer func() {
+		for _, b := range backends {
+			b.cache.Close()
+		}
+	}()
+	for _, s := range sources {
+		name := *s.Destination.Backend
+		if backends[name] == nil {
+			if backends[name], err = openBackend(configDir, dataDir, backupConfig, name); err != nil {
+				delete(backends, name)
+				return nil, err
+			}
+			backends[name].plan = opts.Plan
+		}
+	}
+	return syncDestinations(newDestinations(sources, backupConfig.Watch, backends), halt)
+}
+
+// syncSources returns the sources to back up.
+func syncSources(sources []*config.Source, path string) ([]*config.Source, error) {
+	if path == "" {
+		return sources, nil
+	}
+	for _, s := range sources {
+		if *s.Path == path {
+			return []*config.Source{s}, nil
+		}
+	}
+	return nil, errors.New("Source not configured: " + path)
+}
+
+// syncDestinations queues the changes to the destinations and processes the queues of their backends.
+func syncDestinations(dests []*Destination, halt chan bool) (*SyncSummary, error) {
+	summary := newSyncSummary()
+	backends := make(map[string]*backend)
+	for _, d := range dests {
+		summary.ScanErrors += d.Scan()
+		d.QueueDeleted()
+		backends[d.backend.name] = d.backend
+	}
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !backends[name].drain(summary, halt) {
+			return summary, ErrHalted
+		}
+	}
+	return summary, nil
+}
+
+// drain processes the queued messages until the queue is empty.  Returns false if halted.
+func (b *backend) drain(summary *SyncSummary, halt chan bool) bool {
+	for m := b.queue.TryGet(); m != nil; m = b.queue.TryGet() {
+		select {
+		case <-halt:
+			b.queue.Requeue(m)
+			return false
+		default:
+		}
+		if !b.waitForQuota(m, halt) {
+			b.queue.Requeue(m)
+			return false
+		}
+		err := b.process(m, halt)
+		if err == errHalted {
+			b.queue.Requeue(m)
+			return false
+		}
+		summary.add(m.action, err)
+	}
+	b.drained()
+	return true
+}
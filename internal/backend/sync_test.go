@@ -0,0 +1,135 @@
+package backend
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/jonestimd/backupd/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncSources(t *testing.T) {
+	sources := configuration("backend", "/source1", "Backups").Sources
+	sources = append(sources, configuration("backend", "/source2", "Backups").Sources...)
+	tests := []struct {
+		name          string
+		path          string
+		expected      []*config.Source
+		expectedError string
+	}{
+		{"all sources", "", sources, ""},
+		{"selected source", "/source2", sources[1:], ""},
+		{"unknown source", "/unknown", nil, "Source not configured: /unknown"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := syncSources(sources, test.path)
+
+			assert.Equal(t, test.expected, actual)
+			if test.expectedError == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+			}
+		})
+	}
+}
+
+func TestSyncDestinations(t *testing.T) {
+	source, _ := ioutil.TempDir("", "sync")
+	defer os.RemoveAll(source)
+	os.MkdirAll(filepath.Join(source, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(source, "new.txt"), []byte("new"), 0644)
+	ioutil.WriteFile(filepath.Join(source, "dir", "other.txt"), []byte("other"), 0644)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	cache.Save(newCacheFile("deleted.txt", "deletedId", "backupsId"))
+	srv := &mockService{}
+	b := &backend{name: "backend", queue: NewQueue(), cache: cache, srv: srv}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+
+	summary, err := syncDestinations([]*Destination{d}, make(chan bool))
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[Action]int{StoreAction: 2, TrashAction: 1}, summary.Succeeded)
+	assert.Equal(t, 0, summary.Failures())
+	sort.Strings(srv.calls)
+	assert.Equal(t, []string{"createFolder dir", "store new.txt", "store other.txt", "trash deleted.txt"}, srv.calls)
+	assert.Equal(t, 0, b.queue.Len())
+}
+
+func TestSyncDestinations_Symlinks(t *testing.T) {
+	tests := []struct {
+		symlinks string
+		expected []string
+	}{
+		{config.SkipSymlinks, []string{"store real.txt"}},
+		{config.FollowSymlinks, []string{"store link.txt", "store real.txt"}},
+		{config.PreserveSymlinks, []string{"store link.txt", "store real.txt"}},
+	}
+	for _, test := range tests {
+		t.Run(test.symlinks, func(t *testing.T) {
+			source, _ := ioutil.TempDir("", "sync")
+			defer os.RemoveAll(source)
+			ioutil.WriteFile(filepath.Join(source, "real.txt"), []byte("real"), 0644)
+			ioutil.WriteFile(filepath.Join(source, "real.tmp"), []byte("tmp"), 0644)
+			os.Symlink("real.txt", filepath.Join(source, "link.txt"))
+			cache := initCache()
+			defer func() {
+				cache.Close()
+				os.Remove(dbPath)
+			}()
+			cache.Save(newCacheFile("Backups", "backupsId", ""))
+			srv := &mockService{}
+			cfg := configuration("backend", source, "Backups")
+			cfg.Sources[0].Symlinks = test.symlinks
+			cfg.Sources[0].Exclude = []string{"*.tmp"}
+			backends := map[string]*backend{"backend": {name: "backend", queue: NewQueue(), cache: cache, srv: srv}}
+
+			summary, err := syncDestinations(newDestinations(cfg.Sources, cfg.Watch, backends), make(chan bool))
+
+			assert.Nil(t, err)
+			assert.Equal(t, 0, summary.Failures())
+			sort.Strings(srv.calls)
+			assert.Equal(t, test.expected, srv.calls)
+		})
+	}
+}
+
+func TestSyncDestinations_Failure(t *testing.T) {
+	source, _ := ioutil.TempDir("", "sync")
+	defer os.RemoveAll(source)
+	ioutil.WriteFile(filepath.Join(source, "new.txt"), []byte("new"), 0644)
+	cache := initCache()
+	defer func() {
+		cache.Close()
+		os.Remove(dbPath)
+	}()
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	b := &backend{name: "backend", queue: NewQueue(), cache: cache, srv: &mockService{err: errors.New("failed")}}
+	d := newDestination(b, &source, addrOf("Backups"), false)
+
+	summary, err := syncDestinations([]*Destination{d}, make(chan bool))
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[Action]int{StoreAction: 1}, summary.Failed)
+	assert.Equal(t, 1, summary.Failures())
+}
+
+func TestBackend_drain_Halted(t *testing.T) {
+	b := &backend{queue: NewQueue(), srv: &mockService{}}
+	b.queue.Add(newMessage("local", "/remote", TrashAction))
+	halt := make(chan bool)
+	close(halt)
+
+	assert.False(t, b.drain(newSyncSummary(), halt))
+	assert.Equal(t, 1, b.queue.Len(), "Expected the message to be requeued")
+}
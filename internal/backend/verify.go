@@ -0,0 +1,310 @@
+package backend
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/config"
+	"github.com/jonestimd/backupd/internal/database"
+	"github.com/jonestimd/backupd/internal/filesys"
+)
+
+// Kinds of problems found by Verify.
+const (
+	MissingProblem   = "missing"   // local file has not been backed up
+	StaleProblem     = "stale"     // local file has changed since it was backed up
+	ExtraProblem     = "extra"     // backup of a file that no longer exists locally
+	UncachedProblem  = "uncached"  // remote file is not in the cache
+	NotRemoteProblem = "notRemote" // cached file does not exist remotely
+	ChecksumProblem  = "checksum"  // cached checksum does not match the remote file
+	ContentProblem   = "content"   // downloaded content does not match the recorded checksum
+)
+
+// VerifyOptions specifies the checks to perform.
+type VerifyOptions struct {
+	Source string  // path of the source to verify (empty for all sources)
+	Remote bool    // compare the cache with a new listing of the remote files
+	Sample float64 // percentage of the backed up files to download and check
+	Fix    bool    // queue the actions to correct the problems
+}
+
+// Problem describes a difference between a source, the cache and the remote files.
+type Problem struct {
+	Kind       string
+	LocalPath  string
+	RemotePath string
+	Detail     string
+}
+
+// VerifyReport contains the results of Verify.
+type VerifyReport struct {
+	Problems []*Problem
+	Checked  int          // number of local files that were checked
+	Sampled  int          // number of files that were downloaded
+	Fixed    *SyncSummary // results of the corrective actions (nil if not fixing)
+}
+
+// Verify compares the sources with the cache and, optionally, the remote files.
+func Verify(configDir *string, dataDir *string, backupConfig *config.Config, opts *VerifyOptions, halt chan bool) (*VerifyReport, error) {
+	sources, err := syncSources(backupConfig.Sources, opts.Source)
+	if err != nil {
+		return nil, err
+	}
+	backends := make(map[string]*backend)
+	defer func() {
+		for _, b := range backends {
+			b.cache.Close()
+		}
+	}()
+	for _, s := range sources {
+		name := *s.Destination.Backend
+		if backends[name] == nil {
+			if backends[name], err = openBackend(configDir, dataDir, backupConfig, name); err != nil {
+				delete(backends, name)
+				return nil, err
+			}
+		}
+	}
+	v := &verifier{opts: opts, report: &VerifyReport{}, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	return v.verify(newDestinations(sources, backupConfig.Watch, backends), halt)
+}
+
+// verifier collects the problems found by Verify.
+type verifier struct {
+	opts   *VerifyOptions
+	report *VerifyReport
+	random *rand.Rand
+	mutex  sync.Mutex // guards report while the source folders are walked
+}
+
+func (v *verifier) verify(dests []*Destination, halt chan bool) (*VerifyReport, error) {
+	for _, d := range dests {
+		v.verifyLocal(d)
+		v.verifyDeleted(d)
+	}
+	if v.opts.Remote {
+		for _, b := range destinationBackends(dests) {
+			if err := v.verifyRemote(b, dests); err != nil {
+				return v.report, err
+			}
+		}
+	}
+	if v.opts.Sample > 0 {
+		for _, d := range dests {
+			v.verifySample(d)
+		}
+	}
+	sort.SliceStable(v.report.Problems, func(i, j int) bool {
+		return v.report.Problems[i].RemotePath < v.report.Problems[j].RemotePath
+	})
+	if v.opts.Fix {
+		v.report.Fixed = newSyncSummary()
+		for _, b := range destinationBackends(dests) {
+			if !b.drain(v.report.Fixed, halt) {
+				return v.report, ErrHalted
+			}
+		}
+	}
+	return v.report, nil
+}
+
+// destinationBackends returns the backends of the destinations ordered by name.
+func destinationBackends(dests []*Destination) []*backend {
+	included := make(map[*backend]bool)
+	backends := make([]*backend, 0, len(dests))
+	for _, d := range dests {
+		if !included[d.backend] {
+			included[d.backend] = true
+			backends = append(backends, d.backend)
+		}
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].name < backends[j].name })
+	return backends
+}
+
+func (v *verifier) add(kind string, localPath string, remotePath string, detail string) {
+	v.mutex.Lock()
+	v.report.Problems = append(v.report.Problems, &Problem{kind, localPath, remotePath, detail})
+	v.mutex.Unlock()
+}
+
+// fix queues an action to correct a problem.
+func (v *verifier) fix(d *Destination, localPath string, remotePath string, action Action) {
+	if v.opts.Fix {
+		d.backend.queue.Add(&Message{&localPath, &remotePath, action, d})
+	}
+}
+
+// verifyLocal compares the files in the source folder with the cache.  Excluded files and symbolic links are handled
+// like the scans of the source folder.
+func (v *verifier) verifyLocal(d *Destination) {
+	preserveLinks := d.symlinks == config.PreserveSymlinks
+	filesys.Walk(*d.LocalRoot, d.walkOptions(), func(localPath string, typ os.FileMode, err error) {
+		if err != nil {
+			log.Printf("Error walking %s: %v\n", localPath, err)
+			return
+		}
+		if !typ.IsRegular() && !(preserveLinks && typ&os.ModeSymlink != 0) {
+			return
+		}
+		v.mutex.Lock()
+		v.report.Checked++
+		v.mutex.Unlock()
+		remotePath := d.RemotePath(localPath)
+		if rf := d.backend.cache.FindByPath(remotePath); rf == nil {
+			v.add(MissingProblem, localPath, remotePath, "")
+			v.fix(d, localPath, remotePath, StoreAction)
+		} else if target, ok := d.linkTarget(localPath); ok {
+			if rf.LinkTarget == nil || *rf.LinkTarget != target {
+				v.add(StaleProblem, localPath, remotePath, "link target changed")
+				v.fix(d, localPath, remotePath, UpdateAction)
+			}
+		} else if info, err := os.Stat(localPath); err != nil {
+			log.Printf("Error getting status of %s: %v\n", localPath, err)
+		} else if reason := d.backend.changeReason(localPath, info, rf); reason != "" {
+			v.add(StaleProblem, localPath, remotePath, reason)
+			v.fix(d, localPath, remotePath, UpdateAction)
+		}
+	})
+}
+
+// verifyDeleted looks for backups of files that no longer exist locally.
+func (v *verifier) verifyDeleted(d *Destination) {
+	for _, remotePath := range d.deletedFiles() {
+		localPath := d.LocalPath(remotePath)
+		v.add(ExtraProblem, localPath, remotePath, "")
+		v.fix(d, localPath, remotePath, TrashAction)
+	}
+}
+
+// verifyRemote compares the cache with a new listing of the remote files.  Problems are only reported for the
+// destination folders.
+func (v *verifier) verifyRemote(b *backend, dests []*Destination) error {
+	remoteFiles, err := listRemote(b.srv)
+	if err != nil {
+		return err
+	}
+	for _, d := range dests {
+		if d.backend != b {
+			continue
+		}
+		root := d.remoteRootPath()
+		cached := b.cache.FindByPrefix(root)
+		for remotePath, rf := range remoteFiles {
+			if !isDescendant(root, remotePath) || b.srv.isFolder(rf) {
+				continue
+			}
+			localPath := d.LocalPath(remotePath)
+			if cachedFile := cached[remotePath]; cachedFile == nil || *cachedFile.RemoteID != *rf.RemoteID {
+				v.add(UncachedProblem, localPath, remotePath, "")
+				v.saveRemote(b, rf)
+			} else if checksum(cachedFile) != checksum(rf) {
+				v.add(ChecksumProblem, localPath, remotePath, "cached "+checksum(cachedFile)+", remote "+checksum(rf))
+				v.saveRemote(b, rf)
+			}
+		}
+		for remotePath, rf := range cached {
+			if _, ok := remoteFiles[remotePath]; !ok && !b.srv.isFolder(rf) {
+				localPath := d.LocalPath(remotePath)
+				v.add(NotRemoteProblem, localPath, remotePath, "")
+				if _, err := os.Stat(localPath); err == nil {
+					v.fix(d, localPath, remotePath, StoreAction)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// saveRemote updates the cache with a remote file's record.
+func (v *verifier) saveRemote(b *backend, rf *database.RemoteFile) {
+	if v.opts.Fix {
+		if err := b.cache.Save(rf); err != nil {
+			log.Printf("Error updating cache for %s: %v\n", rf.Name, err)
+		}
+	}
+}
+
+// verifySample downloads a random selection of the backed up files and verifies their checksums.
+func (v *verifier) verifySample(d *Destination) {
+	var paths []string
+	files := d.backend.cache.FindByPrefix(d.remoteRootPath())
+	for remotePath, rf := range files {
+		if !d.backend.srv.isFolder(rf) && checksum(rf) != "" {
+			paths = append(paths, remotePath)
+		}
+	}
+	sort.Strings(paths)
+	count := int(float64(len(paths))*v.opts.Sample/100 + 0.5)
+	if count > len(paths) {
+		count = len(paths)
+	}
+	for _, i := range v.random.Perm(len(paths))[:count] {
+		remotePath := paths[i]
+		rf := files[remotePath]
+		localPath := d.LocalPath(remotePath)
+		hash := md5.New()
+		v.report.Sampled++
+		if err := d.backend.srv.download(rf, hash); err != nil {
+			v.add(ContentProblem, localPath, remotePath, err.Error())
+		} else if actual := hex.EncodeToString(hash.Sum(nil)); actual != checksum(rf) {
+			v.add(ContentProblem, localPath, remotePath, "expected "+checksum(rf)+", got "+actual)
+			if _, err := os.Stat(localPath); err == nil {
+				v.fix(d, localPath, remotePath, UpdateAction)
+			}
+		}
+	}
+}
+
+// listRemote gets the remote files from the backend.  Returns the files by path.
+func listRemote(srv backupService) (map[string]*database.RemoteFile, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fileCh, err := srv.loadFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*database.RemoteFile)
+	for f := range fileCh {
+		if f.Error != nil {
+			return nil, f.Error
+		}
+		byID[*f.File.RemoteID] = f.File
+	}
+	byPath := make(map[string]*database.RemoteFile, len(byID))
+	for _, rf := range byID {
+		byPath[listedPath(byID, rf)] = rf
+	}
+	return byPath, nil
+}
+
+// listedPath returns the path of a listed file.  A file whose parent was not listed is in the root folder.
+func listedPath(byID map[string]*database.RemoteFile, rf *database.RemoteFile) string {
+	names := []string{rf.Name}
+	for len(rf.ParentIDs) > 0 && byID[rf.ParentIDs[0]] != nil {
+		rf = byID[rf.ParentIDs[0]]
+		names = append([]string{rf.Name}, names...)
+	}
+	return string(filepath.Separator) + filepath.Join(names...)
+}
+
+// isDescendant returns true if path is in the folder.
+func isDescendant(folder string, path string) bool {
+	return strings.HasPrefix(path, folder+string(filepath.Separator))
+}
+
+func checksum(rf *database.RemoteFile) string {
+	if rf.Md5Checksum == nil {
+		return ""
+	}
+	return *rf.Md5Checksum
+}
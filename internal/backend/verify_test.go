@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jonestimd/backupd/internal/database"
+	"github.com/stretchr/testify/assert"
+)
+
+type verifyFixture struct {
+	source string
+	cache  *database.BoltDao
+	srv    *mockService
+	dest   *Destination
+}
+
+func newVerifyFixture() *verifyFixture {
+	source, _ := ioutil.TempDir("", "verify")
+	cache := initCache()
+	cache.Save(newCacheFile("Backups", "backupsId", ""))
+	srv := &mockService{}
+	b := &backend{name: "backend", queue: NewQueue(), cache: cache, srv: srv}
+	return &verifyFixture{source, cache, srv, newDestination(b, &source, addrOf("Backups"), false)}
+}
+
+func (f *verifyFixture) close() {
+	f.cache.Close()
+	os.Remove(dbPath)
+	os.RemoveAll(f.source)
+}
+
+// addFile creates a local file and, if remoteID is not empty, its cache record.
+func (f *verifyFixture) addFile(name string, content string, remoteID string, size uint64) {
+	localPath := filepath.Join(f.source, name)
+	ioutil.WriteFile(localPath, []byte(content), 0644)
+	if remoteID != "" {
+		stat, _ := os.Stat(localPath)
+		f.cache.Save(newVerifyFile(name, remoteID, size, stat.ModTime(), ""))
+	}
+}
+
+func newVerifyFile(name string, remoteID string, size uint64, modTime time.Time, md5Checksum string) *database.RemoteFile {
+	rf := newCacheFile(name, remoteID, "backupsId")
+	rf.Size = size
+	rf.ModTime = modTime
+	rf.Md5Checksum = &md5Checksum
+	return rf
+}
+
+func problemKinds(report *VerifyReport) []string {
+	kinds := make([]string, len(report.Problems))
+	for i, p := range report.Problems {
+		kinds[i] = p.Kind + " " + p.RemotePath
+	}
+	return kinds
+}
+
+func TestVerifier_verify_Local(t *testing.T) {
+	f := newVerifyFixture()
+	defer f.close()
+	f.addFile("new.txt", "new", "", 0)
+	f.addFile("changed.txt", "changed", "changedId", 3)
+	f.addFile("same.txt", "same", "sameId", 4)
+	f.cache.Save(newVerifyFile("deleted.txt", "deletedId", 1, time.Now(), ""))
+	v := &verifier{opts: &VerifyOptions{Fix: true}, report: &VerifyReport{}}
+
+	report, err := v.verify([]*Destination{f.dest}, make(chan bool))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Checked)
+	assert.Equal(t, []string{"stale /Backups/changed.txt", "extra /Backups/deleted.txt", "missing /Backups/new.txt"},
+		problemKinds(report))
+	assert.Equal(t, map[Action]int{StoreAction: 1, UpdateAction: 1, TrashAction: 1}, report.Fixed.Succeeded)
+	sort.Strings(f.srv.calls)
+	assert.Equal(t, []string{"store new.txt", "trash deleted.txt", "update changed.txt"}, f.srv.calls)
+}
+
+func TestVerifier_verify_StaleDetail(t *testing.T) {
+	f := newVerifyFixture()
+	defer f.close()
+	f.addFile("size.txt", "size", "sizeId", 3)
+	f.addFile("content.txt", "a", "", 0)
+	f.cache.Save(newVerifyFile("content.txt", "contentId", 1, time.Now(), "other"))
+	f.addFile("time.txt", "time", "", 0)
+	f.cache.Save(newVerifyFile("time.txt", "timeId", 4, time.Now().Add(-time.Hour), ""))
+	v := &verifier{opts: &VerifyOptions{}, report: &VerifyReport{}}
+
+	report, err := v.verify([]*Destination{f.dest}, make(chan bool))
+
+	assert.Nil(t, err)
+	details := make(map[string]string)
+	for _, p := range report.Problems {
+		details[p.Kind+" "+p.RemotePath] = p.Detail
+	}
+	assert.Equal(t, map[string]string{
+		"stale /Backups/size.txt":    "size changed",
+		"stale /Backups/content.txt": "checksum changed",
+		"stale /Backups/time.txt":    "modification time changed",
+	}, details)
+}
+
+func TestVerifier_verify_Excluded(t *testing.T) {
+	f := newVerifyFixture()
+	defer f.close()
+	f.dest.exclude = []string{"*.tmp", "cache"}
+	f.addFile("new.tmp", "new", "", 0)
+	os.Mkdir(filepath.Join(f.source, "cache"), 0755)
+	f.addFile(filepath.Join("cache", "new.txt"), "new", "", 0)
+	f.addFile("same.txt", "same", "sameId", 4)
+	v := &verifier{opts: &VerifyOptions{Fix: true}, report: &VerifyReport{}}
+
+	report, err := v.verify([]*Destination{f.dest}, make(chan bool))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Checked)
+	assert.Empty(t, report.Problems)
+	assert.Empty(t, f.srv.calls)
+}
+
+const aMd5 = "0cc175b9c0f1b6a831c399e269772661" // MD5 of "a"
+
+func TestVerifier_verify_Remote(t *testing.T) {
+	f := newVerifyFixture()
+	defer f.close()
+	modTime := time.Now()
+	f.addFile("a.txt", "a", "aId", 1)
+	f.cache.Save(newVerifyFile("a.txt", "aId", 1, modTime, aMd5))
+	f.addFile("b.txt", "b", "bId", 1)
+	folder := newCacheFile("Backups", "backupsId", "")
+	folder.MimeType = defaultFolderMimeType
+	f.srv.remote = []*database.RemoteFile{
+		folder,
+		newVerifyFile("a.txt", "aId", 1, modTime, "remote"),
+		newVerifyFile("c.txt", "cId", 1, modTime, ""),
+		newCacheFile("other.txt", "otherId", ""),
+	}
+	v := &verifier{opts: &VerifyOptions{Remote: true}, report: &VerifyReport{}}
+
+	report, err := v.verify([]*Destination{f.dest}, make(chan bool))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"checksum /Backups/a.txt", "notRemote /Backups/b.txt", "uncached /Backups/c.txt"},
+		problemKinds(report))
+	assert.Equal(t, "cached "+aMd5+", remote remote", report.Problems[0].Detail)
+	assert.Nil(t, report.Fixed)
+	assert.Empty(t, f.srv.calls)
+}
+
+func TestVerifier_verify_RemoteFix(t *testing.T) {
+	f := newVerifyFixture()
+	defer f.close()
+	modTime := time.Now()
+	f.addFile("b.txt", "b", "bId", 1)
+	f.srv.remote = []*database.RemoteFile{newCacheFile("Backups", "backupsId", ""), newVerifyFile("c.txt", "cId", 1, modTime, "")}
+	v := &verifier{opts: &VerifyOptions{Remote: true, Fix: true}, report: &VerifyReport{}}
+
+	_, err := v.verify([]*Destination{f.dest}, make(chan bool))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "cId", *f.cache.FindByPath("/Backups/c.txt").RemoteID)
+	assert.Equal(t, []string{"store b.txt"}, f.srv.calls)
+}
+
+func TestVerifier_verify_Sample(t *testing.T) {
+	f := newVerifyFixture()
+	defer f.close()
+	modTime := time.Now()
+	f.addFile("good.txt", "hello", "", 0)
+	f.addFile("bad.txt", "hello", "", 0)
+	f.cache.Save(newVerifyFile("good.txt", "goodId", 5, modTime, helloMd5))
+	f.cache.Save(newVerifyFile("bad.txt", "badId", 5, modTime, helloMd5))
+	f.srv.content = map[string]string{"goodId": "hello", "badId": "corrupted"}
+	v := &verifier{opts: &VerifyOptions{Sample: 100}, report: &VerifyReport{}, random: rand.New(rand.NewSource(1))}
+
+	report, err := v.verify([]*Destination{f.dest}, make(chan bool))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Sampled)
+	assert.Equal(t, []string{"content /Backups/bad.txt"}, problemKinds(report))
+}
+
+func TestListedPath(t *testing.T) {
+	byID := map[string]*database.RemoteFile{
+		"folderId": newCacheFile("folder", "folderId", "rootId"),
+		"fileId":   newCacheFile("file.txt", "fileId", "folderId"),
+	}
+
+	assert.Equal(t, "/folder/file.txt", listedPath(byID, byID["fileId"]))
+	assert.Equal(t, "/folder", listedPath(byID, byID["folderId"]))
+}
@@ -2,6 +2,9 @@ package config
 
 import (
 	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/go-yaml/yaml"
 	"errors"
@@ -19,17 +22,49 @@ type Backend struct {
 type Destination struct {
 	Backend *string
 	Folder  *string
-	Encrypt bool
+	Encrypt bool // not supported: Parse returns an error if it is set
 }
 
 type Source struct {
-	Path        *string
-	Destination *Destination
+	Path           *string
+	Destination    *Destination
+	RescanInterval string   `yaml:"rescanInterval"` // interval for comparing the folder with its backups, e.g. "24h"
+	Exclude        []string // patterns (see filepath.Match) for the names of files and directories that are not backed up
+	Symlinks       string   // SkipSymlinks (default), FollowSymlinks or PreserveSymlinks
 }
 
+// Symbolic link policies.
+const (
+	SkipSymlinks     = "skip"     // ignore symbolic links
+	FollowSymlinks   = "follow"   // back up the files and directories that links in the source folder point to
+	PreserveSymlinks = "preserve" // back up the links and recreate them on restore
+)
+
+// Metrics configures the Prometheus metrics endpoint.
+type Metrics struct {
+	Listen string // address for the HTTP listener, e.g. ":9100"
+}
+
+// Watch configures the monitoring of the source folders.
+type Watch struct {
+	Budget       int    // maximum number of directories to watch in each source (0 for no limit)
+	PollInterval string `yaml:"pollInterval"` // interval for rescanning directories that are not watched, e.g. "5m"
+	Mode         string // InotifyMode (default) or FanotifyMode
+	RescanRate   int    `yaml:"rescanRate"`  // maximum number of files checked per second by periodic rescans (0 for no limit)
+	ScanWorkers  int    `yaml:"scanWorkers"` // maximum number of directories scanned concurrently (0 for the default)
+}
+
+// Watch modes.
+const (
+	InotifyMode  = "inotify"  // watch each directory using inotify
+	FanotifyMode = "fanotify" // use fanotify when it is available (requires root), otherwise inotify
+)
+
 type Config struct {
 	Backends map[string]*Backend
 	Sources  []*Source
+	Metrics  *Metrics
+	Watch    *Watch
 }
 
 func Parse(filename string) (*Config, error) {
@@ -45,14 +80,82 @@ func Parse(filename string) (*Config, error) {
 		if cfg.Backends[*source.Destination.Backend] == nil {
 			return nil, errors.New("Backend not configured: " + *source.Destination.Backend)
 		}
+		if source.Destination.Encrypt {
+			return nil, errors.New("Encryption is not supported: " + *source.Path)
+		}
+		for _, pattern := range source.Exclude {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, errors.New("Invalid exclude pattern: " + pattern)
+			}
+		}
+		if source.Symlinks != "" && source.Symlinks != SkipSymlinks && source.Symlinks != FollowSymlinks &&
+			source.Symlinks != PreserveSymlinks {
+			return nil, errors.New("Invalid symlinks option: " + source.Symlinks)
+		}
+	}
+	if cfg.Watch != nil && cfg.Watch.Mode != "" && cfg.Watch.Mode != InotifyMode && cfg.Watch.Mode != FanotifyMode {
+		return nil, errors.New("Invalid watch mode: " + cfg.Watch.Mode)
 	}
 	return &cfg, nil
 }
 
+// GetPollInterval returns the interval for rescanning directories that are not watched.  Returns defaultValue if the
+// interval is not configured or an error if it is not a valid duration.
+func (w *Watch) GetPollInterval(defaultValue time.Duration) (time.Duration, error) {
+	if w == nil || w.PollInterval == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(w.PollInterval)
+	if err != nil {
+		return 0, errors.New("Invalid value for pollInterval: " + w.PollInterval)
+	}
+	return d, nil
+}
+
+// GetRescanInterval returns the interval for comparing the source folder with its backups.  Returns 0 if periodic
+// rescans are not configured or an error if the interval is not a valid duration.
+func (s *Source) GetRescanInterval() (time.Duration, error) {
+	if s.RescanInterval == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s.RescanInterval)
+	if err != nil || d < 0 {
+		return 0, errors.New("Invalid value for rescanInterval: " + s.RescanInterval)
+	}
+	return d, nil
+}
+
 func (b *Backend) GetParameter(key string, defaultValue string) string {
 	value := b.Config[key]
 	if value == nil {
 		return defaultValue
 	}
 	return *value
-}
\ No newline at end of file
+}
+
+// GetIntParameter returns the integer value of a config parameter.  Returns an error if the value is not an integer.
+func (b *Backend) GetIntParameter(key string, defaultValue int64) (int64, error) {
+	value := b.Config[key]
+	if value == nil {
+		return defaultValue, nil
+	}
+	n, err := strconv.ParseInt(*value, 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid value for " + key + ": " + *value)
+	}
+	return n, nil
+}
+
+// GetDurationParameter returns the duration value of a config parameter (e.g. "1s").  Returns an error if the value is
+// not a valid duration.
+func (b *Backend) GetDurationParameter(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := b.Config[key]
+	if value == nil {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(*value)
+	if err != nil {
+		return 0, errors.New("Invalid value for " + key + ": " + *value)
+	}
+	return d, nil
+}
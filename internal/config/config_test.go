@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/go-yaml/yaml"
 	"github.com/stretchr/testify/assert"
@@ -26,6 +27,22 @@ func isBadBackend(err error) bool {
 	return err.Error() == "Backend not configured: Google Drive"
 }
 
+func isBadExclude(err error) bool {
+	return err.Error() == "Invalid exclude pattern: [.cache"
+}
+
+func isBadSymlinks(err error) bool {
+	return err.Error() == "Invalid symlinks option: copy"
+}
+
+func isEncrypt(err error) bool {
+	return err.Error() == "Encryption is not supported: /home/me/Documents"
+}
+
+func isBadWatchMode(err error) bool {
+	return err.Error() == "Invalid watch mode: dnotify"
+}
+
 const (
 	backendName = "Google Drive"
 	backendType = "googleDrive"
@@ -33,8 +50,31 @@ const (
 
 func newConfig(backends map[string]*Backend, sourcesPath string, destFolder string, encrypt bool) Config {
 	dest := &Destination{addrOf(backendName), &destFolder, encrypt}
-	source := &Source{&sourcesPath, dest}
-	config := Config{backends, []*Source{source}}
+	source := &Source{Path: &sourcesPath, Destination: dest}
+	config := Config{Backends: backends, Sources: []*Source{source}}
+	return config
+}
+
+func withMetrics(config Config, listen string) Config {
+	config.Metrics = &Metrics{Listen: listen}
+	return config
+}
+
+func withWatch(config Config, budget int, pollInterval string, mode string) Config {
+	config.Watch = &Watch{Budget: budget, PollInterval: pollInterval, Mode: mode}
+	return config
+}
+
+func withScans(config Config, interval string, rate int, workers int, exclude ...string) Config {
+	config.Sources[0].RescanInterval = interval
+	config.Sources[0].Exclude = exclude
+	config.Watch.RescanRate = rate
+	config.Watch.ScanWorkers = workers
+	return config
+}
+
+func withSymlinks(config Config, symlinks string) Config {
+	config.Sources[0].Symlinks = symlinks
 	return config
 }
 
@@ -45,13 +85,18 @@ func TestParse(t *testing.T) {
 		isError  func(error) bool
 	}{
 		{"minimal.yml", newConfig(map[string]*Backend{backendName: {backendType, nil}}, "/home/me/Documents", "Backups/me", false), nil},
-		{"encrypt.yml", newConfig(map[string]*Backend{backendName: {backendType, nil}}, "/home/me/Documents", "Backups/me", true), nil},
 		{"destinationConfig.yml", newConfig(
 			map[string]*Backend{backendName: {backendType, map[string]*string{"clientConfig": addrOf("gd_client_secret.json")}}},
 			"/home/me/Documents", "Backups/me", false), nil},
+		{"metrics.yml", withMetrics(newConfig(map[string]*Backend{backendName: {backendType, nil}}, "/home/me/Documents", "Backups/me", false), ":9100"), nil},
+		{"watch.yml", withSymlinks(withScans(withWatch(newConfig(map[string]*Backend{backendName: {backendType, nil}}, "/home/me/Documents", "Backups/me", false), 1000, "5m", FanotifyMode), "24h", 50, 8, ".cache", "*.tmp"), PreserveSymlinks), nil},
 		{"no file", Config{}, os.IsNotExist},
 		{"invalid.yml", Config{}, isYamlError},
 		{"bad_backend.yml", Config{}, isBadBackend},
+		{"bad_watch_mode.yml", Config{}, isBadWatchMode},
+		{"bad_exclude.yml", Config{}, isBadExclude},
+		{"bad_symlinks.yml", Config{}, isBadSymlinks},
+		{"encrypt.yml", Config{}, isEncrypt},
 	}
 
 	for _, test := range tests {
@@ -67,6 +112,9 @@ func TestParse(t *testing.T) {
 				if !reflect.DeepEqual(actual.Sources, test.expected.Sources) {
 					t.Errorf("Expected\n%#v to equal\n%#v", actual.Sources, test.expected.Sources)
 				}
+				if !reflect.DeepEqual(actual.Metrics, test.expected.Metrics) {
+					t.Errorf("Expected\n%#v to equal\n%#v", actual.Metrics, test.expected.Metrics)
+				}
 			} else if !test.isError(err) {
 				t.Errorf("Not the expected error for \"%s\": %#v", test.file, err)
 			}
@@ -95,3 +143,113 @@ func TestGetParameter(t *testing.T) {
 		})
 	}
 }
+
+func TestGetIntParameter(t *testing.T) {
+	parameter := "the parameter"
+	tests := []struct {
+		name          string
+		expectedValue int64
+		expectedError string
+		backend       *Backend
+	}{
+		{"returns default", 10, "", &Backend{Config: map[string]*string{}}},
+		{"returns config value", 123, "", &Backend{Config: map[string]*string{parameter: addrOf("123")}}},
+		{"returns error", 0, "Invalid value for the parameter: abc", &Backend{Config: map[string]*string{parameter: addrOf("abc")}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := test.backend.GetIntParameter(parameter, 10)
+
+			assert.Equal(t, test.expectedValue, actual)
+			if test.expectedError == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+			}
+		})
+	}
+}
+
+func TestGetDurationParameter(t *testing.T) {
+	parameter := "the parameter"
+	tests := []struct {
+		name          string
+		expectedValue time.Duration
+		expectedError string
+		backend       *Backend
+	}{
+		{"returns default", time.Second, "", &Backend{Config: map[string]*string{}}},
+		{"returns config value", 2 * time.Millisecond, "", &Backend{Config: map[string]*string{parameter: addrOf("2ms")}}},
+		{"returns error", 0, "Invalid value for the parameter: abc", &Backend{Config: map[string]*string{parameter: addrOf("abc")}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := test.backend.GetDurationParameter(parameter, time.Second)
+
+			assert.Equal(t, test.expectedValue, actual)
+			if test.expectedError == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+			}
+		})
+	}
+}
+
+func TestWatch_GetPollInterval(t *testing.T) {
+	tests := []struct {
+		name          string
+		watch         *Watch
+		expectedValue time.Duration
+		expectedError string
+	}{
+		{"not configured", nil, time.Minute, ""},
+		{"no interval", &Watch{Budget: 10}, time.Minute, ""},
+		{"returns config value", &Watch{PollInterval: "5m"}, 5 * time.Minute, ""},
+		{"returns error", &Watch{PollInterval: "abc"}, 0, "Invalid value for pollInterval: abc"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := test.watch.GetPollInterval(time.Minute)
+
+			assert.Equal(t, test.expectedValue, actual)
+			if test.expectedError == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+			}
+		})
+	}
+}
+
+func TestSource_GetRescanInterval(t *testing.T) {
+	tests := []struct {
+		name          string
+		interval      string
+		expectedValue time.Duration
+		expectedError string
+	}{
+		{"not configured", "", 0, ""},
+		{"returns config value", "24h", 24 * time.Hour, ""},
+		{"returns error", "abc", 0, "Invalid value for rescanInterval: abc"},
+		{"rejects negative interval", "-1h", 0, "Invalid value for rescanInterval: -1h"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := &Source{RescanInterval: test.interval}
+
+			actual, err := source.GetRescanInterval()
+
+			assert.Equal(t, test.expectedValue, actual)
+			if test.expectedError == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+			}
+		})
+	}
+}
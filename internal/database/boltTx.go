@@ -1,23 +1,28 @@
 package database
 
 import (
+	"log"
 	"path/filepath"
+	"time"
 )
 
 type bucket interface {
 	Get(id []byte) []byte
 	Put(id []byte, value []byte) error
+	Delete(id []byte) error
 	ForEach(func(key []byte, value []byte) error) error
 }
 
 type boltTx struct {
 	byRemoteID   bucket
 	byRemotePath bucket
+	trashed      bucket
 }
 
 func (tx *boltTx) insertFile(remoteId string, name string, mimeType string, size uint64, md5checksum *string,
-	parentIds []string, lastModified string, localId *string) error {
-	rf := RemoteFile{name, mimeType, size, md5checksum, parentIds, &lastModified, localId, &remoteId}
+	parentIds []string, modTime time.Time, localId *string) error {
+	rf := RemoteFile{Name: name, MimeType: mimeType, Size: size, Md5Checksum: md5checksum, ParentIDs: parentIds,
+		ModTime: modTime, LocalID: localId, RemoteID: &remoteId}
 	return tx.byRemoteID.Put([]byte(remoteId), toBytes(&rf))
 }
 
@@ -73,10 +78,20 @@ func getPaths(byID bucket, fileID string) []string {
 	return paths
 }
 
+// getFile returns the record for a file.  Returns nil if the record does not exist or cannot be decoded.
 func getFile(b bucket, key *string) *RemoteFile {
-	buf := b.Get([]byte(*key))
-	if buf == nil {
+	return decodeFile(*key, b.Get([]byte(*key)))
+}
+
+// decodeFile decodes the record for a file.  A record that cannot be decoded is logged and nil is returned.
+func decodeFile(key string, value []byte) *RemoteFile {
+	if value == nil {
+		return nil
+	}
+	rf, err := toRemoteFile(value)
+	if err != nil {
+		log.Printf("Skipping corrupt cache record %s: %v\n", key, err)
 		return nil
 	}
-	return toRemoteFile(buf)
+	return rf
 }
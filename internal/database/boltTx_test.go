@@ -12,11 +12,11 @@ func checkPath(t *testing.T, expected string, actual string) {
 }
 
 func TestBoltTx_SetPaths(t *testing.T) {
-	parent := RemoteFile{"parent", "text/plain", 16, nil, []string{"rootId"}, nil, nil, nil}
-	file := RemoteFile{"name", "text/plain", 16, nil, []string{"parent"}, nil, nil, nil}
+	parent := RemoteFile{Name: "parent", MimeType: "text/plain", Size: 16, ParentIDs: []string{"rootId"}}
+	file := RemoteFile{Name: "name", MimeType: "text/plain", Size: 16, ParentIDs: []string{"parent"}}
 	fileBucket := makeFileBucket(&file, &parent)
 	pathBucket := makeMockBucket()
-	tx := boltTx{fileBucket, pathBucket}
+	tx := boltTx{fileBucket, pathBucket, nil}
 
 	tx.SetPaths()
 
@@ -37,7 +37,7 @@ func TestBoltTx_ForEachPath(t *testing.T) {
 	pathBucket := makeMockBucket()
 	pathBucket.keyValues["/parent"] = []byte("parent")
 	pathBucket.keyValues["/parent/name"] = []byte("name")
-	tx := boltTx{nil, pathBucket}
+	tx := boltTx{nil, pathBucket, nil}
 	pathMap := make(map[string]string)
 
 	err := tx.ForEachPath(func(path string, id string) error {
@@ -89,13 +89,16 @@ func TestGetPath(t *testing.T) {
 
 func TestGetFile(t *testing.T) {
 	b := makeFileBucket(&RemoteFile{Name: "existing", Size: 123})
+	b.keyValues["corrupt"] = []byte("not a gob")
+	existing, _ := toRemoteFile(b.keyValues["existing"])
 	tests := []struct {
 		description string
 		fileID      string
 		expected    *RemoteFile
 	}{
-		{"existing file", "existing", toRemoteFile(b.keyValues["existing"])},
+		{"existing file", "existing", existing},
 		{"non-existing file", "unknown", nil},
+		{"corrupt file", "corrupt", nil},
 	}
 
 	for _, test := range tests {
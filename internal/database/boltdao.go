@@ -1,7 +1,12 @@
 package database
 
 import (
+	"bytes"
+	"context"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	bolt "github.com/coreos/bbolt"
@@ -28,17 +33,24 @@ type FileInfo interface {
 	Size() uint64
 }
 
-// OpenDb opens the specified data file.  If the database is empty then getFiles is used to populate it.
-func OpenDb(fileName string, getFiles func() (chan FileOrError, error)) (*BoltDao, error) {
+// OpenDb opens the specified data file.  If the database is empty then getFiles is used to populate it.  If getFiles
+// returns an error then the database is left empty.  The context passed to getFiles is cancelled when OpenDb returns.
+func OpenDb(fileName string, getFiles func(ctx context.Context) (chan FileOrError, error)) (*BoltDao, error) {
 	db, err := bolt.Open(fileName, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		return nil, err
 	}
 	dao := &BoltDao{db}
+	if err = dao.migrate(); err != nil {
+		dao.Close()
+		return nil, err
+	}
 	if getFiles != nil && dao.isEmpty() {
 		log.Printf("Populating files in %s\n", fileName)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 		var ch chan FileOrError
-		if ch, err = getFiles(); err != nil {
+		if ch, err = getFiles(ctx); err != nil {
 			dao.Close()
 			return nil, err
 		}
@@ -66,6 +78,15 @@ func (dao *BoltDao) Close() error {
 	return dao.db.Close()
 }
 
+// Size returns the size of the database file in bytes.
+func (dao *BoltDao) Size() (int64, error) {
+	stat, err := os.Stat(dao.db.Path())
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
 func (dao *BoltDao) isEmpty() bool {
 	var isEmpty bool
 	dao.db.View(func(tx *bolt.Tx) error {
@@ -77,9 +98,9 @@ func (dao *BoltDao) isEmpty() bool {
 
 // AddOrUpdate adds or updates the records for a file.
 func (dao *BoltDao) AddOrUpdate(remoteID string, name string, mimeType string, size uint64, md5checksum *string,
-	parentIDs []string, lastModified string, localID *string) error {
+	parentIDs []string, modTime time.Time, localID *string) error {
 	return dao.update(func(tx *boltTx) error {
-		err := tx.insertFile(remoteID, name, mimeType, size, md5checksum, parentIDs, lastModified, localID)
+		err := tx.insertFile(remoteID, name, mimeType, size, md5checksum, parentIDs, modTime, localID)
 		if err == nil {
 			err = tx.setPaths(remoteID)
 		}
@@ -87,6 +108,16 @@ func (dao *BoltDao) AddOrUpdate(remoteID string, name string, mimeType string, s
 	})
 }
 
+// Save adds or updates the records for a file.
+func (dao *BoltDao) Save(rf *RemoteFile) error {
+	return dao.update(func(tx *boltTx) error {
+		if err := tx.byRemoteID.Put([]byte(*rf.RemoteID), toBytes(rf)); err != nil {
+			return err
+		}
+		return tx.setPaths(*rf.RemoteID)
+	})
+}
+
 func (dao *BoltDao) update(cb func(*boltTx) error) error {
 	return dao.db.Update(func(tx *bolt.Tx) error {
 		byID, err := tx.CreateBucketIfNotExists([]byte(byIDBucket))
@@ -97,7 +128,16 @@ func (dao *BoltDao) update(cb func(*boltTx) error) error {
 		if err != nil {
 			return err
 		}
-		return cb(&boltTx{byID, byPath})
+		trashed, err := tx.CreateBucketIfNotExists([]byte(trashedBucket))
+		if err != nil {
+			return err
+		}
+		if tx.Bucket([]byte(metadataBucket)) == nil {
+			if err := setSchemaVersion(tx, len(migrations)); err != nil {
+				return err
+			}
+		}
+		return cb(&boltTx{byID, byPath, trashed})
 	})
 }
 
@@ -106,7 +146,7 @@ func (dao *BoltDao) FindByPath(remotePath string) *RemoteFile {
 	var rf *RemoteFile
 	dao.db.View(func(tx *bolt.Tx) error {
 		if fileID := tx.Bucket([]byte(byPathBucket)).Get([]byte(remotePath)); fileID != nil {
-			rf = toRemoteFile(tx.Bucket([]byte(byIDBucket)).Get(fileID))
+			rf = decodeFile(string(fileID), tx.Bucket([]byte(byIDBucket)).Get(fileID))
 		}
 		return nil
 	})
@@ -116,10 +156,69 @@ func (dao *BoltDao) FindByPath(remotePath string) *RemoteFile {
 // FindByID looks up a file record using the local ID.
 func (dao *BoltDao) FindByID(finfo FileInfo) (rf *RemoteFile) {
 	dao.db.View(func(tx *bolt.Tx) error {
-		if rec := tx.Bucket([]byte(byIDBucket)).Get([]byte(finfo.ID())); rec != nil {
-			rf = toRemoteFile(rec)
-		}
+		rf = decodeFile(finfo.ID(), tx.Bucket([]byte(byIDBucket)).Get([]byte(finfo.ID())))
+		return nil
+	})
+	return
+}
+
+// FindByRemoteID looks up a file record using the remote ID.
+func (dao *BoltDao) FindByRemoteID(remoteID string) (rf *RemoteFile) {
+	dao.db.View(func(tx *bolt.Tx) error {
+		rf = decodeFile(remoteID, tx.Bucket([]byte(byIDBucket)).Get([]byte(remoteID)))
 		return nil
 	})
 	return
 }
+
+// FindByPattern returns the records for the remote paths that match a pattern.  Patterns use the syntax of
+// filepath.Match.  The contents of matching folders are also returned.
+func (dao *BoltDao) FindByPattern(pattern string) map[string]*RemoteFile {
+	files := make(map[string]*RemoteFile)
+	dao.db.View(func(tx *bolt.Tx) error {
+		byID := tx.Bucket([]byte(byIDBucket))
+		return tx.Bucket([]byte(byPathBucket)).ForEach(func(path []byte, fileID []byte) error {
+			if matchesPath(pattern, string(path)) {
+				if rf := decodeFile(string(fileID), byID.Get(fileID)); rf != nil {
+					files[string(path)] = rf
+				}
+			}
+			return nil
+		})
+	})
+	return files
+}
+
+// FindByPrefix returns the records for a remote folder and its contents.  Unlike FindByPattern, the folder path is
+// used literally and only the records under the folder are read.
+func (dao *BoltDao) FindByPrefix(folderPath string) map[string]*RemoteFile {
+	files := make(map[string]*RemoteFile)
+	prefix := []byte(strings.TrimSuffix(folderPath, string(filepath.Separator)) + string(filepath.Separator))
+	dao.db.View(func(tx *bolt.Tx) error {
+		byID := tx.Bucket([]byte(byIDBucket))
+		byPath := tx.Bucket([]byte(byPathBucket))
+		if fileID := byPath.Get([]byte(folderPath)); fileID != nil {
+			if rf := decodeFile(string(fileID), byID.Get(fileID)); rf != nil {
+				files[folderPath] = rf
+			}
+		}
+		c := byPath.Cursor()
+		for path, fileID := c.Seek(prefix); path != nil && bytes.HasPrefix(path, prefix); path, fileID = c.Next() {
+			if rf := decodeFile(string(fileID), byID.Get(fileID)); rf != nil {
+				files[string(path)] = rf
+			}
+		}
+		return nil
+	})
+	return files
+}
+
+// matchesPath returns true if the path or one of its ancestors matches the pattern.
+func matchesPath(pattern string, path string) bool {
+	for ; path != string(filepath.Separator) && path != "."; path = filepath.Dir(path) {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+	}
+	return false
+}
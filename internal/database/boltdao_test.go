@@ -1,9 +1,14 @@
 package database
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -14,6 +19,8 @@ const (
 	dataDir = "testdata"
 )
 
+var modTime = time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC)
+
 var testDbFile string
 var emptyDbFile string
 var nonemptyDbFile string
@@ -24,18 +31,58 @@ func init() {
 	nonemptyDbFile = filepath.Join(dataDir, "non-empty.db")
 }
 
+// copyDb copies a test database to a temporary file so that the checked in file is not modified by the tests.
+func copyDb(t *testing.T, fileName string) string {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("failed to read database %s: %s", fileName, err.Error())
+	}
+	file, err := ioutil.TempFile("", "backupd-*.db")
+	if err != nil {
+		t.Fatalf("failed to create database file: %s", err.Error())
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("failed to copy database %s: %s", fileName, err.Error())
+	}
+	return file.Name()
+}
+
+// schemaVersionOf returns the schema version of a database file without migrating it.
+func schemaVersionOf(t *testing.T, fileName string) int {
+	db, err := bolt.Open(fileName, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("failed to open database %s: %s", fileName, err.Error())
+	}
+	defer db.Close()
+	var version int
+	db.View(func(tx *bolt.Tx) error {
+		version = getSchemaVersion(tx)
+		return nil
+	})
+	return version
+}
+
 func TestBoltDao_OpenDb_existingFile(t *testing.T) {
-	getFiles := func() (chan FileOrError, error) {
+	getFiles := func(ctx context.Context) (chan FileOrError, error) {
 		return nil, errors.New("Unexpected call to getFiles")
 	}
+	dbFile := copyDb(t, nonemptyDbFile)
+	defer os.Remove(dbFile)
+	if version := schemaVersionOf(t, dbFile); version != 0 {
+		t.Fatalf("Expected %s to predate schema versioning, got version %d", nonemptyDbFile, version)
+	}
 
-	dao, err := OpenDb(nonemptyDbFile, getFiles)
+	dao, err := OpenDb(dbFile, getFiles)
 
 	if err != nil {
 		t.Errorf("failed to open database %s: %s", nonemptyDbFile, err.Error())
 	} else {
 		defer dao.Close()
 		dao.db.View(func(tx *bolt.Tx) error {
+			if version := getSchemaVersion(tx); version != len(migrations) {
+				t.Errorf("Expected schema version %d, got %d", len(migrations), version)
+			}
 			byID := tx.Bucket([]byte(byIDBucket))
 			if byID.Stats().KeyN != 0 {
 				t.Errorf("Expected no file recordss, got %d", byID.Stats().KeyN)
@@ -58,10 +105,10 @@ func TestBoltDao_OpenDb_invalidFile(t *testing.T) {
 	}
 }
 
-func checkEmptyDb(t *testing.T) {
-	db, err := bolt.Open(emptyDbFile, 0600, &bolt.Options{Timeout: 1 * time.Second})
+func checkEmptyDb(t *testing.T, dbFile string) {
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		t.Errorf("Error opening file %s: %s", emptyDbFile, err.Error())
+		t.Errorf("Error opening file %s: %s", dbFile, err.Error())
 	} else {
 		defer db.Close()
 		db.View(func(tx *bolt.Tx) error {
@@ -79,17 +126,20 @@ func checkEmptyDb(t *testing.T) {
 }
 
 func TestBoltDao_OpenDb_initializeEmptyDatabase(t *testing.T) {
-	getFiles := func() (chan FileOrError, error) {
+	getFiles := func(ctx context.Context) (chan FileOrError, error) {
 		ch := make(chan FileOrError, 0)
 		go func() {
-			ch <- FileOrError{File: NewRemoteFile("name", "plain/text", 10, "checksum", []string{}, "2011-01-01", "local ID", "remote ID")}
+			ch <- FileOrError{File: NewRemoteFile("name", "plain/text", 10, "checksum", []string{}, modTime, "local ID", "remote ID")}
 			ch <- FileOrError{Error: errors.New("Rollback initialize")}
 			close(ch)
 		}()
 		return ch, nil
 	}
 
-	dao, err := OpenDb(emptyDbFile, getFiles)
+	dbFile := copyDb(t, emptyDbFile)
+	defer os.Remove(dbFile)
+
+	dao, err := OpenDb(dbFile, getFiles)
 
 	if err == nil {
 		dao.Close()
@@ -97,16 +147,57 @@ func TestBoltDao_OpenDb_initializeEmptyDatabase(t *testing.T) {
 	} else if err.Error() != "Rollback initialize" {
 		t.Errorf("Unexpected error: %s", err.Error())
 	} else {
-		checkEmptyDb(t)
+		checkEmptyDb(t, dbFile)
+	}
+}
+
+func TestBoltDao_OpenDb_cancelsGetFiles(t *testing.T) {
+	stopped := make(chan bool, 1)
+	getFiles := func(ctx context.Context) (chan FileOrError, error) {
+		ch := make(chan FileOrError, 0)
+		go func() {
+			defer close(ch)
+			ch <- FileOrError{File: NewRemoteFile("name", "plain/text", 10, "checksum", []string{}, modTime, "local ID", "remote ID")}
+			ch <- FileOrError{Error: errors.New("Listing failed")}
+			for i := 0; ; i++ {
+				select {
+				case ch <- FileOrError{File: NewRemoteFile("other", "plain/text", 10, "checksum", []string{}, modTime, "local ID", fmt.Sprint(i))}:
+				case <-ctx.Done():
+					stopped <- true
+					return
+				}
+			}
+		}()
+		return ch, nil
+	}
+
+	dbFile := copyDb(t, emptyDbFile)
+	defer os.Remove(dbFile)
+
+	dao, err := OpenDb(dbFile, getFiles)
+
+	if err == nil {
+		dao.Close()
+		t.Error("Expected the error from getFiles()")
+	} else {
+		checkEmptyDb(t, dbFile)
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Error("Expected getFiles context to be cancelled")
+		}
 	}
 }
 
 func TestBoltDao_OpenDb_errorLoadingFiles(t *testing.T) {
-	getFiles := func() (chan FileOrError, error) {
+	getFiles := func(ctx context.Context) (chan FileOrError, error) {
 		return nil, errors.New("error laoding files")
 	}
 
-	dao, err := OpenDb(emptyDbFile, getFiles)
+	dbFile := copyDb(t, emptyDbFile)
+	defer os.Remove(dbFile)
+
+	dao, err := OpenDb(dbFile, getFiles)
 
 	if err == nil {
 		dao.Close()
@@ -114,15 +205,15 @@ func TestBoltDao_OpenDb_errorLoadingFiles(t *testing.T) {
 	} else if err.Error() != "error laoding files" {
 		t.Errorf("Unexpected error: %s", err.Error())
 	} else {
-		checkEmptyDb(t)
+		checkEmptyDb(t, dbFile)
 	}
 }
 
 func TestBoltDao_OpenDb_createFile(t *testing.T) {
-	getFiles := func() (chan FileOrError, error) {
+	getFiles := func(ctx context.Context) (chan FileOrError, error) {
 		ch := make(chan FileOrError, 0)
 		go func() {
-			ch <- FileOrError{File: NewRemoteFile("name", "plain/text", 10, "checksum", []string{}, "2011-01-01", "local ID", "remote ID")}
+			ch <- FileOrError{File: NewRemoteFile("name", "plain/text", 10, "checksum", []string{}, modTime, "local ID", "remote ID")}
 			close(ch)
 		}()
 		return ch, nil
@@ -167,7 +258,10 @@ func TestBoltDao_isEmpty(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
-			dao, err := OpenDb(test.dbFile, nil)
+			dbFile := copyDb(t, test.dbFile)
+			defer os.Remove(dbFile)
+
+			dao, err := OpenDb(dbFile, nil)
 			if err != nil {
 				t.Errorf("failed to open database %s: %s", test.dbFile, err.Error())
 			} else {
@@ -180,6 +274,49 @@ func TestBoltDao_isEmpty(t *testing.T) {
 	}
 }
 
+func TestOpenDb_MigratesModTime(t *testing.T) {
+	tests := []struct {
+		description  string
+		lastModified string
+		expected     time.Time
+	}{
+		{"seconds", "2018-06-01T12:30:15Z", time.Date(2018, 6, 1, 12, 30, 15, 0, time.UTC)},
+		{"milliseconds", "2018-06-01T12:30:15.250Z", time.Date(2018, 6, 1, 12, 30, 15, 250000000, time.UTC)},
+		{"time zone", "2018-06-01T08:30:15-04:00", time.Date(2018, 6, 1, 12, 30, 15, 0, time.UTC)},
+		{"invalid", "2018-06-01", time.Time{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dao, err := OpenDb(testDbFile, nil)
+			if err != nil {
+				t.Fatalf("Couldn't open test.db: %v", err)
+			}
+			rf := NewRemoteFile("name", "text/plain", 10, "checksum", nil, time.Time{}, "local ID", "fileId")
+			rf.LastModified = &test.lastModified
+			dao.Save(rf)
+			dao.db.Update(func(tx *bolt.Tx) error {
+				return tx.DeleteBucket([]byte(metadataBucket))
+			})
+			dao.Close()
+
+			dao, err = OpenDb(testDbFile, nil)
+			defer removeTestDb(t, dao)
+
+			if err != nil {
+				t.Fatalf("Couldn't reopen test.db: %v", err)
+			}
+			migrated := dao.FindByPath("/name")
+			if migrated.LastModified != nil {
+				t.Errorf("Expected LastModified to be cleared, got %s", *migrated.LastModified)
+			}
+			if !migrated.ModTime.Equal(test.expected) {
+				t.Errorf("Expected ModTime %v, got %v", test.expected, migrated.ModTime)
+			}
+		})
+	}
+}
+
 func removeTestDb(t *testing.T, dao *BoltDao) {
 	if dao != nil {
 		if err := dao.Close(); err != nil {
@@ -223,7 +360,7 @@ func TestBoltDao_update_Commits(t *testing.T) {
 
 		remoteID := "remoteId"
 		err := dao.update(func(tx *boltTx) error {
-			if err := tx.insertFile(remoteID, "text/plain", "name", 16, nil, nil, "1970-01-01", nil); err != nil {
+			if err := tx.insertFile(remoteID, "text/plain", "name", 16, nil, nil, time.Time{}, nil); err != nil {
 				return err
 			}
 			return nil
@@ -272,6 +409,30 @@ func TestBoltDao_update_RollsBackOnError(t *testing.T) {
 	}
 }
 
+func TestBoltDao_Save(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+	parent := NewRemoteFile("parent", "folder", 0, "", nil, modTime, "", "parentId")
+	file := NewRemoteFile("name", "plain/text", 10, "checksum", []string{"parentId"}, modTime, "local ID", "fileId")
+	file.LocalPath = &file.Name
+
+	if err := dao.Save(parent); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := dao.Save(file); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if rf := dao.FindByPath("/parent/name"); rf == nil {
+		t.Error("Expected file to be saved")
+	} else if !reflect.DeepEqual(rf, file) {
+		t.Errorf("Expected %v to equal %v", rf, file)
+	}
+}
+
 func TestBoltDao_FindByPath(t *testing.T) {
 	tests := []struct {
 		description string
@@ -306,6 +467,23 @@ func TestBoltDao_FindByPath(t *testing.T) {
 	}
 }
 
+func TestBoltDao_FindByRemoteID(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+	file := NewRemoteFile("name", "plain/text", 10, "checksum", nil, modTime, "local ID", "fileId")
+	dao.Save(file)
+
+	if rf := dao.FindByRemoteID("fileId"); !reflect.DeepEqual(rf, file) {
+		t.Errorf("Expected %v to equal %v", rf, file)
+	}
+	if rf := dao.FindByRemoteID("unknownId"); rf != nil {
+		t.Errorf("Expected nil for unknown ID, got %v", rf)
+	}
+}
+
 type fileInfoMock struct {
 	id   string
 	size uint64
@@ -351,3 +529,105 @@ func TestBoltDao_FindByID(t *testing.T) {
 		})
 	}
 }
+
+func TestBoltDao_FindByPattern(t *testing.T) {
+	tests := []struct {
+		description string
+		pattern     string
+		expected    []string
+	}{
+		{"single file", "/folder/file1.txt", []string{"/folder/file1.txt"}},
+		{"glob", "/folder/*.txt", []string{"/folder/file1.txt", "/folder/file2.txt"}},
+		{"folder", "/folder", []string{"/folder", "/folder/file1.txt", "/folder/file2.txt", "/folder/sub", "/folder/sub/file3.txt"}},
+		{"no match", "/other", []string{}},
+	}
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+	dao.Save(NewRemoteFile("folder", "folder", 0, "", nil, time.Time{}, "", "folder"))
+	dao.Save(NewRemoteFile("file1.txt", "text/plain", 0, "", []string{"folder"}, time.Time{}, "", "file1"))
+	dao.Save(NewRemoteFile("file2.txt", "text/plain", 0, "", []string{"folder"}, time.Time{}, "", "file2"))
+	dao.Save(NewRemoteFile("sub", "folder", 0, "", []string{"folder"}, time.Time{}, "", "sub"))
+	dao.Save(NewRemoteFile("file3.txt", "text/plain", 0, "", []string{"sub"}, time.Time{}, "", "file3"))
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			files := dao.FindByPattern(test.pattern)
+
+			paths := make([]string, 0, len(files))
+			for path, rf := range files {
+				paths = append(paths, path)
+				if rf == nil {
+					t.Errorf("Expected record for %s", path)
+				}
+			}
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, test.expected) {
+				t.Errorf("Expected paths %v to equal %v", paths, test.expected)
+			}
+		})
+	}
+}
+
+func TestBoltDao_FindByPrefix(t *testing.T) {
+	tests := []struct {
+		description string
+		folder      string
+		expected    []string
+	}{
+		{"folder", "/folder", []string{"/folder", "/folder/file1.txt", "/folder/sub", "/folder/sub/file3.txt"}},
+		{"trailing separator", "/folder/", []string{"/folder/file1.txt", "/folder/sub", "/folder/sub/file3.txt"}},
+		{"pattern characters", "/f[o]lder*", []string{"/f[o]lder*", "/f[o]lder*/file2.txt"}},
+		{"file", "/folder/file1.txt", []string{"/folder/file1.txt"}},
+		{"no match", "/fold", []string{}},
+	}
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+	dao.Save(NewRemoteFile("folder", "folder", 0, "", nil, time.Time{}, "", "folder"))
+	dao.Save(NewRemoteFile("file1.txt", "text/plain", 0, "", []string{"folder"}, time.Time{}, "", "file1"))
+	dao.Save(NewRemoteFile("sub", "folder", 0, "", []string{"folder"}, time.Time{}, "", "sub"))
+	dao.Save(NewRemoteFile("file3.txt", "text/plain", 0, "", []string{"sub"}, time.Time{}, "", "file3"))
+	dao.Save(NewRemoteFile("folder2", "folder", 0, "", nil, time.Time{}, "", "folder2"))
+	dao.Save(NewRemoteFile("f[o]lder*", "folder", 0, "", nil, time.Time{}, "", "glob"))
+	dao.Save(NewRemoteFile("file2.txt", "text/plain", 0, "", []string{"glob"}, time.Time{}, "", "file2"))
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			files := dao.FindByPrefix(test.folder)
+
+			paths := make([]string, 0, len(files))
+			for path, rf := range files {
+				paths = append(paths, path)
+				if rf == nil {
+					t.Errorf("Expected record for %s", path)
+				}
+			}
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, test.expected) {
+				t.Errorf("Expected paths %v to equal %v", paths, test.expected)
+			}
+		})
+	}
+}
+
+func TestBoltDao_Size(t *testing.T) {
+	dbFile := copyDb(t, nonemptyDbFile)
+	defer os.Remove(dbFile)
+	dao, err := OpenDb(dbFile, nil)
+	if err != nil {
+		t.Fatalf("failed to open database %s: %s", nonemptyDbFile, err.Error())
+	}
+	defer dao.Close()
+	stat, _ := os.Stat(dbFile)
+
+	size, err := dao.Size()
+
+	if err != nil || size != stat.Size() {
+		t.Errorf("Expected size %d, got %d, %v", stat.Size(), size, err)
+	}
+}
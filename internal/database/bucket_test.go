@@ -13,6 +13,11 @@ func (b *mockBucket) Put(key []byte, value []byte) error {
 	return nil
 }
 
+func (b *mockBucket) Delete(key []byte) error {
+	delete(b.keyValues, string(key))
+	return nil
+}
+
 func (b *mockBucket) ForEach(cb func(key []byte, value []byte) error) error {
 	for key, value := range b.keyValues {
 		cb([]byte(key), value)
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// CatalogEntry is a file record with its remote paths.  The catalog is written as one JSON entry per line.
+type CatalogEntry struct {
+	*RemoteFile
+	Paths []string `json:"paths"`
+}
+
+// Export writes the file records to w as JSON lines.  Corrupt records are skipped.  Returns the number of records
+// written.
+func (dao *BoltDao) Export(w io.Writer) (int, error) {
+	count := 0
+	enc := json.NewEncoder(w)
+	err := dao.view(func(tx *boltTx) error {
+		return tx.byRemoteID.ForEach(func(id []byte, value []byte) error {
+			rf := decodeFile(string(id), value)
+			if rf == nil {
+				return nil
+			}
+			if err := enc.Encode(&CatalogEntry{rf, sortedPaths(getPaths(tx.byRemoteID, string(id)))}); err != nil {
+				return err
+			}
+			count++
+			return nil
+		})
+	})
+	return count, err
+}
+
+// Import adds the file records from a catalog written by Export.  The paths are calculated from the records instead of
+// being read from the catalog.  The database must not contain any files.  Nothing is imported if the catalog contains
+// an invalid entry.  Returns the number of records imported.
+func (dao *BoltDao) Import(r io.Reader) (int, error) {
+	if dao.hasFiles() {
+		return 0, errors.New("the database already contains files")
+	}
+	count := 0
+	err := dao.update(func(tx *boltTx) error {
+		dec := json.NewDecoder(r)
+		for line := 1; ; line++ {
+			entry := &CatalogEntry{}
+			if err := dec.Decode(entry); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("invalid catalog entry %d: %v", line, err)
+			}
+			if entry.RemoteFile == nil || entry.RemoteID == nil || *entry.RemoteID == "" {
+				return fmt.Errorf("invalid catalog entry %d: missing remote ID", line)
+			}
+			if err := tx.byRemoteID.Put([]byte(*entry.RemoteID), toBytes(entry.RemoteFile)); err != nil {
+				return err
+			}
+			count++
+		}
+		return tx.SetPaths()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// hasFiles returns true if the database contains any file records.
+func (dao *BoltDao) hasFiles() bool {
+	var hasFiles bool
+	dao.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(byIDBucket)); b != nil {
+			key, _ := b.Cursor().First()
+			hasFiles = key != nil
+		}
+		return nil
+	})
+	return hasFiles
+}
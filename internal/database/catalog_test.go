@@ -0,0 +1,99 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltDao_Export(t *testing.T) {
+	dao, _ := OpenDb(testDbFile, nil)
+	defer removeTestDb(t, dao)
+	dao.Save(NewRemoteFile("folder", "folder", 0, "", nil, time.Time{}, "", "folderId"))
+	dao.Save(NewRemoteFile("file.txt", "text/plain", 10, "checksum", []string{"folderId"}, modTime, "local ID", "fileId"))
+	var buf bytes.Buffer
+
+	count, err := dao.Export(&buf)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, `{"name":"file.txt","mimeType":"text/plain","size":10,"md5Checksum":"checksum","parentIds":["folderId"],`+
+		`"localId":"local ID","remoteId":"fileId","modTime":"2011-01-01T00:00:00Z","paths":["/folder/file.txt"]}`+"\n"+
+		`{"name":"folder","mimeType":"folder","size":0,"remoteId":"folderId",`+
+		`"modTime":"0001-01-01T00:00:00Z","paths":["/folder"]}`+"\n", buf.String())
+}
+
+func TestBoltDao_Import(t *testing.T) {
+	dao, _ := OpenDb(testDbFile, nil)
+	defer removeTestDb(t, dao)
+	folder := NewRemoteFile("folder", "folder", 0, "", nil, time.Time{}, "", "folderId")
+	file := NewRemoteFile("file.txt", "text/plain", 10, "checksum", []string{"folderId"}, modTime, "local ID", "fileId")
+	dao.Save(folder)
+	dao.Save(file)
+	var buf bytes.Buffer
+	dao.Export(&buf)
+	importFile := filepath.Join(dataDir, "import.db")
+	imported, _ := OpenDb(importFile, nil)
+	defer func() {
+		imported.Close()
+		os.Remove(importFile)
+	}()
+
+	count, err := imported.Import(&buf)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, dao.FindByPattern("/*"), imported.FindByPattern("/*"))
+	assert.True(t, file.ModTime.Equal(imported.FindByPath("/folder/file.txt").ModTime))
+	assert.Empty(t, mustCheck(imported))
+}
+
+func TestBoltDao_Import_NotEmpty(t *testing.T) {
+	dao, _ := OpenDb(testDbFile, nil)
+	defer removeTestDb(t, dao)
+	dao.Save(NewRemoteFile("file.txt", "text/plain", 10, "checksum", nil, modTime, "", "fileId"))
+
+	count, err := dao.Import(strings.NewReader(`{"name":"other.txt","remoteId":"otherId"}`))
+
+	assert.EqualError(t, err, "the database already contains files")
+	assert.Equal(t, 0, count)
+	assert.Nil(t, dao.FindByPath("/other.txt"))
+}
+
+func TestBoltDao_Import_InvalidEntry(t *testing.T) {
+	tests := []struct {
+		description   string
+		catalog       string
+		expectedError string
+	}{
+		{"invalid JSON", `{"name":"file.txt","remoteId":"fileId"}` + "\n{", "invalid catalog entry 2: unexpected EOF"},
+		{"missing remote ID", `{"name":"file.txt","remoteId":"fileId"}` + "\n" + `{"name":"other.txt"}`,
+			"invalid catalog entry 2: missing remote ID"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dao, _ := OpenDb(testDbFile, nil)
+			defer removeTestDb(t, dao)
+
+			count, err := dao.Import(strings.NewReader(test.catalog))
+
+			assert.EqualError(t, err, test.expectedError)
+			assert.Equal(t, 0, count)
+			assert.False(t, dao.hasFiles(), "expected import to be rolled back")
+		})
+	}
+}
+
+func mustCheck(dao *BoltDao) []string {
+	problems, err := dao.Check(false)
+	if err != nil {
+		panic(err)
+	}
+	return problems
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const hashBucket = "LocalHashes"
+
+// LocalHash contains the checksums of a local file's content and the attributes of the file when they were
+// calculated.
+type LocalHash struct {
+	Size       uint64
+	ModTime    time.Time
+	ChangeTime time.Time
+	Md5        string // hex encoded
+	Sha256     string // hex encoded
+}
+
+// Matches returns true if the checksums were calculated for the current attributes of the file.
+func (h *LocalHash) Matches(size uint64, modTime time.Time, changeTime time.Time) bool {
+	return h.Size == size && h.ModTime.Equal(modTime) && h.ChangeTime.Equal(changeTime)
+}
+
+// GetLocalHash returns the saved checksums of a local file.  Returns nil if no checksums have been saved.
+func (dao *BoltDao) GetLocalHash(localID string) *LocalHash {
+	var hash *LocalHash
+	dao.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(hashBucket)); b != nil {
+			if value := b.Get([]byte(localID)); value != nil {
+				h := LocalHash{}
+				if err := decode(value, &h); err == nil {
+					hash = &h
+				}
+			}
+		}
+		return nil
+	})
+	return hash
+}
+
+// SaveLocalHash saves the checksums of a local file.
+func (dao *BoltDao) SaveLocalHash(localID string, hash *LocalHash) error {
+	value, err := encode(hash)
+	if err != nil {
+		return err
+	}
+	return dao.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(hashBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(localID), value)
+	})
+}
+
+// DeleteLocalHash removes the saved checksums of a local file.
+func (dao *BoltDao) DeleteLocalHash(localID string) error {
+	return dao.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(hashBucket)); b != nil {
+			return b.Delete([]byte(localID))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltDao_GetLocalHash_NotSaved(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+
+	assert.Nil(t, dao.GetLocalHash("local ID"))
+}
+
+func TestBoltDao_SaveLocalHash(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+	modTime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	hash := &LocalHash{Size: 5, ModTime: modTime, ChangeTime: modTime, Md5: "md5", Sha256: "sha256"}
+
+	err = dao.SaveLocalHash("local ID", hash)
+
+	assert.Nil(t, err)
+	assert.Equal(t, hash, dao.GetLocalHash("local ID"))
+	assert.Nil(t, dao.GetLocalHash("other ID"))
+}
+
+func TestBoltDao_DeleteLocalHash(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+	assert.Nil(t, dao.DeleteLocalHash("local ID"), "Unexpected error before the bucket exists")
+	dao.SaveLocalHash("local ID", &LocalHash{Md5: "md5"})
+	dao.SaveLocalHash("other ID", &LocalHash{Md5: "other"})
+
+	err = dao.DeleteLocalHash("local ID")
+
+	assert.Nil(t, err)
+	assert.Nil(t, dao.GetLocalHash("local ID"))
+	assert.Equal(t, "other", dao.GetLocalHash("other ID").Md5)
+}
+
+func TestLocalHash_Matches(t *testing.T) {
+	modTime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	changeTime := modTime.Add(time.Second)
+	hash := &LocalHash{Size: 5, ModTime: modTime, ChangeTime: changeTime}
+	tests := []struct {
+		name       string
+		size       uint64
+		modTime    time.Time
+		changeTime time.Time
+		expected   bool
+	}{
+		{"same attributes", 5, modTime, changeTime, true},
+		{"same time in other zone", 5, modTime.In(time.FixedZone("EST", -5*3600)), changeTime, true},
+		{"different size", 6, modTime, changeTime, false},
+		{"different mod time", 5, modTime.Add(time.Nanosecond), changeTime, false},
+		{"different change time", 5, modTime, modTime, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, hash.Matches(test.size, test.modTime, test.changeTime))
+		})
+	}
+}
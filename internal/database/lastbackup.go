@@ -0,0 +1,41 @@
+package database
+
+import (
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const lastBackupKeyPrefix = "lastBackup:"
+
+// GetLastBackup returns the time that a source folder was last known to be backed up.  Returns the zero time if no
+// time has been saved.
+func (dao *BoltDao) GetLastBackup(source string) time.Time {
+	var lastBackup time.Time
+	dao.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(metadataBucket)); b != nil {
+			if value := b.Get([]byte(lastBackupKeyPrefix + source)); value != nil {
+				lastBackup.UnmarshalBinary(value)
+			}
+		}
+		return nil
+	})
+	return lastBackup
+}
+
+// SaveLastBackup saves the time that a source folder was last known to be backed up.
+func (dao *BoltDao) SaveLastBackup(source string, lastBackup time.Time) error {
+	value, err := lastBackup.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return dao.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(metadataBucket)) == nil {
+			// the file records of a new database are created with the current schema
+			if err := setSchemaVersion(tx, len(migrations)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(metadataBucket)).Put([]byte(lastBackupKeyPrefix+source), value)
+	})
+}
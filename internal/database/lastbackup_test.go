@@ -0,0 +1,38 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltDao_GetLastBackup_NotSaved(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+
+	assert.True(t, dao.GetLastBackup("/source").IsZero())
+}
+
+func TestBoltDao_SaveLastBackup(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+	lastBackup := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	err = dao.SaveLastBackup("/source", lastBackup)
+
+	assert.Nil(t, err)
+	assert.True(t, lastBackup.Equal(dao.GetLastBackup("/source")))
+	assert.True(t, dao.GetLastBackup("/other").IsZero())
+	dao.db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, len(migrations), getSchemaVersion(tx))
+		return nil
+	})
+}
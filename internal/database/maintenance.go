@@ -0,0 +1,179 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// Rebuild replaces the file records in the database with the files returned by getFiles.  The new records are written
+// to a temporary file that replaces the database when it is complete, so the database is unchanged if getFiles fails.
+// The other records (e.g. quota, revisions) are copied from the existing database.
+func Rebuild(fileName string, getFiles func(ctx context.Context) (chan FileOrError, error)) error {
+	return replace(fileName, func(src *bolt.DB, tmpName string) error {
+		dao, err := OpenDb(tmpName, getFiles)
+		if err != nil {
+			return err
+		}
+		defer dao.Close()
+		return dao.db.Update(func(dst *bolt.Tx) error {
+			return src.View(func(tx *bolt.Tx) error {
+				return copyBuckets(dst, tx, func(name string) bool {
+					return name != byIDBucket && name != byPathBucket && name != metadataBucket
+				})
+			})
+		})
+	})
+}
+
+// Compact rewrites the database to reclaim the space used by deleted records.  Returns the sizes of the file before
+// and after compaction.
+func Compact(fileName string) (before int64, after int64, err error) {
+	if before, err = fileSize(fileName); err != nil {
+		return
+	}
+	err = replace(fileName, func(src *bolt.DB, tmpName string) error {
+		dst, err := bolt.Open(tmpName, 0600, &bolt.Options{Timeout: 1 * time.Second})
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+		return dst.Update(func(dstTx *bolt.Tx) error {
+			return src.View(func(srcTx *bolt.Tx) error {
+				return copyBuckets(dstTx, srcTx, func(string) bool { return true })
+			})
+		})
+	})
+	if err == nil {
+		after, err = fileSize(fileName)
+	}
+	return
+}
+
+func fileSize(fileName string) (int64, error) {
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// replace opens a database and calls create to write its replacement to a temporary file.  The database is locked
+// while the replacement is created, so it cannot be in use by another process.
+func replace(fileName string, create func(src *bolt.DB, tmpName string) error) error {
+	tmpName := fileName + ".tmp"
+	os.Remove(tmpName)
+	src, err := bolt.Open(fileName, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err = create(src, tmpName); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+// copyBuckets copies the included top level buckets from src to dst.
+func copyBuckets(dst *bolt.Tx, src *bolt.Tx, include func(name string) bool) error {
+	return src.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if !include(string(name)) {
+			return nil
+		}
+		target, err := dst.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		return copyBucket(target, b)
+	})
+}
+
+func copyBucket(dst *bolt.Bucket, src *bolt.Bucket) error {
+	return src.ForEach(func(key []byte, value []byte) error {
+		if value == nil {
+			child, err := dst.CreateBucketIfNotExists(key)
+			if err != nil {
+				return err
+			}
+			return copyBucket(child, src.Bucket(key))
+		}
+		return dst.Put(key, value)
+	})
+}
+
+// Check validates the file records and the path index.  Every path must refer to an existing file record that has
+// that path, and every file record must have all of its paths.  If fix is true then the problems are corrected by
+// adding the missing paths and deleting the invalid paths and corrupt records.  Returns descriptions of the problems.
+func (dao *BoltDao) Check(fix bool) ([]string, error) {
+	var problems []string
+	var repairs []func(tx *boltTx) error
+	check := func(tx *boltTx) error {
+		files := make(map[string]map[string]bool)
+		tx.byRemoteID.ForEach(func(id []byte, value []byte) error {
+			fileID := string(id)
+			if _, err := toRemoteFile(value); err != nil {
+				problems = append(problems, fmt.Sprintf("corrupt record %s: %v", fileID, err))
+				repairs = append(repairs, func(tx *boltTx) error { return tx.byRemoteID.Delete([]byte(fileID)) })
+				return nil
+			}
+			paths := make(map[string]bool)
+			for _, path := range sortedPaths(getPaths(tx.byRemoteID, fileID)) {
+				paths[path] = true
+				if tx.byRemotePath.Get([]byte(path)) == nil {
+					path := path
+					problems = append(problems, fmt.Sprintf("missing path %s for %s", path, fileID))
+					repairs = append(repairs, func(tx *boltTx) error { return tx.byRemotePath.Put([]byte(path), []byte(fileID)) })
+				}
+			}
+			files[fileID] = paths
+			return nil
+		})
+		tx.byRemotePath.ForEach(func(key []byte, value []byte) error {
+			path, fileID := string(key), string(value)
+			if paths, ok := files[fileID]; !ok {
+				problems = append(problems, fmt.Sprintf("path %s refers to missing record %s", path, fileID))
+			} else if !paths[path] {
+				problems = append(problems, fmt.Sprintf("obsolete path %s for %s", path, fileID))
+			} else {
+				return nil
+			}
+			repairs = append(repairs, func(tx *boltTx) error { return tx.byRemotePath.Delete([]byte(path)) })
+			return nil
+		})
+		if !fix {
+			return nil
+		}
+		for _, repair := range repairs {
+			if err := repair(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if fix {
+		return problems, dao.update(check)
+	}
+	return problems, dao.view(check)
+}
+
+// view calls cb with the file buckets.  cb is not called if the database is empty.
+func (dao *BoltDao) view(cb func(*boltTx) error) error {
+	return dao.db.View(func(tx *bolt.Tx) error {
+		byID := tx.Bucket([]byte(byIDBucket))
+		byPath := tx.Bucket([]byte(byPathBucket))
+		if byID == nil || byPath == nil {
+			return nil
+		}
+		return cb(&boltTx{byRemoteID: byID, byRemotePath: byPath})
+	})
+}
+
+func sortedPaths(paths []string) []string {
+	sort.Strings(paths)
+	return paths
+}
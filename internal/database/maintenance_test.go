@@ -0,0 +1,155 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func listFiles(files ...*RemoteFile) func(ctx context.Context) (chan FileOrError, error) {
+	return func(ctx context.Context) (chan FileOrError, error) {
+		ch := make(chan FileOrError, len(files))
+		for _, f := range files {
+			ch <- FileOrError{File: f}
+		}
+		close(ch)
+		return ch, nil
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	dao, _ := OpenDb(testDbFile, nil)
+	dao.Save(NewRemoteFile("stale.txt", "text/plain", 10, "checksum", nil, modTime, "", "staleId"))
+	dao.SaveUploadQuota(&UploadQuota{Day: "2011-01-01", Bytes: 100})
+	dao.Close()
+	defer removeTestDb(t, nil)
+
+	err := Rebuild(testDbFile, listFiles(
+		NewRemoteFile("folder", "folder", 0, "", nil, time.Time{}, "", "folderId"),
+		NewRemoteFile("file.txt", "text/plain", 10, "checksum", []string{"folderId"}, modTime, "", "fileId")))
+
+	assert.Nil(t, err)
+	dao, _ = OpenDb(testDbFile, nil)
+	defer dao.Close()
+	assert.Nil(t, dao.FindByPath("/stale.txt"))
+	assert.Equal(t, "fileId", *dao.FindByPath("/folder/file.txt").RemoteID)
+	assert.Equal(t, uint64(100), dao.GetUploadQuota().Bytes)
+	assert.Equal(t, len(migrations), testSchemaVersion(dao))
+	_, err = os.Stat(testDbFile + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRebuild_Error(t *testing.T) {
+	dao, _ := OpenDb(testDbFile, nil)
+	dao.Save(NewRemoteFile("file.txt", "text/plain", 10, "checksum", nil, modTime, "", "fileId"))
+	dao.Close()
+	defer removeTestDb(t, nil)
+
+	err := Rebuild(testDbFile, func(ctx context.Context) (chan FileOrError, error) {
+		return nil, errors.New("failed")
+	})
+
+	assert.EqualError(t, err, "failed")
+	dao, _ = OpenDb(testDbFile, nil)
+	defer dao.Close()
+	assert.NotNil(t, dao.FindByPath("/file.txt"))
+	_, err = os.Stat(testDbFile + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRebuild_Locked(t *testing.T) {
+	dao, _ := OpenDb(testDbFile, nil)
+	defer removeTestDb(t, dao)
+
+	err := Rebuild(testDbFile, listFiles())
+
+	assert.NotNil(t, err, "expected an error for a database that is in use")
+}
+
+func TestCompact(t *testing.T) {
+	dao, _ := OpenDb(testDbFile, nil)
+	for i := 0; i < 1000; i++ {
+		id := string(rune('a'+i%26)) + time.Duration(i).String()
+		dao.Save(NewRemoteFile(id, "text/plain", 10, "checksum", nil, modTime, "", id))
+	}
+	dao.Save(NewRemoteFile("kept.txt", "text/plain", 10, "checksum", nil, modTime, "", "keptId"))
+	dao.db.Update(func(tx *bolt.Tx) error {
+		tx.DeleteBucket([]byte(byPathBucket))
+		return tx.DeleteBucket([]byte(byIDBucket))
+	})
+	dao.Save(NewRemoteFile("kept.txt", "text/plain", 10, "checksum", nil, modTime, "", "keptId"))
+	dao.Close()
+	defer removeTestDb(t, nil)
+
+	before, after, err := Compact(testDbFile)
+
+	assert.Nil(t, err)
+	assert.True(t, after < before, "expected %d to be less than %d", after, before)
+	dao, _ = OpenDb(testDbFile, nil)
+	defer dao.Close()
+	assert.Equal(t, "keptId", *dao.FindByPath("/kept.txt").RemoteID)
+	assert.Equal(t, len(migrations), testSchemaVersion(dao))
+}
+
+func TestBoltDao_Check(t *testing.T) {
+	expected := []string{
+		"corrupt record corruptId: unexpected EOF",
+		"missing path /folder/unindexed.txt for unindexedId",
+		"path /folder/deleted.txt refers to missing record deletedId",
+		"obsolete path /folder/moved.txt for movedId",
+	}
+	tests := []struct {
+		description string
+		fix         bool
+	}{
+		{"report problems", false},
+		{"fix problems", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dao, _ := OpenDb(testDbFile, nil)
+			defer removeTestDb(t, dao)
+			dao.Save(NewRemoteFile("folder", "folder", 0, "", nil, time.Time{}, "", "folderId"))
+			dao.Save(NewRemoteFile("moved.txt", "text/plain", 10, "checksum", []string{"folderId"}, modTime, "", "movedId"))
+			dao.Save(NewRemoteFile("deleted.txt", "text/plain", 10, "checksum", []string{"folderId"}, modTime, "", "deletedId"))
+			dao.db.Update(func(tx *bolt.Tx) error {
+				byID := tx.Bucket([]byte(byIDBucket))
+				byID.Put([]byte("corruptId"), []byte{0x0f, 0xff})
+				byID.Delete([]byte("deletedId"))
+				moved := NewRemoteFile("renamed.txt", "text/plain", 10, "checksum", []string{"folderId"}, modTime, "", "movedId")
+				byID.Put([]byte("movedId"), toBytes(moved))
+				tx.Bucket([]byte(byPathBucket)).Put([]byte("/folder/renamed.txt"), []byte("movedId"))
+				unindexed := NewRemoteFile("unindexed.txt", "text/plain", 10, "checksum", []string{"folderId"}, modTime, "", "unindexedId")
+				return byID.Put([]byte("unindexedId"), toBytes(unindexed))
+			})
+
+			problems, err := dao.Check(test.fix)
+
+			assert.Nil(t, err)
+			assert.Equal(t, expected, problems)
+			remaining, _ := dao.Check(false)
+			if test.fix {
+				assert.Empty(t, remaining)
+				assert.Equal(t, "unindexedId", *dao.FindByPath("/folder/unindexed.txt").RemoteID)
+			} else {
+				assert.Equal(t, expected, remaining)
+			}
+		})
+	}
+}
+
+func TestBoltDao_Check_EmptyDatabase(t *testing.T) {
+	dao, _ := OpenDb(testDbFile, nil)
+	defer removeTestDb(t, dao)
+
+	problems, err := dao.Check(false)
+
+	assert.Nil(t, err)
+	assert.Empty(t, problems)
+}
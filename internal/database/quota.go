@@ -0,0 +1,48 @@
+package database
+
+import (
+	bolt "github.com/coreos/bbolt"
+)
+
+const (
+	quotaBucket = "Quota"
+	uploadKey   = "upload"
+)
+
+// UploadQuota records the number of bytes uploaded on a day.
+type UploadQuota struct {
+	Day   string // local date formatted as YYYY-MM-DD
+	Bytes uint64
+}
+
+// GetUploadQuota returns the saved upload usage.  Returns nil if no usage has been saved.
+func (dao *BoltDao) GetUploadQuota() *UploadQuota {
+	var quota *UploadQuota
+	dao.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(quotaBucket)); b != nil {
+			if value := b.Get([]byte(uploadKey)); value != nil {
+				q := UploadQuota{}
+				if err := decode(value, &q); err == nil {
+					quota = &q
+				}
+			}
+		}
+		return nil
+	})
+	return quota
+}
+
+// SaveUploadQuota saves the upload usage.
+func (dao *BoltDao) SaveUploadQuota(quota *UploadQuota) error {
+	value, err := encode(quota)
+	if err != nil {
+		return err
+	}
+	return dao.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(quotaBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(uploadKey), value)
+	})
+}
@@ -0,0 +1,31 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltDao_GetUploadQuota_NotSaved(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+
+	assert.Nil(t, dao.GetUploadQuota())
+}
+
+func TestBoltDao_SaveUploadQuota(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+	quota := &UploadQuota{"2018-06-01", 12345}
+
+	err = dao.SaveUploadQuota(quota)
+
+	assert.Nil(t, err)
+	assert.Equal(t, quota, dao.GetUploadQuota())
+}
@@ -8,28 +8,39 @@ import (
 
 // Cache record for a remote file.
 type RemoteFile struct {
-	Name         string
-	MimeType     string
-	Size         uint64
-	Md5Checksum  *string
-	ParentIDs    []string // remote IDs of the file's parents
-	LastModified *string
-	LocalID      *string
-	RemoteID     *string
+	Name         string            `json:"name"`
+	MimeType     string            `json:"mimeType"`
+	Size         uint64            `json:"size"`
+	Md5Checksum  *string           `json:"md5Checksum,omitempty"`
+	ParentIDs    []string          `json:"parentIds,omitempty"` // remote IDs of the file's parents
+	LastModified *string           `json:"-"`                   // modification time in RFC 3339 format (only in records saved by old versions)
+	LocalID      *string           `json:"localId,omitempty"`
+	RemoteID     *string           `json:"remoteId"`
+	Host         *string           `json:"host,omitempty"`       // host name of the backed up file
+	LocalPath    *string           `json:"localPath,omitempty"`  // path of the backed up file
+	Mode         *uint32           `json:"mode,omitempty"`       // permissions of the backed up file, including the setuid, setgid and sticky bits
+	Uid          *uint32           `json:"uid,omitempty"`        // owner of the backed up file
+	Gid          *uint32           `json:"gid,omitempty"`        // group of the backed up file
+	RevisionID   *string           `json:"revisionId,omitempty"` // ID of the current version of the content
+	ModTime      time.Time         `json:"modTime"`              // modification time of the backed up file
+	LinkTarget   *string           `json:"linkTarget,omitempty"` // target of a symbolic link that was backed up as a link
+	AccessTime   *time.Time        `json:"accessTime,omitempty"` // access time of the backed up file
+	Xattrs       map[string][]byte `json:"xattrs,omitempty"`     // extended attributes (including ACLs) of the backed up file
+	TargetID     *string           `json:"targetId,omitempty"`   // for a hard link, the remote ID of the backup that contains its content
+	Created      *time.Time        `json:"created,omitempty"`    // time that the backup was created
 }
 
-func NewRemoteFile(name string, mimeType string, size uint64, md5Checksum string, parentIDs []string, modifiedTime string, localID string, remoteID string) *RemoteFile {
-	return &RemoteFile{name, mimeType, size, &md5Checksum, parentIDs, &modifiedTime, &localID, &remoteID}
+func NewRemoteFile(name string, mimeType string, size uint64, md5Checksum string, parentIDs []string, modTime time.Time, localID string, remoteID string) *RemoteFile {
+	return &RemoteFile{Name: name, MimeType: mimeType, Size: size, Md5Checksum: &md5Checksum, ParentIDs: parentIDs,
+		ModTime: modTime, LocalID: &localID, RemoteID: &remoteID}
 }
 
-func toRemoteFile(b []byte) *RemoteFile {
+func toRemoteFile(b []byte) (*RemoteFile, error) {
 	rf := RemoteFile{}
-	buf := bytes.NewBuffer(b)
-	dec := gob.NewDecoder(buf)
-	if err := dec.Decode(&rf); err != nil {
-		panic(err)
+	if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(&rf); err != nil {
+		return nil, err
 	}
-	return &rf
+	return &rf, nil
 }
 
 func toBytes(rf *RemoteFile) []byte {
@@ -41,10 +52,15 @@ func toBytes(rf *RemoteFile) []byte {
 	return buf.Bytes()
 }
 
-func (rf *RemoteFile) ModTime() time.Time {
-	t, err := time.Parse(time.RFC3339, *rf.LastModified)
-	if err != nil {
-		return time.Time{}
+// migrateModTime converts the modification time of a record saved by an old version.  Returns false if the record
+// does not need to be converted.
+func (rf *RemoteFile) migrateModTime() bool {
+	if rf.LastModified == nil {
+		return false
+	}
+	if t, err := time.Parse(time.RFC3339Nano, *rf.LastModified); err == nil {
+		rf.ModTime = t
 	}
-	return t
+	rf.LastModified = nil
+	return true
 }
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const (
+	revisionsBucket = "Revisions"
+	trashedBucket   = "Trashed"
+)
+
+// Revision identifies an uploaded version of a file.
+type Revision struct {
+	ID          string
+	Uploaded    time.Time // time of the upload
+	ModTime     time.Time // modification time of the local file (zero if unknown)
+	Md5Checksum string
+}
+
+// TrashedFile is the cache record for a file that was moved to the trash.
+type TrashedFile struct {
+	File    *RemoteFile
+	Paths   []string // remote paths of the file before it was trashed
+	Trashed time.Time
+}
+
+func encode(value interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(b []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(b)).Decode(value)
+}
+
+// AddRevision records an upload of a file.
+func (dao *BoltDao) AddRevision(remoteID string, rev *Revision) error {
+	return dao.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(revisionsBucket))
+		if err != nil {
+			return err
+		}
+		var revs []*Revision
+		if value := b.Get([]byte(remoteID)); value != nil {
+			if err := decode(value, &revs); err != nil {
+				return err
+			}
+		}
+		value, err := encode(append(revs, rev))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(remoteID), value)
+	})
+}
+
+// GetRevisions returns the recorded uploads of a file in the order they were added.
+func (dao *BoltDao) GetRevisions(remoteID string) []*Revision {
+	var revs []*Revision
+	dao.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(revisionsBucket)); b != nil {
+			if value := b.Get([]byte(remoteID)); value != nil {
+				return decode(value, &revs)
+			}
+		}
+		return nil
+	})
+	return revs
+}
+
+// Trash moves the record for a file to the trashed files.  The file's paths are removed.
+func (dao *BoltDao) Trash(remoteID string, trashed time.Time) error {
+	return dao.update(func(tx *boltTx) error {
+		rf := getFile(tx.byRemoteID, &remoteID)
+		if rf == nil {
+			return nil
+		}
+		paths := getPaths(tx.byRemoteID, remoteID)
+		value, err := encode(&TrashedFile{File: rf, Paths: paths, Trashed: trashed})
+		if err != nil {
+			return err
+		}
+		if err := tx.trashed.Put([]byte(remoteID), value); err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if string(tx.byRemotePath.Get([]byte(path))) == remoteID {
+				if err := tx.byRemotePath.Delete([]byte(path)); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.byRemoteID.Delete([]byte(remoteID))
+	})
+}
+
+// FindTrashedByPattern returns the records for the files trashed after the specified time that had a path matching
+// the pattern.  Patterns use the syntax of filepath.Match.  If multiple files with the same path were trashed then the
+// one that was trashed first is returned.
+func (dao *BoltDao) FindTrashedByPattern(pattern string, after time.Time) map[string]*RemoteFile {
+	files := make(map[string]*RemoteFile)
+	trashTimes := make(map[string]time.Time)
+	dao.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(trashedBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(key []byte, value []byte) error {
+			trashed := TrashedFile{}
+			if err := decode(value, &trashed); err == nil && trashed.Trashed.After(after) {
+				for _, path := range trashed.Paths {
+					if first, ok := trashTimes[path]; matchesPath(pattern, path) && (!ok || trashed.Trashed.Before(first)) {
+						files[path] = trashed.File
+						trashTimes[path] = trashed.Trashed
+					}
+				}
+			}
+			return nil
+		})
+	})
+	return files
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltDao_AddRevision(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+	rev1 := &Revision{"rev1", time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), time.Date(2018, 6, 1, 11, 0, 0, 0, time.UTC), "md5 1"}
+	rev2 := &Revision{"rev2", time.Date(2018, 6, 2, 12, 0, 0, 0, time.UTC), time.Date(2018, 6, 2, 11, 0, 0, 0, time.UTC), "md5 2"}
+
+	assert.Nil(t, dao.AddRevision("fileId", rev1))
+	assert.Nil(t, dao.AddRevision("fileId", rev2))
+
+	assert.Equal(t, []*Revision{rev1, rev2}, dao.GetRevisions("fileId"))
+	assert.Nil(t, dao.GetRevisions("otherId"))
+}
+
+func TestBoltDao_Trash(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatal("Couldn't open test.db")
+	}
+	defer removeTestDb(t, dao)
+	trashed := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	folder := NewRemoteFile("folder", "folder", 0, "", nil, time.Time{}, "", "folder")
+	file := NewRemoteFile("file.txt", "text/plain", 10, "checksum", []string{"folder"}, time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), "local ID", "file")
+	dao.Save(folder)
+	dao.Save(file)
+
+	assert.Nil(t, dao.Trash("file", trashed))
+	assert.Nil(t, dao.Trash("unknown", trashed))
+
+	assert.Nil(t, dao.FindByPath("/folder/file.txt"))
+	assert.NotNil(t, dao.FindByPath("/folder"))
+	assert.Equal(t, map[string]*RemoteFile{"/folder/file.txt": file}, dao.FindTrashedByPattern("/folder", trashed.Add(-time.Second)))
+	assert.Empty(t, dao.FindTrashedByPattern("/folder", trashed))
+	assert.Empty(t, dao.FindTrashedByPattern("/other", trashed.Add(-time.Second)))
+}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const (
+	metadataBucket   = "Metadata"
+	schemaVersionKey = "schemaVersion"
+)
+
+// migration converts the records saved using the previous version of the schema.
+type migration struct {
+	description string
+	apply       func(tx *bolt.Tx) error
+}
+
+// migrations contains the changes to the schema in the order they were made.  The schema version of a database is the
+// number of migrations that have been applied to it.
+var migrations = []migration{
+	{"store modification times as time.Time", migrateModTimes},
+}
+
+// getSchemaVersion returns the schema version of the database.  Databases created before versioning was added are
+// version 0.
+func getSchemaVersion(tx *bolt.Tx) int {
+	if b := tx.Bucket([]byte(metadataBucket)); b != nil {
+		if value := b.Get([]byte(schemaVersionKey)); value != nil {
+			return int(binary.BigEndian.Uint32(value))
+		}
+	}
+	return 0
+}
+
+// setSchemaVersion records the schema version of the database.
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
+	if err != nil {
+		return err
+	}
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(version))
+	return b.Put([]byte(schemaVersionKey), value)
+}
+
+// migrate applies the migrations that are newer than the schema version of the database.  The migrations are applied
+// in a single transaction, so the database is left unchanged if one of them fails.  Returns an error if the database
+// was created by a newer version of the daemon.
+func (dao *BoltDao) migrate() error {
+	var version int
+	dao.db.View(func(tx *bolt.Tx) error {
+		version = getSchemaVersion(tx)
+		return nil
+	})
+	if version > len(migrations) {
+		return fmt.Errorf("unsupported schema version %d (expected %d or less)", version, len(migrations))
+	}
+	if version == len(migrations) || dao.isEmpty() {
+		return nil
+	}
+	return dao.db.Update(func(tx *bolt.Tx) error {
+		for ; version < len(migrations); version++ {
+			log.Printf("Migrating %s to schema version %d: %s\n", dao.db.Path(), version+1, migrations[version].description)
+			if err := migrations[version].apply(tx); err != nil {
+				return fmt.Errorf("schema migration %d failed: %v", version+1, err)
+			}
+		}
+		return setSchemaVersion(tx, version)
+	})
+}
+
+// migrateModTimes converts the modification times of the file records from strings to time.Time.
+func migrateModTimes(tx *bolt.Tx) error {
+	byID := tx.Bucket([]byte(byIDBucket))
+	if byID == nil {
+		return nil
+	}
+	converted := make(map[string]*RemoteFile)
+	byID.ForEach(func(id []byte, value []byte) error {
+		if rf := decodeFile(string(id), value); rf != nil && rf.migrateModTime() {
+			converted[string(id)] = rf
+		}
+		return nil
+	})
+	for id, rf := range converted {
+		if err := byID.Put([]byte(id), toBytes(rf)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// setTestSchemaVersion opens test.db and sets its schema version.
+func setTestSchemaVersion(t *testing.T, version int) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatalf("Couldn't open test.db: %v", err)
+	}
+	defer dao.Close()
+	dao.Save(NewRemoteFile("name", "text/plain", 10, "checksum", nil, modTime, "local ID", "fileId"))
+	dao.db.Update(func(tx *bolt.Tx) error {
+		return setSchemaVersion(tx, version)
+	})
+}
+
+func testSchemaVersion(dao *BoltDao) (version int) {
+	dao.db.View(func(tx *bolt.Tx) error {
+		version = getSchemaVersion(tx)
+		return nil
+	})
+	return
+}
+
+// replaceMigrations replaces the migrations for a test.  Returns a function that restores the migrations.
+func replaceMigrations(replacement ...migration) func() {
+	saved := migrations
+	migrations = replacement
+	return func() { migrations = saved }
+}
+
+func TestBoltDao_update_SetsSchemaVersion(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatalf("Couldn't open test.db: %v", err)
+	}
+	defer removeTestDb(t, dao)
+
+	if version := testSchemaVersion(dao); version != 0 {
+		t.Errorf("Expected empty database to be unversioned, got %d", version)
+	}
+	dao.Save(NewRemoteFile("name", "text/plain", 10, "checksum", nil, modTime, "local ID", "fileId"))
+
+	if version := testSchemaVersion(dao); version != len(migrations) {
+		t.Errorf("Expected schema version %d, got %d", len(migrations), version)
+	}
+}
+
+func TestOpenDb_AppliesMigrations(t *testing.T) {
+	var applied []string
+	record := func(name string) func(*bolt.Tx) error {
+		return func(tx *bolt.Tx) error {
+			applied = append(applied, name)
+			return nil
+		}
+	}
+	defer replaceMigrations(migration{"first", record("first")}, migration{"second", record("second")},
+		migration{"third", record("third")})()
+	setTestSchemaVersion(t, 1)
+
+	dao, err := OpenDb(testDbFile, nil)
+	defer removeTestDb(t, dao)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(applied, []string{"second", "third"}) {
+		t.Errorf("Expected second and third migrations to be applied, got %v", applied)
+	}
+	if version := testSchemaVersion(dao); version != 3 {
+		t.Errorf("Expected schema version 3, got %d", version)
+	}
+}
+
+func TestOpenDb_MigrationFailure(t *testing.T) {
+	defer replaceMigrations(migration{"first", func(tx *bolt.Tx) error {
+		tx.DeleteBucket([]byte(byIDBucket))
+		return errors.New("failed")
+	}})()
+	setTestSchemaVersion(t, 0)
+
+	dao, err := OpenDb(testDbFile, nil)
+
+	if err == nil || err.Error() != "schema migration 1 failed: failed" {
+		removeTestDb(t, dao)
+		t.Fatalf("Expected migration error, got %v", err)
+	}
+	db, _ := bolt.Open(testDbFile, 0600, nil)
+	dao = &BoltDao{db}
+	defer removeTestDb(t, dao)
+	if version := testSchemaVersion(dao); version != 0 {
+		t.Errorf("Expected schema version to be unchanged, got %d", version)
+	}
+	if dao.FindByPath("/name") == nil {
+		t.Error("Expected migration to be rolled back")
+	}
+}
+
+func TestOpenDb_UnsupportedSchemaVersion(t *testing.T) {
+	setTestSchemaVersion(t, len(migrations)+1)
+	defer removeTestDb(t, nil)
+
+	dao, err := OpenDb(testDbFile, nil)
+
+	if err == nil {
+		dao.Close()
+		t.Fatal("Expected an error for a newer schema version")
+	}
+}
+
+func TestBoltDao_CorruptRecord(t *testing.T) {
+	dao, err := OpenDb(testDbFile, nil)
+	if err != nil {
+		t.Fatalf("Couldn't open test.db: %v", err)
+	}
+	defer removeTestDb(t, dao)
+	dao.Save(NewRemoteFile("name", "text/plain", 10, "checksum", nil, modTime, "local ID", "fileId"))
+	dao.Save(NewRemoteFile("other", "text/plain", 10, "checksum", nil, modTime, "local ID", "otherId"))
+	dao.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(byIDBucket)).Put([]byte("fileId"), []byte("not a gob"))
+	})
+
+	if rf := dao.FindByPath("/name"); rf != nil {
+		t.Errorf("Expected corrupt record to be skipped, got %v", rf)
+	}
+	if files := dao.FindByPattern("/*"); len(files) != 1 || files["/other"] == nil {
+		t.Errorf("Expected only the valid record, got %v", files)
+	}
+}
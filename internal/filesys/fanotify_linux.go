@@ -0,0 +1,382 @@
+package filesys
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const fanotifyMask = unix.FAN_CREATE | unix.FAN_CLOSE_WRITE | unix.FAN_DELETE | unix.FAN_MOVED_FROM |
+	unix.FAN_MOVED_TO | unix.FAN_ONDIR
+
+const maxCachedDirs = 10000
+
+// fanotifyFid is the header of a fanotify_event_info_fid record.  It is followed by the bytes of the file handle and
+// the name of the file.
+type fanotifyFid struct {
+	InfoType    uint8
+	Pad         uint8
+	Len         uint16
+	Fsid        unix.Fsid
+	HandleBytes uint32
+	HandleType  int32
+}
+
+const (
+	sizeofFanotifyFid      = int(unsafe.Sizeof(fanotifyFid{}))
+	sizeofFanotifyMetadata = int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+)
+
+// FanotifyWatcher uses fanotify to report changes to the files in directory trees.  The whole filesystem containing
+// each tree and each filesystem mounted inside of a tree are marked, so new subdirectories don't need to be watched
+// and there is no limit on the number of directories.  Filesystems that are mounted later are not marked.  Events
+// outside of the trees are ignored.  Requires Linux 5.9 or later (for FAN_REPORT_DFID_NAME) and the CAP_SYS_ADMIN and
+// CAP_DAC_READ_SEARCH capabilities.
+type FanotifyWatcher struct {
+	events    chan Event
+	opts      WatcherOptions
+	file      *os.File // fanotify instance
+	fd        int
+	mutex     sync.Mutex
+	roots     []string
+	mounts    map[unix.Fsid]int // directories used for opening file handles, by filesystem ID
+	dirs      map[string]string // directory paths by file handle
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFanotifyWatcher creates a fanotify watcher.  Returns an error if fanotify is not supported or the process does
+// not have the required capabilities.  Events must be read from the Events channel until the watcher is closed.
+func NewFanotifyWatcher(opts WatcherOptions) (*FanotifyWatcher, error) {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_REPORT_DFID_NAME|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK,
+		unix.O_RDONLY|unix.O_LARGEFILE)
+	if err != nil {
+		return nil, err
+	}
+	w := &FanotifyWatcher{
+		events: make(chan Event),
+		opts:   opts,
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "fanotify"),
+		mounts: make(map[unix.Fsid]int),
+		dirs:   make(map[string]string),
+		done:   make(chan struct{}),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Events returns the channel that receives the changes.
+func (w *FanotifyWatcher) Events() <-chan Event {
+	return w.events
+}
+
+// Close stops the watcher.  OnWatch is called for each of the watched trees.
+func (w *FanotifyWatcher) Close() error {
+	err := os.ErrClosed
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.file.Close()
+		w.mutex.Lock()
+		for _, fd := range w.mounts {
+			unix.Close(fd)
+		}
+		roots := w.roots
+		w.roots = nil
+		w.mutex.Unlock()
+		if w.opts.OnWatch != nil {
+			for _, root := range roots {
+				w.opts.OnWatch(root, false)
+			}
+		}
+	})
+	return err
+}
+
+// Watch marks the filesystem containing a directory and the filesystems mounted inside of the directory and reports
+// the changes in the directory and its subdirectories.  Returns an error if one of the filesystems can't be marked.
+func (w *FanotifyWatcher) Watch(root string) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory: " + root)
+	}
+	mounts, err := ReadMounts()
+	if err != nil {
+		return err
+	}
+	if err := w.mark(root); err != nil {
+		return err
+	}
+	var nested []string
+	for _, point := range treeMounts(mounts, root) {
+		if point != root && isInTree(root, point) {
+			if err := w.mark(point); err != nil {
+				return fmt.Errorf("%s: %v", point, err)
+			}
+			nested = append(nested, point)
+		}
+	}
+	if len(nested) > 0 {
+		log.Printf("Using fanotify for the mounts in %s: %s\n", root, strings.Join(nested, ", "))
+	}
+	w.mutex.Lock()
+	w.roots = append(w.roots, root)
+	w.mutex.Unlock()
+	if w.opts.OnWatch != nil {
+		w.opts.OnWatch(root, true)
+	}
+	return nil
+}
+
+// mark adds a mark for the filesystem containing a directory and keeps the directory open for resolving the file
+// handles of the filesystem.
+func (w *FanotifyWatcher) mark(dir string) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return err
+	}
+	mount, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	// make sure that directory handles can be resolved before relying on the events
+	if _, err := resolveHandle(mount, dir); err != nil {
+		unix.Close(mount)
+		return err
+	}
+	if err := unix.FanotifyMark(w.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, fanotifyMask, unix.AT_FDCWD, dir); err != nil {
+		unix.Close(mount)
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.mounts[stat.Fsid]; ok {
+		unix.Close(mount)
+	} else {
+		w.mounts[stat.Fsid] = mount
+	}
+	return nil
+}
+
+// resolveHandle returns the current path of a directory using its file handle.
+func resolveHandle(mount int, dir string) (string, error) {
+	handle, _, err := unix.NameToHandleAt(unix.AT_FDCWD, dir, 0)
+	if err != nil {
+		return "", err
+	}
+	return openHandle(mount, handle)
+}
+
+func openHandle(mount int, handle unix.FileHandle) (string, error) {
+	fd, err := unix.OpenByHandleAt(mount, handle, unix.O_PATH|unix.O_CLOEXEC)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(fd)
+	return os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+}
+
+// dirPath returns the path of the directory identified by a file handle.  Returns false if the directory no longer
+// exists or is not on a marked filesystem.
+func (w *FanotifyWatcher) dirPath(fsid unix.Fsid, handleType int32, handle []byte) (string, bool) {
+	key := string((*[8]byte)(unsafe.Pointer(&fsid))[:]) + strconv.Itoa(int(handleType)) + string(handle)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if dir, ok := w.dirs[key]; ok {
+		return dir, true
+	}
+	mount, ok := w.mounts[fsid]
+	if !ok {
+		return "", false
+	}
+	dir, err := openHandle(mount, unix.NewFileHandle(handleType, handle))
+	if err != nil || strings.HasSuffix(dir, " (deleted)") {
+		return "", false
+	}
+	if len(w.dirs) >= maxCachedDirs {
+		w.dirs = make(map[string]string)
+	}
+	w.dirs[key] = dir
+	return dir, true
+}
+
+// forgetDirs clears the cached directory paths.  Called when a directory is moved or deleted.
+func (w *FanotifyWatcher) forgetDirs() {
+	w.mutex.Lock()
+	w.dirs = make(map[string]string)
+	w.mutex.Unlock()
+}
+
+// inRoots returns true if the path is in one of the watched trees.
+func (w *FanotifyWatcher) inRoots(path string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, root := range w.roots {
+		if isInTree(root, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *FanotifyWatcher) send(event Event) {
+	select {
+	case w.events <- event:
+	case <-w.done:
+	}
+}
+
+func (w *FanotifyWatcher) readEvents() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("Error reading fanotify events: %v\n", err)
+			}
+			return
+		}
+		for offset := 0; offset+sizeofFanotifyMetadata <= n; {
+			meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+			if meta.Vers != unix.FANOTIFY_METADATA_VERSION || meta.Event_len == 0 {
+				log.Printf("Unsupported fanotify event version: %d\n", meta.Vers)
+				return
+			}
+			if meta.Fd >= 0 {
+				unix.Close(int(meta.Fd))
+			}
+			w.handle(meta.Mask, buf[offset+int(meta.Metadata_len):offset+int(meta.Event_len)])
+			offset += int(meta.Event_len)
+		}
+	}
+}
+
+// handle converts a fanotify event to Events.  info contains the information records of the event.
+func (w *FanotifyWatcher) handle(mask uint64, info []byte) {
+	if mask&unix.FAN_Q_OVERFLOW != 0 {
+		w.forgetDirs()
+		w.mutex.Lock()
+		roots := append([]string(nil), w.roots...)
+		w.mutex.Unlock()
+		for _, root := range roots {
+			w.send(Event{Rescan, root})
+		}
+		return
+	}
+	path, ok := w.eventPath(info)
+	if !ok || !w.inRoots(path) {
+		return
+	}
+	isDir := mask&unix.FAN_ONDIR != 0
+	created := mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0
+	removed := mask&(unix.FAN_DELETE|unix.FAN_MOVED_FROM) != 0
+	if removed && isDir {
+		w.forgetDirs()
+	}
+	// the kernel merges consecutive events for the same file, so use the current state to order them
+	exists := true
+	if removed {
+		_, err := os.Lstat(path)
+		exists = err == nil
+		if exists {
+			w.send(Event{Remove, path})
+		}
+	}
+	if created && exists {
+		if isDir {
+			w.send(Event{Rescan, path})
+		} else {
+			w.send(Event{Create, path})
+		}
+	}
+	if mask&unix.FAN_CLOSE_WRITE != 0 && exists && !isDir {
+		w.send(Event{Write, path})
+	}
+	if removed && !exists {
+		w.send(Event{Remove, path})
+	}
+}
+
+// eventPath returns the path of the file from the directory file handle and name in the information records of an
+// event.
+func (w *FanotifyWatcher) eventPath(info []byte) (string, bool) {
+	for offset := 0; offset+sizeofFanotifyFid <= len(info); {
+		fid := (*fanotifyFid)(unsafe.Pointer(&info[offset]))
+		if fid.Len == 0 {
+			break
+		}
+		end := offset + int(fid.Len)
+		if fid.InfoType == unix.FAN_EVENT_INFO_TYPE_DFID_NAME && end <= len(info) {
+			start := offset + sizeofFanotifyFid
+			handle := info[start : start+int(fid.HandleBytes)]
+			name := strings.TrimRight(string(info[start+int(fid.HandleBytes):end]), "\x00")
+			dir, ok := w.dirPath(fid.Fsid, fid.HandleType, handle)
+			if !ok {
+				return "", false
+			}
+			if name == "." {
+				return dir, true
+			}
+			return filepath.Join(dir, name), true
+		}
+		offset = end
+	}
+	return "", false
+}
+
+// NewFileWatcher creates a watcher for directory trees.  If opts.Fanotify is true then fanotify is used if it is
+// available and all of the filesystems in the trees can be marked, otherwise inotify is used.  If one of the trees
+// cannot be watched then the inotify watcher is returned with the error.  Events must be read from the Events channel until the watcher is closed.
+func NewFileWatcher(opts WatcherOptions, roots ...string) (FileWatcher, error) {
+	if opts.Fanotify {
+		w, err := newFanotifyTrees(opts, roots)
+		if err == nil {
+			return w, nil
+		}
+		log.Printf("Unable to use fanotify (%v), using inotify instead\n", err)
+	}
+	w, err := NewWatcher(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		if err := w.Watch(root); err != nil {
+			return w, err
+		}
+	}
+	return w, nil
+}
+
+func newFanotifyTrees(opts WatcherOptions, roots []string) (*FanotifyWatcher, error) {
+	// don't report the watches until all of the trees have been marked
+	onWatch := opts.OnWatch
+	opts.OnWatch = nil
+	w, err := NewFanotifyWatcher(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		if err := w.Watch(root); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	if onWatch != nil {
+		w.opts.OnWatch = onWatch
+		for _, root := range roots {
+			onWatch(root, true)
+		}
+	}
+	return w, nil
+}
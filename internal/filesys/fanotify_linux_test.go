@@ -0,0 +1,172 @@
+package filesys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// newTestFanotifyWatcher creates a watcher for a temporary directory.  Skips the test if fanotify is not available.
+func newTestFanotifyWatcher(t *testing.T, opts WatcherOptions) (*FanotifyWatcher, string) {
+	root, _ := ioutil.TempDir("", "fanotify")
+	w, err := NewFanotifyWatcher(opts)
+	if err == nil {
+		if err = w.Watch(root); err != nil {
+			w.Close()
+		}
+	}
+	if err != nil {
+		os.RemoveAll(root)
+		t.Skipf("fanotify is not available: %v", err)
+	}
+	return w, root
+}
+
+func TestFanotifyWatcher_FileEvents(t *testing.T) {
+	w, root := newTestFanotifyWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(root)
+	defer w.Close()
+	os.MkdirAll(filepath.Join(root, "dir"), 0755)
+	path := filepath.Join(root, "dir", "file.txt")
+
+	go ioutil.WriteFile(path, []byte("file"), 0644)
+	assert.True(t, waitFor(w, Event{Create, path}), "expected create event")
+	assert.True(t, waitFor(w, Event{Write, path}), "expected write event")
+
+	go os.Rename(path, filepath.Join(root, "moved.txt"))
+	assert.True(t, waitFor(w, Event{Remove, path}), "expected remove event for old path")
+	assert.True(t, waitFor(w, Event{Create, filepath.Join(root, "moved.txt")}), "expected create event for new path")
+
+	go os.Remove(filepath.Join(root, "moved.txt"))
+	assert.True(t, waitFor(w, Event{Remove, filepath.Join(root, "moved.txt")}), "expected remove event")
+}
+
+func TestFanotifyWatcher_Directories(t *testing.T) {
+	w, root := newTestFanotifyWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(root)
+	defer w.Close()
+	dir := filepath.Join(root, "new")
+
+	go os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	assert.True(t, waitFor(w, Event{Rescan, dir}), "expected rescan of new directory")
+	assert.True(t, waitFor(w, Event{Rescan, filepath.Join(dir, "sub")}), "expected rescan of new subdirectory")
+	go ioutil.WriteFile(filepath.Join(dir, "sub", "file.txt"), []byte("file"), 0644)
+	assert.True(t, waitFor(w, Event{Write, filepath.Join(dir, "sub", "file.txt")}), "expected write event in new directory")
+
+	go os.Rename(dir, filepath.Join(root, "renamed"))
+	assert.True(t, waitFor(w, Event{Remove, dir}), "expected remove event for directory")
+	go ioutil.WriteFile(filepath.Join(root, "renamed", "sub", "file.txt"), []byte("file"), 0644)
+	assert.True(t, waitFor(w, Event{Write, filepath.Join(root, "renamed", "sub", "file.txt")}),
+		"expected write event in renamed directory")
+}
+
+func TestFanotifyWatcher_IgnoresOtherDirectories(t *testing.T) {
+	w, root := newTestFanotifyWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(root)
+	defer w.Close()
+	other, _ := ioutil.TempDir("", "other")
+	defer os.RemoveAll(other)
+
+	go func() {
+		ioutil.WriteFile(filepath.Join(other, "file.txt"), []byte("file"), 0644)
+		ioutil.WriteFile(filepath.Join(root, "file.txt"), []byte("file"), 0644)
+	}()
+
+	assert.Equal(t, Event{Create, filepath.Join(root, "file.txt")}, <-w.Events())
+}
+
+func TestFanotifyWatcher_handle_Overflow(t *testing.T) {
+	w, root := newTestFanotifyWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(root)
+	defer w.Close()
+
+	go w.handle(unix.FAN_Q_OVERFLOW, nil)
+
+	assert.True(t, waitFor(w, Event{Rescan, root}), "expected rescan after overflow")
+}
+
+func TestNewFileWatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		fanotify bool
+	}{
+		{"inotify", false},
+		{"fanotify or fallback to inotify", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var watched []string
+			root, _ := ioutil.TempDir("", "watcher")
+			defer os.RemoveAll(root)
+			opts := WatcherOptions{Fanotify: test.fanotify, OnWatch: func(dir string, added bool) {
+				watched = append(watched, dir)
+			}}
+
+			w, err := NewFileWatcher(opts, root)
+			defer w.Close()
+
+			assert.Nil(t, err)
+			if !test.fanotify {
+				assert.IsType(t, &Watcher{}, w)
+			}
+			assert.Equal(t, []string{root}, watched)
+			path := filepath.Join(root, "file.txt")
+			go ioutil.WriteFile(path, []byte("file"), 0644)
+			assert.True(t, waitFor(w, Event{Write, path}), "expected write event")
+		})
+	}
+}
+
+func TestNewFileWatcher_MissingDirectory(t *testing.T) {
+	root, _ := ioutil.TempDir("", "watcher")
+	os.RemoveAll(root)
+
+	w, err := NewFileWatcher(WatcherOptions{Fanotify: true}, root)
+	defer w.Close()
+
+	assert.IsType(t, &Watcher{}, w)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFanotifyWatcher_NestedMount(t *testing.T) {
+	w, root := newTestFanotifyWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(root)
+	w.Close()
+	mnt := filepath.Join(root, "mnt")
+	os.Mkdir(mnt, 0755)
+	if err := unix.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("unable to mount tmpfs: %v", err)
+	}
+	defer unix.Unmount(mnt, unix.MNT_DETACH)
+	w, err := NewFanotifyWatcher(WatcherOptions{})
+	assert.Nil(t, err)
+	defer w.Close()
+
+	assert.Nil(t, w.Watch(root))
+
+	path := filepath.Join(mnt, "file.txt")
+	go ioutil.WriteFile(path, []byte("file"), 0644)
+	assert.True(t, waitFor(w, Event{Write, path}), "expected write event in the nested mount")
+}
+
+func TestNewFileWatcher_UnmarkedMount(t *testing.T) {
+	root, _ := ioutil.TempDir("", "watcher")
+	defer os.RemoveAll(root)
+	originalPath := mountInfoPath
+	defer func() {
+		mountInfoPath = originalPath
+	}()
+	mountInfoPath = filepath.Join(root, "mountinfo")
+	ioutil.WriteFile(mountInfoPath, []byte("36 35 98:0 / "+root+"/missing rw - tmpfs tmpfs rw\n"), 0644)
+
+	w, err := NewFileWatcher(WatcherOptions{Fanotify: true}, root)
+	defer w.Close()
+
+	assert.Nil(t, err)
+	assert.IsType(t, &Watcher{}, w)
+}
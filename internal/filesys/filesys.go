@@ -5,13 +5,22 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 // FileInfo contains information about a local file.
 type FileInfo struct {
-	fsID string
-	ino  uint64
-	size uint64
+	fsID       string
+	ino        uint64
+	size       uint64
+	links      uint64
+	mode       os.FileMode
+	uid        uint32
+	gid        uint32
+	modTime    time.Time
+	accessTime time.Time
+	changeTime time.Time
 }
 
 // ID returns a unique identifier for the file.
@@ -19,12 +28,53 @@ func (info *FileInfo) ID() string {
 	return fmt.Sprintf("%s-%016x", info.fsID, info.ino)
 }
 
+// IDFileSystem returns the ID of the filesystem (see FileSystemID) from a file ID returned by FileInfo.ID.
+func IDFileSystem(id string) string {
+	return strings.SplitN(id, "-", 2)[0]
+}
+
 // Size returns the size of the file in bytes.
 func (info *FileInfo) Size() uint64 {
 	return info.size
 }
 
-// ListDirectories writes directories starting with path to the provided channel.
+// Links returns the number of hard links to the file.
+func (info *FileInfo) Links() uint64 {
+	return info.links
+}
+
+// Mode returns the file's type and permission bits.
+func (info *FileInfo) Mode() os.FileMode {
+	return info.mode
+}
+
+// Uid returns the user ID of the file's owner.
+func (info *FileInfo) Uid() uint32 {
+	return info.uid
+}
+
+// Gid returns the group ID of the file's group.
+func (info *FileInfo) Gid() uint32 {
+	return info.gid
+}
+
+// ModTime returns the time that the file's content was last modified.
+func (info *FileInfo) ModTime() time.Time {
+	return info.modTime
+}
+
+// AccessTime returns the time that the file was last read.
+func (info *FileInfo) AccessTime() time.Time {
+	return info.accessTime
+}
+
+// ChangeTime returns the time that the file's content or attributes were last changed.
+func (info *FileInfo) ChangeTime() time.Time {
+	return info.changeTime
+}
+
+// ListDirectories writes directories starting with path to the provided channel.  Directories that cannot be read are
+// logged and skipped.  See Walk for a concurrent alternative.
 func ListDirectories(path string, ch chan string) {
 	stat, err := os.Lstat(path)
 	if err != nil {
@@ -39,7 +89,7 @@ func ListDirectories(path string, ch chan string) {
 				stack = stack[1:]
 				dirs, err := listDirs(path, ch)
 				if err != nil {
-					log.Fatal(err)
+					log.Printf("Error reading %s: %v\n", path, err)
 				}
 				stack = append(stack, dirs...)
 			}
@@ -69,3 +119,8 @@ func listDirs(path string, ch chan string) ([]string, error) {
 	}
 	return dirs, nil
 }
+
+// isInTree returns true if path is root or a path below root.
+func isInTree(root string, path string) bool {
+	return path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
@@ -13,7 +13,7 @@ func TestListDirectories(t *testing.T) {
 		expected    []string
 	}{
 		{"directory", "..", []string{
-			"..", "../database", "../backend", "../config", "../filesys", "../database/testdata",
+			"..", "../database", "../backend", "../config", "../filesys", "../metrics", "../database/testdata",
 			"../backend/testdata", "../config/testdata", "../backend/testdata/.auth"}},
 		{"file", "filesys.go", []string{}},
 		{"unknown", "x", []string{}},
@@ -29,18 +29,14 @@ func TestListDirectories(t *testing.T) {
 			for d := range dirs {
 				result = append(result, d)
 			}
-			assert.Equal(t, len(test.expected), len(result), "Directory count mismatch")
-			if len(result) == len(test.expected) {
-				for i, d := range result {
-					assert.Equal(t, test.expected[i], d)
-				}
-			}
+			// Readdir order depends on the file system
+			assert.ElementsMatch(t, test.expected, result, "Directory list mismatch")
 		})
 	}
 }
 
 func TestFileInfo_String(t *testing.T) {
-	info := &FileInfo{"file sys ID", 0xdeadbeefabacab, 0}
+	info := &FileInfo{fsID: "file sys ID", ino: 0xdeadbeefabacab}
 
 	if info.ID() != "file sys ID-00deadbeefabacab" {
 		t.Errorf("Wrong format for file ID: %s", info.ID())
@@ -0,0 +1,207 @@
+package filesys
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var mountInfoPath = "/proc/self/mountinfo"
+
+// Mount describes a mounted filesystem.
+type Mount struct {
+	Point  string // path of the mount point
+	FSType string
+	Source string // device or remote share
+}
+
+// ReadMounts returns the mounted filesystems.
+func ReadMounts() ([]Mount, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseMounts(file)
+}
+
+// parseMounts reads the mounted filesystems in the format of /proc/self/mountinfo.
+func parseMounts(r io.Reader) ([]Mount, error) {
+	var mounts []Mount
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		separator := 6
+		for separator < len(fields) && fields[separator] != "-" {
+			separator++
+		}
+		if len(fields) < 5 || separator+2 >= len(fields) {
+			return nil, fmt.Errorf("invalid mount info: %s", scanner.Text())
+		}
+		mounts = append(mounts, Mount{
+			Point:  unescapeMountField(fields[4]),
+			FSType: fields[separator+1],
+			Source: unescapeMountField(fields[separator+2]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountField replaces the octal escapes used for spaces, tabs, newlines and backslashes.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// MountState identifies the filesystems that a directory tree is stored on: the filesystem IDs by mount point for
+// the mount containing the root of the tree and the mounts inside of the tree.
+type MountState map[string]string
+
+// NewMountState returns the filesystems of a directory tree.  Mount points that cannot be read are omitted.
+func NewMountState(mounts []Mount, root string) MountState {
+	state := make(MountState)
+	for _, point := range treeMounts(mounts, root) {
+		if info, err := Stat(point); err == nil {
+			state[point] = info.fsID
+		}
+	}
+	return state
+}
+
+// treeMounts returns the mount point containing root and the mount points inside of root.
+func treeMounts(mounts []Mount, root string) []string {
+	var parent string
+	points := make(map[string]bool)
+	for _, m := range mounts {
+		if isInTree(m.Point, root) && len(m.Point) > len(parent) {
+			parent = m.Point
+		} else if isInTree(root, m.Point) {
+			points[m.Point] = true
+		}
+	}
+	if parent != "" {
+		points[parent] = true
+	}
+	sorted := make([]string, 0, len(points))
+	for point := range points {
+		sorted = append(sorted, point)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// Missing returns the mount points that are not in other or have a different filesystem in other.
+func (s MountState) Missing(other MountState) []string {
+	var points []string
+	for point, fsID := range s {
+		if other[point] != fsID {
+			points = append(points, point)
+		}
+	}
+	sort.Strings(points)
+	return points
+}
+
+// MountWatcher reports changes to the mounted filesystems.
+type MountWatcher struct {
+	mounts    chan []Mount
+	file      *os.File
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMountWatcher creates a watcher for the mount table.  The current mounts are sent to the Mounts channel after
+// each change.
+func NewMountWatcher() (*MountWatcher, error) {
+	// os.Open would add the file to the runtime's poller, which would consume the change notifications
+	fd, err := unix.Open(mountInfoPath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), mountInfoPath)
+	w := &MountWatcher{mounts: make(chan []Mount), file: file, done: make(chan struct{})}
+	if _, err := parseMounts(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	go w.run(fd)
+	return w, nil
+}
+
+// Mounts returns the channel that receives the mounted filesystems.
+func (w *MountWatcher) Mounts() <-chan []Mount {
+	return w.mounts
+}
+
+// Close stops the watcher.
+func (w *MountWatcher) Close() error {
+	err := os.ErrClosed
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = nil
+	})
+	return err
+}
+
+// run waits for changes to the mount table.  The kernel signals a change with POLLPRI on the mountinfo file.
+func (w *MountWatcher) run(fd int) {
+	defer w.file.Close()
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLPRI}}
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		n, err := unix.Poll(fds, 1000)
+		if err != nil {
+			if !errors.Is(err, unix.EINTR) {
+				log.Printf("Error waiting for mount changes: %v\n", err)
+				return
+			}
+			continue
+		}
+		if n == 0 || fds[0].Revents&(unix.POLLPRI|unix.POLLERR) == 0 {
+			continue
+		}
+		mounts, err := w.read()
+		if err != nil {
+			log.Printf("Error reading mounts: %v\n", err)
+			continue
+		}
+		select {
+		case w.mounts <- mounts:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *MountWatcher) read() ([]Mount, error) {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return parseMounts(w.file)
+}
@@ -0,0 +1,100 @@
+package filesys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMountInfo = `21 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+22 21 0:20 / /proc rw,nosuid - proc proc rw
+40 21 8:17 / /media/me/USB\040Disk rw,relatime shared:20 master:1 - vfat /dev/sdb1 rw
+41 21 0:45 / /home/me/nfs rw,relatime - nfs4 server:/export rw
+`
+
+func TestParseMounts(t *testing.T) {
+	mounts, err := parseMounts(strings.NewReader(testMountInfo))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []Mount{
+		{"/", "ext4", "/dev/sda1"},
+		{"/proc", "proc", "proc"},
+		{"/media/me/USB Disk", "vfat", "/dev/sdb1"},
+		{"/home/me/nfs", "nfs4", "server:/export"},
+	}, mounts)
+}
+
+func TestParseMounts_Invalid(t *testing.T) {
+	_, err := parseMounts(strings.NewReader("21 1 8:1 / / rw\n"))
+
+	assert.EqualError(t, err, "invalid mount info: 21 1 8:1 / / rw")
+}
+
+func TestReadMounts(t *testing.T) {
+	mounts, err := ReadMounts()
+
+	assert.Nil(t, err)
+	assert.Contains(t, treeMounts(mounts, "/"), "/")
+}
+
+func TestTreeMounts(t *testing.T) {
+	mounts, _ := parseMounts(strings.NewReader(testMountInfo))
+	tests := []struct {
+		root     string
+		expected []string
+	}{
+		{"/home/me", []string{"/", "/home/me/nfs"}},
+		{"/home/me/nfs/dir", []string{"/home/me/nfs"}},
+		{"/media/me/USB Disk", []string{"/media/me/USB Disk"}},
+		{"/home/meet", []string{"/"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.root, func(t *testing.T) {
+			assert.Equal(t, test.expected, treeMounts(mounts, test.root))
+		})
+	}
+}
+
+func TestNewMountState(t *testing.T) {
+	root, _ := ioutil.TempDir("", "mounts")
+	defer os.RemoveAll(root)
+	info, _ := Stat(root)
+	mounts := []Mount{{Point: "/"}, {Point: root}, {Point: filepath.Join(root, "missing")}}
+
+	state := NewMountState(mounts, root)
+
+	assert.Equal(t, MountState{root: info.fsID}, state)
+}
+
+func TestMountState_Missing(t *testing.T) {
+	state := MountState{"/": "root", "/home/me/nfs": "nfs"}
+	tests := []struct {
+		name     string
+		other    MountState
+		expected []string
+	}{
+		{"same filesystems", MountState{"/": "root", "/home/me/nfs": "nfs"}, nil},
+		{"unmounted", MountState{"/": "root"}, []string{"/home/me/nfs"}},
+		{"different filesystem", MountState{"/": "root", "/home/me/nfs": "other"}, []string{"/home/me/nfs"}},
+		{"additional mount", MountState{"/": "root", "/home/me/nfs": "nfs", "/home/me/usb": "usb"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, state.Missing(test.other))
+		})
+	}
+}
+
+func TestMountWatcher_Close(t *testing.T) {
+	w, err := NewMountWatcher()
+
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	assert.Equal(t, os.ErrClosed, w.Close())
+}
@@ -1,21 +1,164 @@
 package filesys
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-// Stat returns information about a local file.
+// Stat returns information about a local file.  Symbolic links are followed.
 func Stat(path string) (*FileInfo, error) {
 	var finfo unix.Stat_t
 	if err := unix.Stat(path, &finfo); err != nil {
 		return nil, err
 	}
+	return newFileInfo(path, &finfo)
+}
+
+// Lstat returns information about a local file.  If the file is a symbolic link then the information describes the
+// link instead of the file that it points to.
+func Lstat(path string) (*FileInfo, error) {
+	var finfo unix.Stat_t
+	if err := unix.Lstat(path, &finfo); err != nil {
+		return nil, err
+	}
+	if finfo.Mode&unix.S_IFMT == unix.S_IFLNK {
+		// statfs follows links, so use the directory containing the link
+		return newFileInfo(filepath.Dir(path), &finfo)
+	}
+	return newFileInfo(path, &finfo)
+}
+
+// newFileInfo combines the status of a file with the ID of the filesystem containing fsPath.
+func newFileInfo(fsPath string, finfo *unix.Stat_t) (*FileInfo, error) {
+	fsID, err := FileSystemID(fsPath)
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{fsID: fsID, ino: finfo.Ino, size: uint64(finfo.Size), links: uint64(finfo.Nlink),
+		mode: fileMode(finfo.Mode), uid: finfo.Uid, gid: finfo.Gid, modTime: time.Unix(finfo.Mtim.Unix()),
+		accessTime: time.Unix(finfo.Atim.Unix()), changeTime: time.Unix(finfo.Ctim.Unix())}, nil
+}
+
+// FileSystemID returns the ID of the filesystem containing a file.  Symbolic links are followed.
+func FileSystemID(path string) (string, error) {
 	var fsinfo unix.Statfs_t
 	if err := unix.Statfs(path, &fsinfo); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08x%08x", uint32(fsinfo.Fsid.X__val[0]), uint32(fsinfo.Fsid.X__val[1])), nil
+}
+
+// fileMode converts the mode from stat(2) in the same way as os.Stat.
+func fileMode(mode uint32) os.FileMode {
+	fm := os.FileMode(mode & 0777)
+	switch mode & unix.S_IFMT {
+	case unix.S_IFBLK:
+		fm |= os.ModeDevice
+	case unix.S_IFCHR:
+		fm |= os.ModeDevice | os.ModeCharDevice
+	case unix.S_IFDIR:
+		fm |= os.ModeDir
+	case unix.S_IFIFO:
+		fm |= os.ModeNamedPipe
+	case unix.S_IFLNK:
+		fm |= os.ModeSymlink
+	case unix.S_IFSOCK:
+		fm |= os.ModeSocket
+	}
+	if mode&unix.S_ISUID != 0 {
+		fm |= os.ModeSetuid
+	}
+	if mode&unix.S_ISGID != 0 {
+		fm |= os.ModeSetgid
+	}
+	if mode&unix.S_ISVTX != 0 {
+		fm |= os.ModeSticky
+	}
+	return fm
+}
+
+// GetXattrs returns the extended attributes of a file.  POSIX ACLs are included as the system.posix_acl_access and
+// system.posix_acl_default attributes.  Returns nil if the file has no extended attributes or the filesystem doesn't
+// support them.  Symbolic links are followed.
+func GetXattrs(path string) (map[string][]byte, error) {
+	return readXattrs(path, unix.Listxattr, unix.Getxattr)
+}
+
+// LgetXattrs returns the extended attributes of a file like GetXattrs.  If the file is a symbolic link then the
+// attributes of the link are returned instead of the attributes of the file that it points to.
+func LgetXattrs(path string) (map[string][]byte, error) {
+	return readXattrs(path, unix.Llistxattr, unix.Lgetxattr)
+}
+
+// readXattrs returns the extended attributes of a file.  Returns nil if the filesystem does not support extended
+// attributes.  Attributes that are removed while they are being read are omitted.
+func readXattrs(path string, list func(string, []byte) (int, error),
+	get func(string, string, []byte) (int, error)) (map[string][]byte, error) {
+	names, err := readXattr(func(buf []byte) (int, error) { return list(path, buf) })
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
 		return nil, err
 	}
-	fsID := fmt.Sprintf("%08x%08x", uint32(fsinfo.Fsid.X__val[0]), uint32(fsinfo.Fsid.X__val[1]))
-	return &FileInfo{fsID, finfo.Ino, uint64(finfo.Size)}, nil
+	var xattrs map[string][]byte
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := readXattr(func(buf []byte) (int, error) { return get(path, name, buf) })
+		if errors.Is(err, unix.ENODATA) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+// readXattr calls an xattr function with a buffer that is large enough for the result.
+func readXattr(call func([]byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := call(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := call(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue // grew since the size was checked
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// SetXattrs sets the extended attributes of a file.  Symbolic links are not followed.  Attributes that are not
+// supported by the filesystem or that the process is not permitted to set are skipped and returned as the result.
+func SetXattrs(path string, xattrs map[string][]byte) (skipped []string, err error) {
+	for name, value := range xattrs {
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+				skipped = append(skipped, name)
+				continue
+			}
+			return nil, &os.PathError{Op: "setxattr " + name, Path: path, Err: err}
+		}
+	}
+	sort.Strings(skipped)
+	return skipped, nil
 }
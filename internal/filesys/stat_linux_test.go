@@ -1,9 +1,13 @@
 package filesys
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func TestStat(t *testing.T) {
@@ -12,6 +16,14 @@ func TestStat(t *testing.T) {
 	assert.Nil(t, err, "Unexpected error")
 	assert.Equal(t, 16, len(info.fsID), "Expected FsID to be 16 chars")
 	assert.NotEqual(t, 0, info.Size())
+	stat, _ := os.Stat("filesys.go")
+	assert.True(t, stat.ModTime().Equal(info.ModTime()), "Expected ModTime to match os.Stat")
+	assert.False(t, info.ChangeTime().IsZero())
+	assert.False(t, info.AccessTime().IsZero())
+	assert.Equal(t, stat.Mode(), info.Mode())
+	assert.Equal(t, uint32(os.Getuid()), info.Uid())
+	assert.Equal(t, uint32(os.Getgid()), info.Gid())
+	assert.Equal(t, uint64(1), info.Links())
 
 	_, err = Stat("x")
 
@@ -19,3 +31,72 @@ func TestStat(t *testing.T) {
 		t.Errorf("Expected error for unknown file")
 	}
 }
+
+func TestLstat(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lstat")
+	defer os.RemoveAll(dir)
+	os.Symlink("missing.txt", filepath.Join(dir, "link"))
+	os.Symlink(filepath.Join(dir, "link"), filepath.Join(dir, "other"))
+
+	info, err := Lstat(filepath.Join(dir, "link"))
+	other, _ := Lstat(filepath.Join(dir, "other"))
+
+	assert.Nil(t, err, "Unexpected error")
+	assert.Equal(t, uint64(len("missing.txt")), info.Size())
+	assert.NotEqual(t, info.ID(), other.ID())
+	_, err = Stat(filepath.Join(dir, "link"))
+	assert.True(t, os.IsNotExist(err), "Stat should follow the link")
+}
+
+func TestFileSystemID(t *testing.T) {
+	info, _ := Stat("filesys.go")
+
+	fsID, err := FileSystemID(".")
+
+	assert.Nil(t, err, "Unexpected error")
+	assert.Equal(t, info.fsID, fsID)
+	assert.Equal(t, fsID, IDFileSystem(info.ID()))
+	_, err = FileSystemID("x")
+	assert.True(t, os.IsNotExist(err), "Expected not exist error")
+}
+
+func TestGetXattrs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "xattr")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file.txt")
+	ioutil.WriteFile(path, []byte("file"), 0644)
+	if err := unix.Setxattr(path, "user.test", []byte("value"), 0); err != nil {
+		t.Skipf("extended attributes are not supported: %v", err)
+	}
+	unix.Setxattr(path, "user.empty", nil, 0)
+
+	xattrs, err := GetXattrs(path)
+
+	assert.Nil(t, err, "Unexpected error")
+	assert.Equal(t, []byte("value"), xattrs["user.test"])
+	assert.Contains(t, xattrs, "user.empty")
+	link := filepath.Join(dir, "link")
+	os.Symlink(path, link)
+	xattrs, err = LgetXattrs(link)
+	assert.Nil(t, err, "Unexpected error")
+	assert.NotContains(t, xattrs, "user.test", "LgetXattrs should not follow the link")
+}
+
+func TestSetXattrs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "xattr")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file.txt")
+	ioutil.WriteFile(path, []byte("file"), 0644)
+	if err := unix.Setxattr(path, "user.probe", []byte("probe"), 0); err != nil {
+		t.Skipf("extended attributes are not supported: %v", err)
+	}
+
+	skipped, err := SetXattrs(path, map[string][]byte{"user.test": []byte("value"), "trusted.test": []byte("value")})
+
+	assert.Nil(t, err, "Unexpected error")
+	xattrs, _ := GetXattrs(path)
+	assert.Equal(t, []byte("value"), xattrs["user.test"])
+	if os.Geteuid() != 0 {
+		assert.Equal(t, []string{"trusted.test"}, skipped)
+	}
+}
@@ -0,0 +1,233 @@
+package filesys
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	defaultWalkWorkers = 4
+	readDirBatch       = 1024
+)
+
+// ErrSymlinkLoop is reported for a symbolic link that points to one of the directories containing it.
+var ErrSymlinkLoop = errors.New("symbolic link loop")
+
+// WalkOptions configures Walk.
+type WalkOptions struct {
+	Workers     int                                     // number of goroutines reading directories (default 4)
+	Exclude     func(path string, typ os.FileMode) bool // returns true for entries to skip (optional)
+	FollowLinks bool                                    // report the targets of symbolic links instead of the links
+	Boundary    string                                  // links are only followed to targets in this tree (default root)
+	Sort        bool                                    // read the entries of each directory in lexical order
+}
+
+// WalkFunc is called by Walk for each file or directory.  typ contains the type bits of the entry's mode.  If err is
+// not nil then the entry could not be read.  For a directory, the error may be reported after some of its entries.
+type WalkFunc func(path string, typ os.FileMode, err error)
+
+// Walk calls fn for root and the files and directories below it.  Directories are read by a fixed number of workers
+// (opts.Workers) taking them from a shared queue.  The entries are not sorted, so fn is called in no particular order
+// and must be safe for concurrent use.  With a single worker, directories are read in breadth first order, and with
+// opts.Sort as well, fn is called in a deterministic order.  Entry types are taken
+// from the directory listing where the filesystem provides them (d_type), so most entries don't need to be stat'ed.
+// Excluded directories are not read.  Symbolic links are not followed unless opts.FollowLinks is true, in which case a
+// link is reported with the type of its target and a link to a directory is walked like a subdirectory.  Links whose
+// targets are missing or outside of opts.Boundary are skipped and links to a directory containing the link are
+// reported with ErrSymlinkLoop.  Errors are passed to fn instead of stopping the walk.
+func Walk(root string, opts WalkOptions, fn WalkFunc) {
+	info, err := os.Lstat(root)
+	if err != nil {
+		fn(root, 0, err)
+		return
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = defaultWalkWorkers
+	}
+	w := &walker{opts: opts, fn: fn}
+	w.ready = sync.NewCond(&w.mutex)
+	if opts.FollowLinks {
+		boundary := opts.Boundary
+		if boundary == "" {
+			boundary = root
+		}
+		if w.boundary, err = filepath.EvalSymlinks(boundary); err != nil {
+			fn(boundary, os.ModeDir, err)
+			return
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info = w.target(root, nil); info == nil {
+				return
+			}
+		}
+	}
+	typ := info.Mode().Type()
+	if opts.Exclude != nil && opts.Exclude(root, typ) {
+		return
+	}
+	fn(root, typ, nil)
+	if !info.IsDir() {
+		return
+	}
+	var ancestors []os.FileInfo
+	if opts.FollowLinks {
+		ancestors = []os.FileInfo{info}
+	}
+	w.push(dirTask{root, ancestors})
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+	wg.Wait()
+}
+
+// dirTask is a directory waiting to be read.  When links are followed, ancestors contains the directories on the path
+// from the root to dir, for detecting loops.
+type dirTask struct {
+	dir       string
+	ancestors []os.FileInfo
+}
+
+type walker struct {
+	opts     WalkOptions
+	fn       WalkFunc
+	boundary string // resolved path of the tree that links may point to
+	mutex    sync.Mutex
+	ready    *sync.Cond // signaled when a directory is queued or the walk is finished
+	queue    []dirTask  // directories waiting to be read, in breadth first order
+	pending  int        // number of directories that are queued or being read
+}
+
+// work reads directories from the queue until all of the directories have been read.
+func (w *walker) work() {
+	for {
+		task, ok := w.next()
+		if !ok {
+			return
+		}
+		w.readDir(task.dir, task.ancestors)
+		w.done()
+	}
+}
+
+// push adds a directory to the queue.
+func (w *walker) push(task dirTask) {
+	w.mutex.Lock()
+	w.queue = append(w.queue, task)
+	w.pending++
+	w.mutex.Unlock()
+	w.ready.Signal()
+}
+
+// next removes a directory from the queue, waiting for one to be added if other directories are still being read.
+// Returns false when all of the directories have been read.
+func (w *walker) next() (dirTask, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for len(w.queue) == 0 && w.pending > 0 {
+		w.ready.Wait()
+	}
+	if len(w.queue) == 0 {
+		return dirTask{}, false
+	}
+	task := w.queue[0]
+	w.queue = w.queue[1:]
+	return task, true
+}
+
+// done records that a directory has been read.
+func (w *walker) done() {
+	w.mutex.Lock()
+	w.pending--
+	if w.pending == 0 {
+		w.ready.Broadcast()
+	}
+	w.mutex.Unlock()
+}
+
+// readDir processes the entries of a directory.  Subdirectories are added to the queue.
+func (w *walker) readDir(dir string, ancestors []os.FileInfo) {
+	f, err := os.Open(dir)
+	if err != nil {
+		w.fn(dir, os.ModeDir, err)
+		return
+	}
+	defer f.Close()
+	batch := readDirBatch
+	if w.opts.Sort {
+		batch = -1
+	}
+	for {
+		entries, err := f.ReadDir(batch)
+		if w.opts.Sort {
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+			if err == nil {
+				err = io.EOF
+			}
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			typ := entry.Type()
+			if w.opts.Exclude != nil && w.opts.Exclude(path, typ) {
+				continue
+			}
+			var info os.FileInfo
+			if w.opts.FollowLinks && typ&os.ModeSymlink != 0 {
+				if info = w.target(path, ancestors); info == nil {
+					continue
+				}
+				typ = info.Mode().Type()
+			} else if w.opts.FollowLinks && typ.IsDir() {
+				var infoErr error
+				if info, infoErr = entry.Info(); infoErr != nil {
+					w.fn(path, typ, infoErr)
+					continue
+				}
+			}
+			w.fn(path, typ, nil)
+			if typ.IsDir() {
+				w.push(dirTask{path, append(ancestors[:len(ancestors):len(ancestors)], info)})
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			w.fn(dir, os.ModeDir, err)
+			return
+		}
+	}
+}
+
+// target returns the status of the file or directory that a link points to.  Returns nil if the link should be
+// skipped.
+func (w *walker) target(path string, ancestors []os.FileInfo) os.FileInfo {
+	info, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			w.fn(path, os.ModeSymlink, err)
+		}
+		return nil
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err != nil || !isInTree(w.boundary, resolved) {
+		return nil
+	}
+	if info.IsDir() {
+		for _, ancestor := range ancestors {
+			if os.SameFile(info, ancestor) {
+				w.fn(path, os.ModeSymlink, ErrSymlinkLoop)
+				return nil
+			}
+		}
+	}
+	return info
+}
@@ -0,0 +1,199 @@
+package filesys
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// walkTree returns the types of the entries found by Walk, relative to root, and the paths of the errors.
+func walkTree(root string, opts WalkOptions) (map[string]os.FileMode, []string) {
+	var mutex sync.Mutex
+	entries := make(map[string]os.FileMode)
+	var errors []string
+	Walk(root, opts, func(path string, typ os.FileMode, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			errors = append(errors, path)
+		} else {
+			rel, _ := filepath.Rel(root, path)
+			entries[rel] = typ
+		}
+	})
+	sort.Strings(errors)
+	return entries, errors
+}
+
+func newWalkTree() string {
+	root, _ := ioutil.TempDir("", "walk")
+	os.MkdirAll(filepath.Join(root, "a", "b"), 0755)
+	os.MkdirAll(filepath.Join(root, "cache", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "file.txt"), []byte("file"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "a", "b", "file.txt"), []byte("file"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "a", "file.tmp"), []byte("file"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "cache", "sub", "file.txt"), []byte("file"), 0644)
+	os.Symlink(filepath.Join(root, "a"), filepath.Join(root, "link"))
+	return root
+}
+
+func TestWalk(t *testing.T) {
+	root := newWalkTree()
+	defer os.RemoveAll(root)
+
+	for _, workers := range []int{0, 1, 8} {
+		entries, errors := walkTree(root, WalkOptions{Workers: workers})
+
+		assert.Equal(t, map[string]os.FileMode{
+			".":                  os.ModeDir,
+			"a":                  os.ModeDir,
+			"a/b":                os.ModeDir,
+			"a/b/file.txt":       0,
+			"a/file.tmp":         0,
+			"cache":              os.ModeDir,
+			"cache/sub":          os.ModeDir,
+			"cache/sub/file.txt": 0,
+			"file.txt":           0,
+			"link":               os.ModeSymlink,
+		}, entries, "workers: %d", workers)
+		assert.Empty(t, errors)
+	}
+}
+
+func TestWalk_Workers(t *testing.T) {
+	root, _ := ioutil.TempDir("", "walk")
+	defer os.RemoveAll(root)
+	for i := 0; i < 50; i++ {
+		os.MkdirAll(filepath.Join(root, fmt.Sprintf("dir%d", i), "sub"), 0755)
+	}
+	var mutex sync.Mutex
+	count, maxGoroutines := 0, 0
+	before := runtime.NumGoroutine()
+
+	Walk(root, WalkOptions{Workers: 2}, func(path string, typ os.FileMode, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		count++
+		if n := runtime.NumGoroutine(); n > maxGoroutines {
+			maxGoroutines = n
+		}
+	})
+
+	assert.Equal(t, 101, count)
+	assert.True(t, maxGoroutines <= before+2, "expected at most 2 workers, got %d goroutines", maxGoroutines-before)
+}
+
+func TestWalk_SingleWorker(t *testing.T) {
+	root := newWalkTree()
+	defer os.RemoveAll(root)
+	var depths []int
+
+	Walk(root, WalkOptions{Workers: 1}, func(path string, typ os.FileMode, err error) {
+		if typ.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			depths = append(depths, strings.Count(rel, string(filepath.Separator)))
+		}
+	})
+
+	assert.Len(t, depths, 5)
+	assert.True(t, sort.IntsAreSorted(depths), "expected breadth first order, got depths %v", depths)
+}
+
+func TestWalk_Exclude(t *testing.T) {
+	root := newWalkTree()
+	defer os.RemoveAll(root)
+	var mutex sync.Mutex
+	var checked []string
+	exclude := func(path string, typ os.FileMode) bool {
+		mutex.Lock()
+		checked = append(checked, path)
+		mutex.Unlock()
+		return filepath.Base(path) == "cache" || filepath.Ext(path) == ".tmp"
+	}
+
+	entries, _ := walkTree(root, WalkOptions{Exclude: exclude})
+
+	assert.Equal(t, map[string]os.FileMode{
+		".":            os.ModeDir,
+		"a":            os.ModeDir,
+		"a/b":          os.ModeDir,
+		"a/b/file.txt": 0,
+		"file.txt":     0,
+		"link":         os.ModeSymlink,
+	}, entries)
+	assert.NotContains(t, checked, filepath.Join(root, "cache", "sub"), "excluded directory should not be read")
+}
+
+func TestWalk_File(t *testing.T) {
+	root := newWalkTree()
+	defer os.RemoveAll(root)
+
+	entries, errors := walkTree(filepath.Join(root, "file.txt"), WalkOptions{})
+
+	assert.Equal(t, map[string]os.FileMode{".": 0}, entries)
+	assert.Empty(t, errors)
+}
+
+func TestWalk_ReportsErrors(t *testing.T) {
+	root, _ := ioutil.TempDir("", "walk")
+	os.RemoveAll(root)
+
+	entries, errors := walkTree(root, WalkOptions{})
+
+	assert.Empty(t, entries)
+	assert.Equal(t, []string{root}, errors)
+}
+
+func TestWalk_FollowLinks(t *testing.T) {
+	root := newWalkTree()
+	defer os.RemoveAll(root)
+	outside, _ := ioutil.TempDir("", "outside")
+	defer os.RemoveAll(outside)
+	os.Symlink(filepath.Join(root, "file.txt"), filepath.Join(root, "file-link"))
+	os.Symlink(outside, filepath.Join(root, "outside"))
+	os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "dangling"))
+	os.Symlink(root, filepath.Join(root, "a", "b", "loop"))
+
+	entries, errors := walkTree(root, WalkOptions{FollowLinks: true})
+
+	assert.Equal(t, map[string]os.FileMode{
+		".":                  os.ModeDir,
+		"a":                  os.ModeDir,
+		"a/b":                os.ModeDir,
+		"a/b/file.txt":       0,
+		"a/file.tmp":         0,
+		"cache":              os.ModeDir,
+		"cache/sub":          os.ModeDir,
+		"cache/sub/file.txt": 0,
+		"file-link":          0,
+		"file.txt":           0,
+		"link":               os.ModeDir,
+		"link/b":             os.ModeDir,
+		"link/b/file.txt":    0,
+		"link/file.tmp":      0,
+	}, entries)
+	assert.Equal(t, []string{filepath.Join(root, "a", "b", "loop"), filepath.Join(root, "link", "b", "loop")}, errors)
+}
+
+func TestWalk_FollowLinks_Boundary(t *testing.T) {
+	root := newWalkTree()
+	defer os.RemoveAll(root)
+
+	entries, errors := walkTree(filepath.Join(root, "link"), WalkOptions{FollowLinks: true, Boundary: root})
+
+	assert.Equal(t, map[string]os.FileMode{
+		".":          os.ModeDir,
+		"b":          os.ModeDir,
+		"b/file.txt": 0,
+		"file.tmp":   0,
+	}, entries)
+	assert.Empty(t, errors)
+}
@@ -0,0 +1,43 @@
+package filesys
+
+import "time"
+
+// Op identifies the kind of change reported by a Watcher.
+type Op int
+
+// Changes reported by a Watcher.
+const (
+	Create Op = iota + 1 // a file was created in or moved into a watched directory
+	Write                // a file was closed after being written
+	Remove               // a file or directory was deleted or moved out of a watched directory
+	Rescan               // changes to the contents of a directory may have been missed
+)
+
+var opNames = map[Op]string{Create: "create", Write: "write", Remove: "remove", Rescan: "rescan"}
+
+func (op Op) String() string {
+	return opNames[op]
+}
+
+// Event describes a change to a file or directory.
+type Event struct {
+	Op   Op
+	Path string
+}
+
+// FileWatcher reports changes to the files in directory trees.  Events must be read from the Events channel until
+// the watcher is closed.
+type FileWatcher interface {
+	Events() <-chan Event
+	Watch(root string) error
+	Close() error
+}
+
+// WatcherOptions configures a Watcher.
+type WatcherOptions struct {
+	Budget       int                          // maximum number of directories to watch (0 for no limit)
+	PollInterval time.Duration                // interval for rescanning directories that are not watched
+	OnWatch      func(dir string, added bool) // called when a watch is added or removed (optional)
+	Fanotify     bool                         // use fanotify instead of inotify if it is available
+	Exclude      func(path string) bool       // returns true for directories that are not watched (optional)
+}
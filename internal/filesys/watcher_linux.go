@@ -0,0 +1,280 @@
+package filesys
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW
+
+var errBudgetExceeded = errors.New("watch budget exceeded")
+
+// Watcher uses inotify to report changes to the files in directory trees.  Watches are added for new subdirectories
+// as they are created, and a Rescan event is sent for each new subdirectory because files may be created in it before
+// its watch is added.  Subdirectories that cannot be watched because the watch budget or the inotify limit has been
+// reached are rescanned periodically instead.
+type Watcher struct {
+	events    chan Event
+	opts      WatcherOptions
+	fd        int
+	file      *os.File // inotify instance
+	mutex     sync.Mutex
+	roots     []string
+	dirs      map[int]string  // watched directories by watch descriptor
+	wds       map[string]int  // watch descriptors by directory
+	polled    map[string]bool // directories that are rescanned instead of being watched
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWatcher creates an inotify watcher.  Events must be read from the Events channel until the watcher is closed.
+func NewWatcher(opts WatcherOptions) (*Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		events: make(chan Event),
+		opts:   opts,
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int]string),
+		wds:    make(map[string]int),
+		polled: make(map[string]bool),
+		done:   make(chan struct{}),
+	}
+	go w.readEvents()
+	if opts.PollInterval > 0 {
+		go w.poll()
+	}
+	return w, nil
+}
+
+// Events returns the channel that receives the changes.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Close stops the watcher.  OnWatch is called for each of the removed watches.
+func (w *Watcher) Close() error {
+	err := os.ErrClosed
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.file.Close()
+		w.mutex.Lock()
+		for wd := range w.dirs {
+			w.forget(wd)
+		}
+		w.mutex.Unlock()
+	})
+	return err
+}
+
+// Watch adds watches for a directory and its subdirectories.
+func (w *Watcher) Watch(root string) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory: " + root)
+	}
+	w.mutex.Lock()
+	w.roots = append(w.roots, root)
+	w.mutex.Unlock()
+	w.addTree(root)
+	return nil
+}
+
+// Watches returns the number of watched directories.
+func (w *Watcher) Watches() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.wds)
+}
+
+// Polled returns the directories that are rescanned instead of being watched.
+func (w *Watcher) Polled() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	dirs := make([]string, 0, len(w.polled))
+	for dir := range w.polled {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// addTree adds watches for a directory and its subdirectories, nearest directories first.  Excluded directories are
+// skipped.  A subdirectory that cannot be watched is polled instead.
+func (w *Watcher) addTree(root string) {
+	opts := WalkOptions{Workers: 1, Sort: true, Exclude: func(path string, typ os.FileMode) bool {
+		return !typ.IsDir() || w.opts.Exclude != nil && w.opts.Exclude(path) || !w.watchDir(path)
+	}}
+	Walk(root, opts, func(path string, typ os.FileMode, err error) {
+		if err != nil {
+			log.Printf("Error walking %s: %v\n", path, err)
+		}
+	})
+}
+
+// watchDir adds a watch for a directory.  Returns false if the directory can't be watched.  The directory is polled if
+// the watch budget or the inotify limit has been reached.
+func (w *Watcher) watchDir(dir string) bool {
+	if err := w.add(dir); err == errBudgetExceeded || err == unix.ENOSPC {
+		log.Printf("Unable to watch %s (%v), polling instead\n", dir, err)
+		w.mutex.Lock()
+		w.polled[dir] = true
+		w.mutex.Unlock()
+		return false
+	} else if err != nil {
+		log.Printf("Error watching %s: %v\n", dir, err)
+		return false
+	}
+	return true
+}
+
+func (w *Watcher) add(dir string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.wds[dir]; ok {
+		return nil
+	}
+	if w.opts.Budget > 0 && len(w.wds) >= w.opts.Budget {
+		return errBudgetExceeded
+	}
+	wd, err := unix.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return err
+	}
+	if previous, ok := w.dirs[wd]; ok {
+		delete(w.wds, previous)
+		w.notify(previous, false)
+	}
+	w.dirs[wd] = dir
+	w.wds[dir] = wd
+	w.notify(dir, true)
+	return nil
+}
+
+// removeTree removes the watches and polling for a directory and its subdirectories.
+func (w *Watcher) removeTree(root string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for dir, wd := range w.wds {
+		if isInTree(root, dir) {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			w.forget(wd)
+		}
+	}
+	for dir := range w.polled {
+		if isInTree(root, dir) {
+			delete(w.polled, dir)
+		}
+	}
+}
+
+// forget removes the record of a watch.  Must be called with the mutex locked.
+func (w *Watcher) forget(wd int) {
+	if dir, ok := w.dirs[wd]; ok {
+		delete(w.dirs, wd)
+		delete(w.wds, dir)
+		w.notify(dir, false)
+	}
+}
+
+func (w *Watcher) notify(dir string, added bool) {
+	if w.opts.OnWatch != nil {
+		w.opts.OnWatch(dir, added)
+	}
+}
+
+func (w *Watcher) send(event Event) {
+	select {
+	case w.events <- event:
+	case <-w.done:
+	}
+}
+
+func (w *Watcher) readEvents() {
+	buf := make([]byte, unix.SizeofInotifyEvent*4096)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("Error reading inotify events: %v\n", err)
+			}
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + unix.SizeofInotifyEvent
+			offset = start + int(raw.Len)
+			w.handle(int(raw.Wd), raw.Mask, strings.TrimRight(string(buf[start:offset]), "\x00"))
+		}
+	}
+}
+
+// handle converts an inotify event to an Event.
+func (w *Watcher) handle(wd int, mask uint32, name string) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		w.mutex.Lock()
+		roots := append([]string(nil), w.roots...)
+		w.mutex.Unlock()
+		for _, root := range roots {
+			w.send(Event{Rescan, root})
+		}
+		return
+	}
+	w.mutex.Lock()
+	dir, ok := w.dirs[wd]
+	if ok && mask&unix.IN_IGNORED != 0 {
+		w.forget(wd)
+	}
+	w.mutex.Unlock()
+	if !ok || name == "" {
+		return
+	}
+	path := filepath.Join(dir, name)
+	isDir := mask&unix.IN_ISDIR != 0
+	switch {
+	case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 && isDir:
+		w.addTree(path)
+		w.send(Event{Rescan, path})
+	case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		w.send(Event{Create, path})
+	case mask&unix.IN_CLOSE_WRITE != 0:
+		w.send(Event{Write, path})
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		if isDir {
+			w.removeTree(path)
+		}
+		w.send(Event{Remove, path})
+	}
+}
+
+// poll periodically sends Rescan events for the directories that are not watched.
+func (w *Watcher) poll() {
+	ticker := time.NewTicker(w.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			for _, dir := range w.Polled() {
+				w.send(Event{Rescan, dir})
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package filesys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func newTestWatcher(t *testing.T, opts WatcherOptions) (*Watcher, string) {
+	root, _ := ioutil.TempDir("", "watcher")
+	w, err := NewWatcher(opts)
+	if err != nil {
+		t.Fatalf("Error creating watcher: %v", err)
+	}
+	return w, root
+}
+
+// waitFor reads events until the expected event is received.  Returns false if it is not received within a second.
+func waitFor(w FileWatcher, expected Event) bool {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-w.Events():
+			if event == expected {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func TestWatcher_Watch(t *testing.T) {
+	w, root := newTestWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(root)
+	defer w.Close()
+	os.MkdirAll(filepath.Join(root, "a", "b"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "file.txt"), []byte("file"), 0644)
+
+	assert.Nil(t, w.Watch(root))
+
+	assert.Equal(t, 3, w.Watches())
+	assert.Empty(t, w.Polled())
+	assert.NotNil(t, w.Watch(filepath.Join(root, "file.txt")), "expected an error for a file")
+	assert.NotNil(t, w.Watch(filepath.Join(root, "unknown")), "expected an error for a missing directory")
+}
+
+func TestWatcher_FileEvents(t *testing.T) {
+	w, root := newTestWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(root)
+	defer w.Close()
+	os.MkdirAll(filepath.Join(root, "dir"), 0755)
+	w.Watch(root)
+	path := filepath.Join(root, "dir", "file.txt")
+
+	go ioutil.WriteFile(path, []byte("file"), 0644)
+	assert.True(t, waitFor(w, Event{Create, path}), "expected create event")
+	assert.True(t, waitFor(w, Event{Write, path}), "expected write event")
+
+	go os.Rename(path, filepath.Join(root, "moved.txt"))
+	assert.True(t, waitFor(w, Event{Remove, path}), "expected remove event for old path")
+	assert.True(t, waitFor(w, Event{Create, filepath.Join(root, "moved.txt")}), "expected create event for new path")
+
+	go os.Remove(filepath.Join(root, "moved.txt"))
+	assert.True(t, waitFor(w, Event{Remove, filepath.Join(root, "moved.txt")}), "expected remove event")
+}
+
+func TestWatcher_NewDirectory(t *testing.T) {
+	var added, removed []string
+	w, root := newTestWatcher(t, WatcherOptions{OnWatch: func(dir string, add bool) {
+		if add {
+			added = append(added, dir)
+		} else {
+			removed = append(removed, dir)
+		}
+	}})
+	defer os.RemoveAll(root)
+	defer w.Close()
+	w.Watch(root)
+	dir := filepath.Join(root, "new")
+
+	go os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	assert.True(t, waitFor(w, Event{Rescan, dir}), "expected rescan of new directory")
+	assert.Eventually(t, func() bool { return w.Watches() == 3 }, time.Second, 10*time.Millisecond)
+	go ioutil.WriteFile(filepath.Join(dir, "sub", "file.txt"), []byte("file"), 0644)
+	assert.True(t, waitFor(w, Event{Write, filepath.Join(dir, "sub", "file.txt")}), "expected write event in new directory")
+
+	go os.RemoveAll(dir)
+	assert.True(t, waitFor(w, Event{Remove, dir}), "expected remove event for directory")
+	assert.Equal(t, 1, w.Watches())
+	assert.Equal(t, []string{root, dir, filepath.Join(dir, "sub")}, added)
+	assert.ElementsMatch(t, []string{dir, filepath.Join(dir, "sub")}, removed)
+}
+
+func TestWatcher_Budget(t *testing.T) {
+	w, root := newTestWatcher(t, WatcherOptions{Budget: 2, PollInterval: 10 * time.Millisecond})
+	defer os.RemoveAll(root)
+	defer w.Close()
+	os.MkdirAll(filepath.Join(root, "a", "sub"), 0755)
+	os.MkdirAll(filepath.Join(root, "b"), 0755)
+
+	w.Watch(root)
+
+	assert.Equal(t, 2, w.Watches())
+	assert.Equal(t, []string{filepath.Join(root, "a", "sub"), filepath.Join(root, "b")}, w.Polled())
+	assert.True(t, waitFor(w, Event{Rescan, filepath.Join(root, "b")}), "expected polling of unwatched directory")
+
+	go os.RemoveAll(filepath.Join(root, "b"))
+	assert.True(t, waitFor(w, Event{Remove, filepath.Join(root, "b")}), "expected remove event")
+	assert.Equal(t, []string{filepath.Join(root, "a", "sub")}, w.Polled())
+}
+
+func TestWatcher_Exclude(t *testing.T) {
+	w, root := newTestWatcher(t, WatcherOptions{Budget: 2, Exclude: func(path string) bool {
+		return filepath.Base(path) == "cache"
+	}})
+	defer os.RemoveAll(root)
+	defer w.Close()
+	os.MkdirAll(filepath.Join(root, "a", "cache"), 0755)
+	os.MkdirAll(filepath.Join(root, "cache", "sub"), 0755)
+
+	w.Watch(root)
+
+	assert.Equal(t, 2, w.Watches())
+	assert.Empty(t, w.Polled())
+}
+
+func TestWatcher_handle_Overflow(t *testing.T) {
+	w, root := newTestWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(root)
+	defer w.Close()
+	w.Watch(root)
+
+	go w.handle(-1, unix.IN_Q_OVERFLOW, "")
+
+	assert.True(t, waitFor(w, Event{Rescan, root}), "expected rescan after overflow")
+}
+
+func TestWatcher_Close(t *testing.T) {
+	var removed []string
+	w, root := newTestWatcher(t, WatcherOptions{OnWatch: func(dir string, added bool) {
+		if !added {
+			removed = append(removed, dir)
+		}
+	}})
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "dir"), 0755)
+	w.Watch(root)
+
+	assert.Nil(t, w.Close())
+	assert.ElementsMatch(t, []string{root, filepath.Join(root, "dir")}, removed)
+	assert.Equal(t, 0, w.Watches())
+	assert.Equal(t, os.ErrClosed, w.Close())
+	w.send(Event{Create, root}) // does not block
+}
@@ -0,0 +1,307 @@
+// Package metrics collects statistics about the daemon and writes them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const contentType = "text/plain; version=0.0.4"
+
+// Default is the registry for the daemon's metrics.
+var Default = NewRegistry()
+
+// Sample is a value of a metric that is calculated when the metrics are collected.
+type Sample struct {
+	Labels []string // label values, in the order of the metric's label names
+	Value  float64
+}
+
+// collector writes the current values of a metric.
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry contains the metrics to be exposed.
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mutex.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mutex.Unlock()
+}
+
+// NewCounter adds a counter to the registry.
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{vector{family: family{name, help, "counter", labels}, entries: make(map[string]*entry)}}
+	r.register(c)
+	return c
+}
+
+// NewGauge adds a gauge to the registry.
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{vector{family: family{name, help, "gauge", labels}, entries: make(map[string]*entry)}}
+	r.register(g)
+	return g
+}
+
+// NewGaugeFunc adds a gauge whose values are calculated by collect when the metrics are written.
+func (r *Registry) NewGaugeFunc(name string, help string, labels []string, collect func() []Sample) {
+	r.register(&gaugeFunc{family{name, help, "gauge", labels}, collect})
+}
+
+// NewHistogram adds a histogram to the registry.  buckets contains the upper bounds of the buckets in increasing
+// order.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{vector: vector{family: family{name, help, "histogram", labels}, entries: make(map[string]*entry)},
+		buckets: buckets}
+	r.register(h)
+	return h
+}
+
+// Write writes all of the metrics in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mutex.Unlock()
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buf)
+	}
+	return buf.Flush()
+}
+
+// ServeHTTP responds to a scrape request.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	r.Write(w)
+}
+
+// family contains the description of a metric.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (f *family) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escape(f.help, false), f.name, f.kind)
+}
+
+// writeSample writes a single value.  extra contains additional label name/value pairs.
+func (f *family) writeSample(w io.Writer, suffix string, labels []string, value float64, extra ...string) {
+	pairs := make([]string, 0, len(labels)+len(extra)/2)
+	for i, name := range f.labels {
+		pairs = append(pairs, name+`="`+escape(labels[i], true)+`"`)
+	}
+	for i := 0; i < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1], true)+`"`)
+	}
+	if len(pairs) == 0 {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, suffix, formatFloat(value))
+	} else {
+		fmt.Fprintf(w, "%s%s{%s} %s\n", f.name, suffix, strings.Join(pairs, ","), formatFloat(value))
+	}
+}
+
+// entry contains the values for one combination of labels.
+type entry struct {
+	labels []string
+	value  float64
+	counts []uint64 // histogram bucket counts
+	count  uint64   // histogram observations
+}
+
+// vector contains the values of a metric for each combination of labels.
+type vector struct {
+	family
+	mutex   sync.Mutex
+	entries map[string]*entry
+}
+
+// get returns the entry for the label values.  Must be called with the mutex locked.
+func (v *vector) get(labels []string) *entry {
+	if len(labels) != len(v.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", v.name, len(v.labels), len(labels)))
+	}
+	e := v.entries[key(labels)]
+	if e == nil {
+		e = &entry{labels: append([]string(nil), labels...)}
+		v.entries[key(labels)] = e
+	}
+	return e
+}
+
+// find returns the entry for the label values or an empty entry if there are no values.  Must be called with the mutex
+// locked.
+func (v *vector) find(labels []string) *entry {
+	if e := v.entries[key(labels)]; e != nil {
+		return e
+	}
+	return &entry{}
+}
+
+func key(labels []string) string {
+	return strings.Join(labels, "\xff")
+}
+
+// sorted returns the entries ordered by their label values.  Must be called with the mutex locked.
+func (v *vector) sorted() []*entry {
+	keys := make([]string, 0, len(v.entries))
+	for key := range v.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make([]*entry, len(keys))
+	for i, key := range keys {
+		entries[i] = v.entries[key]
+	}
+	return entries
+}
+
+// Value returns the current value for the label values.
+func (v *vector) Value(labels ...string) float64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.find(labels).value
+}
+
+func (v *vector) write(w io.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.writeHeader(w)
+	for _, e := range v.sorted() {
+		v.writeSample(w, "", e.labels, e.value)
+	}
+}
+
+// Counter is a metric that only increases.
+type Counter struct {
+	vector
+}
+
+// Add increases the counter for the label values.
+func (c *Counter) Add(value float64, labels ...string) {
+	if value < 0 {
+		panic(c.name + ": counter cannot decrease")
+	}
+	c.mutex.Lock()
+	c.get(labels).value += value
+	c.mutex.Unlock()
+}
+
+// Inc increments the counter for the label values.
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Gauge is a metric that can be set to any value.
+type Gauge struct {
+	vector
+}
+
+// Set sets the value of the gauge for the label values.
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.mutex.Lock()
+	g.get(labels).value = value
+	g.mutex.Unlock()
+}
+
+type gaugeFunc struct {
+	family
+	collect func() []Sample
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	g.writeHeader(w)
+	for _, s := range g.collect() {
+		g.writeSample(w, "", s.Labels, s.Value)
+	}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	vector
+	buckets []float64
+}
+
+// Observe adds a value to the histogram for the label values.
+func (h *Histogram) Observe(value float64, labels ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	e := h.get(labels)
+	if e.counts == nil {
+		e.counts = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			e.counts[i]++
+		}
+	}
+	e.count++
+	e.value += value
+}
+
+// Count returns the number of observations for the label values.
+func (h *Histogram) Count(labels ...string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.find(labels).count
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writeHeader(w)
+	for _, e := range h.sorted() {
+		for i, bound := range h.buckets {
+			var count uint64
+			if e.counts != nil {
+				count = e.counts[i]
+			}
+			h.writeSample(w, "_bucket", e.labels, float64(count), "le", formatFloat(bound))
+		}
+		h.writeSample(w, "_bucket", e.labels, float64(e.count), "le", "+Inf")
+		h.writeSample(w, "_sum", e.labels, e.value)
+		h.writeSample(w, "_count", e.labels, float64(e.count))
+	}
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escape escapes backslashes and line feeds.  Double quotes are also escaped in label values.
+func escape(value string, quotes bool) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	if quotes {
+		value = strings.Replace(value, `"`, `\"`, -1)
+	}
+	return value
+}
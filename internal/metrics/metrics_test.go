@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	tests := []struct {
+		name     string
+		register func(r *Registry)
+		expected string
+	}{
+		{"counter", func(r *Registry) {
+			c := r.NewCounter("ops_total", "Operations.", "action", "result")
+			c.Inc("store", "success")
+			c.Add(2, "store", "success")
+			c.Inc("trash", "error")
+		}, "# HELP ops_total Operations.\n# TYPE ops_total counter\n" +
+			"ops_total{action=\"store\",result=\"success\"} 3\n" +
+			"ops_total{action=\"trash\",result=\"error\"} 1\n"},
+		{"gauge without labels", func(r *Registry) {
+			r.NewGauge("size_bytes", "Size.").Set(1.5)
+		}, "# HELP size_bytes Size.\n# TYPE size_bytes gauge\nsize_bytes 1.5\n"},
+		{"gauge func", func(r *Registry) {
+			r.NewGaugeFunc("depth", "Queue depth.", []string{"backend"}, func() []Sample {
+				return []Sample{{[]string{"a \"quoted\"\\name"}, 4}}
+			})
+		}, "# HELP depth Queue depth.\n# TYPE depth gauge\ndepth{backend=\"a \\\"quoted\\\"\\\\name\"} 4\n"},
+		{"histogram", func(r *Registry) {
+			h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "backend")
+			h.Observe(0.05, "b")
+			h.Observe(0.5, "b")
+			h.Observe(2, "b")
+		}, "# HELP latency_seconds Latency.\n# TYPE latency_seconds histogram\n" +
+			"latency_seconds_bucket{backend=\"b\",le=\"0.1\"} 1\n" +
+			"latency_seconds_bucket{backend=\"b\",le=\"1\"} 2\n" +
+			"latency_seconds_bucket{backend=\"b\",le=\"+Inf\"} 3\n" +
+			"latency_seconds_sum{backend=\"b\"} 2.55\n" +
+			"latency_seconds_count{backend=\"b\"} 3\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewRegistry()
+			test.register(r)
+			var buf bytes.Buffer
+
+			err := r.Write(&buf)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, buf.String())
+		})
+	}
+}
+
+func TestCounter_Value(t *testing.T) {
+	c := NewRegistry().NewCounter("bytes_total", "Bytes.", "backend")
+
+	c.Add(10, "b")
+
+	assert.Equal(t, 10.0, c.Value("b"))
+	assert.Equal(t, 0.0, c.Value("other"))
+}
+
+func TestCounter_WrongLabels(t *testing.T) {
+	c := NewRegistry().NewCounter("bytes_total", "Bytes.", "backend")
+
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { c.Add(-1, "b") })
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("up", "Up.").Set(1)
+	w := httptest.NewRecorder()
+
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, contentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "# HELP up Up.\n# TYPE up gauge\nup 1\n", w.Body.String())
+}